@@ -0,0 +1,47 @@
+package tollbooth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// identityContextKey scopes the identity found by AfterAuth to the limiter it was given,
+// so other limiters handling the request keep their own keys.
+type identityContextKey struct {
+	lmt *limiter.Limiter
+}
+
+// BeforeAuth is a middleware limiting requests before they are authenticated, by IP address.
+// Mount it outside of the authentication middleware, so floods of unauthenticated requests,
+// e.g. credential stuffing, are rejected before they cost an authentication.
+// Nothing is authenticated yet, so keys can only come from the IP lookup, path, methods and headers.
+func BeforeAuth(lmt *limiter.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return LimitHandler(lmt, next)
+	}
+}
+
+// AfterAuth is a middleware limiting authenticated requests by the identity identityFromContext finds
+// in their context, e.g. the user ID set by the authentication middleware, in place of the IP address.
+// Mount it inside of the authentication middleware. Requests without identity are limited by IP address.
+// Only lmt keys on the identity, other limiters handling the request keep their own keys.
+// Use another limiter than the one of BeforeAuth, since a limiter decides only once per request.
+func AfterAuth(lmt *limiter.Limiter, identityFromContext func(ctx context.Context) (string, bool)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identity, found := identityFromContext(r.Context()); found && identity != "" {
+				r = r.WithContext(context.WithValue(r.Context(), identityContextKey{lmt: lmt}, identity))
+			}
+
+			serveLimited(lmt, next, w, r)
+		})
+	}
+}
+
+// identityFromRequest returns the identity AfterAuth set for lmt, and false when there is none.
+func identityFromRequest(lmt *limiter.Limiter, r *http.Request) (string, bool) {
+	identity, found := r.Context().Value(identityContextKey{lmt: lmt}).(string)
+	return identity, found
+}
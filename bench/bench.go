@@ -0,0 +1,205 @@
+// Package bench drives synthetic admissions through a limiter, to measure its throughput and allocations
+// across key distributions, e.g. to catch performance regressions or to size a deployment.
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// Distribution picks which key every admission is for.
+type Distribution interface {
+	// Keys returns how many distinct keys the distribution picks from.
+	Keys() int
+
+	// Sampler returns a function picking key indexes below Keys, drawing from r.
+	Sampler(r *rand.Rand) func() int
+}
+
+type uniform struct {
+	keys int
+}
+
+// Uniform picks every one of keys keys equally often. It panics when keys is below 1.
+func Uniform(keys int) Distribution {
+	if keys < 1 {
+		panic(fmt.Sprintf("bench: Uniform needs at least 1 key, got %d", keys))
+	}
+	return uniform{keys: keys}
+}
+
+func (u uniform) Keys() int {
+	return u.keys
+}
+
+func (u uniform) Sampler(r *rand.Rand) func() int {
+	return func() int { return r.Intn(u.keys) }
+}
+
+type zipf struct {
+	s    float64
+	keys int
+}
+
+// Zipf picks among keys keys following Zipf's law with exponent s, which must be greater than 1:
+// a few keys get most admissions, as with real traffic. The higher s, the more skewed.
+// It panics when s is not greater than 1 or keys is below 1.
+func Zipf(s float64, keys int) Distribution {
+	if !(s > 1) {
+		panic(fmt.Sprintf("bench: Zipf needs an exponent greater than 1, got %v", s))
+	}
+	if keys < 1 {
+		panic(fmt.Sprintf("bench: Zipf needs at least 1 key, got %d", keys))
+	}
+	return zipf{s: s, keys: keys}
+}
+
+func (z zipf) Keys() int {
+	return z.keys
+}
+
+func (z zipf) Sampler(r *rand.Rand) func() int {
+	sampler := rand.NewZipf(r, z.s, 1, uint64(z.keys-1))
+	return func() int { return int(sampler.Uint64()) }
+}
+
+// Config describes a run.
+type Config struct {
+	// Number of admissions.
+	Admissions int
+
+	// Distribution of the keys of the admissions.
+	Keys Distribution
+
+	// Number of goroutines sharing the admissions. Zero means GOMAXPROCS.
+	Concurrency int
+
+	// Seed of the key distribution, runs with the same seed pick the same keys.
+	Seed int64
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	// Number of admissions, and how many of them were admitted or limited.
+	Admissions int
+	Admitted   int
+	Limited    int
+
+	// Wall time of the run.
+	Duration time.Duration
+
+	// Heap allocations and allocated bytes per admission, including those of other goroutines.
+	AllocsPerOp float64
+	BytesPerOp  float64
+}
+
+// Throughput returns the admissions per second.
+func (result Result) Throughput() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	return float64(result.Admissions) / result.Duration.Seconds()
+}
+
+// keyNames formats the keys of distribution ahead of a run, so formatting does not count as allocations.
+// It panics when distribution is nil or has no keys, e.g. for a zero Config.
+func keyNames(distribution Distribution) []string {
+	if distribution == nil {
+		panic("bench: no key distribution, set Config.Keys, e.g. to Uniform or Zipf")
+	}
+	if keys := distribution.Keys(); keys < 1 {
+		panic(fmt.Sprintf("bench: key distribution needs at least 1 key, got %d", keys))
+	}
+
+	names := make([]string, distribution.Keys())
+	for i := range names {
+		names[i] = "key-" + strconv.Itoa(i) + "|/|"
+	}
+	return names
+}
+
+// Run sends cfg.Admissions admissions through lmt with LimitReached, and measures them.
+// It panics when cfg.Keys is not set.
+func Run(lmt *limiter.Limiter, cfg Config) Result {
+	names := keyNames(cfg.Keys)
+
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	var limited atomic.Int64
+	var wg sync.WaitGroup
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for worker := 0; worker < concurrency; worker++ {
+		admissions := cfg.Admissions / concurrency
+		if worker < cfg.Admissions%concurrency {
+			admissions++
+		}
+
+		wg.Add(1)
+		go func(seed int64, admissions int) {
+			defer wg.Done()
+
+			next := cfg.Keys.Sampler(rand.New(rand.NewSource(seed)))
+			var workerLimited int64
+			for i := 0; i < admissions; i++ {
+				if lmt.LimitReached(names[next()]) {
+					workerLimited++
+				}
+			}
+			limited.Add(workerLimited)
+		}(cfg.Seed+int64(worker), admissions)
+	}
+
+	wg.Wait()
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result := Result{
+		Admissions: cfg.Admissions,
+		Limited:    int(limited.Load()),
+		Duration:   duration,
+	}
+	result.Admitted = result.Admissions - result.Limited
+	if cfg.Admissions > 0 {
+		result.AllocsPerOp = float64(after.Mallocs-before.Mallocs) / float64(cfg.Admissions)
+		result.BytesPerOp = float64(after.TotalAlloc-before.TotalAlloc) / float64(cfg.Admissions)
+	}
+
+	return result
+}
+
+// Benchmark sends b.N admissions picked from keys through lmt, from GOMAXPROCS goroutines.
+// Call it from a benchmark, to compare configurations with go test -bench and benchstat:
+//
+//	func BenchmarkZipf(b *testing.B) {
+//		bench.Benchmark(b, tollbooth.NewLimiter(10, nil), bench.Zipf(1.1, 1<<20))
+//	}
+func Benchmark(b *testing.B, lmt *limiter.Limiter, keys Distribution) {
+	names := keyNames(keys)
+	var seed atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		next := keys.Sampler(rand.New(rand.NewSource(seed.Add(1))))
+		for pb.Next() {
+			lmt.LimitReached(names[next()])
+		}
+	})
+}
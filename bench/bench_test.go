@@ -0,0 +1,64 @@
+package bench
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+func TestRun(t *testing.T) {
+	lmt := limiter.New(nil).SetMax(1).SetBurst(1)
+
+	result := Run(lmt, Config{Admissions: 1000, Keys: Uniform(10), Concurrency: 3, Seed: 1})
+
+	if result.Admissions != 1000 || result.Admitted+result.Limited != 1000 {
+		t.Errorf("Every admission should be counted. Result: %+v", result)
+	}
+	if result.Admitted < 10 || result.Admitted > 20 {
+		t.Errorf("About one admission per key should be admitted. Admitted: %v", result.Admitted)
+	}
+	if result.Throughput() <= 0 {
+		t.Errorf("Throughput should be measured. Value: %v", result.Throughput())
+	}
+}
+
+func TestZipf(t *testing.T) {
+	next := Zipf(1.5, 1000).Sampler(rand.New(rand.NewSource(1)))
+
+	counts := make([]int, 1000)
+	for i := 0; i < 10000; i++ {
+		counts[next()]++
+	}
+
+	if counts[0] < counts[1] || counts[1] < counts[100] {
+		t.Errorf("Lower keys should be picked more often. Counts: %v %v %v", counts[0], counts[1], counts[100])
+	}
+}
+
+func BenchmarkUniform(b *testing.B) {
+	Benchmark(b, limiter.New(nil).SetMax(10).SetBurst(10), Uniform(1<<16))
+}
+
+func BenchmarkZipf(b *testing.B) {
+	Benchmark(b, limiter.New(nil).SetMax(10).SetBurst(10), Zipf(1.1, 1<<16))
+}
+
+func TestInvalidDistributions(t *testing.T) {
+	for name, fn := range map[string]func(){
+		"uniform without keys": func() { Uniform(0) },
+		"zipf without keys":    func() { Zipf(1.1, 0) },
+		"zipf exponent":        func() { Zipf(1, 10) },
+		"zero config":          func() { Run(limiter.New(nil), Config{}) },
+	} {
+		func() {
+			defer func() {
+				if message, ok := recover().(string); !ok || !strings.HasPrefix(message, "bench: ") {
+					t.Errorf("%s: should panic with a clear message. Got: %v", name, message)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,125 @@
+package tollbooth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// rebufferedBody replays the bytes already read by tollbooth before the rest of the original body.
+type rebufferedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyValuesFromRequest reads a bounded prefix of the request body and extracts the configured fields from it.
+// The prefix is put back in front of the remaining body, so the next handler still sees the full body.
+func bodyValuesFromRequest(lmt *limiter.Limiter, r *http.Request) [][]string {
+	fields := lmt.GetBodyKeyFields()
+	if len(fields) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	readLimit := lmt.GetBodyReadLimit()
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, readLimit))
+	r.Body = rebufferedBody{Reader: io.MultiReader(bytes.NewReader(prefix), r.Body), Closer: r.Body}
+	if err != nil {
+		return nil
+	}
+
+	truncated := int64(len(prefix)) >= readLimit
+
+	var values map[string]string
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		values = formBodyValues(prefix, truncated)
+	} else {
+		values = jsonBodyValues(prefix, fields)
+	}
+
+	bodyValues := [][]string{}
+	for _, field := range fields {
+		if value, found := values[field]; found && value != "" {
+			bodyValues = append(bodyValues, []string{field, value})
+		}
+	}
+
+	return bodyValues
+}
+
+// formBodyValues parses a urlencoded body prefix.
+// When the prefix was truncated, the last and possibly incomplete pair is dropped.
+func formBodyValues(prefix []byte, truncated bool) map[string]string {
+	if truncated {
+		lastAmpersand := bytes.LastIndexByte(prefix, '&')
+		if lastAmpersand < 0 {
+			return nil
+		}
+		prefix = prefix[:lastAmpersand]
+	}
+
+	form, err := url.ParseQuery(string(prefix))
+	if err != nil {
+		return nil
+	}
+
+	values := make(map[string]string, len(form))
+	for field := range form {
+		values[field] = form.Get(field)
+	}
+
+	return values
+}
+
+// jsonBodyValues scans the top-level object of a JSON body prefix for scalar fields.
+// Scanning stops at the first syntax error, so fields located before the truncation point are still found.
+func jsonBodyValues(prefix []byte, fields []string) map[string]string {
+	decoder := json.NewDecoder(bytes.NewReader(prefix))
+	decoder.UseNumber()
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+
+	wanted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		wanted[field] = true
+	}
+
+	values := make(map[string]string)
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		field, ok := token.(string)
+		if !ok {
+			break
+		}
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+
+		if !wanted[field] {
+			continue
+		}
+
+		switch value.(type) {
+		case string, json.Number, bool:
+			values[field] = fmt.Sprintf("%v", value)
+		}
+	}
+
+	return values
+}
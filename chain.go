@@ -0,0 +1,87 @@
+package tollbooth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// Chain is a middleware evaluating several limiters in order, e.g. per IP address, per user then global.
+// It stops at the first limiter rejecting the request, so later limiters do not spend tokens on it.
+// The rate limit headers are the ones of the strictest limiter: the rejecting one, or the one with the fewest remaining tokens.
+// Other headers, e.g. Connection: close or the X-Quota headers, are sent for every limiter which set them.
+// Every limiter sees the response of admitted requests, e.g. to refund it with limiter.SetCountResponse.
+func Chain(lmts ...*limiter.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = WithDecisionCache(r)
+
+			var strictest http.Header
+			var strictestInfo limiter.Info
+
+			// Headers which do not describe the rate, e.g. Connection: close or X-Quota-Remaining, of every limiter.
+			merged := make(http.Header)
+
+			admitted := w
+			keys := make([]string, len(lmts))
+			for i, lmt := range lmts {
+				headers := &headerRecorder{header: make(http.Header)}
+
+				httpError, info := LimitByRequestWithInfo(lmt, headers, r)
+				if httpError != nil {
+					copyHeaders(w, merged)
+					copyHeaders(w, headers.header)
+					writeLimitReached(lmt, w, r, httpError, info.Key)
+					return
+				}
+
+				// Skipped limiters have no limit, they are never the strictest.
+				if i == 0 || (info.Limit > 0 && (strictestInfo.Limit == 0 || info.Remaining < strictestInfo.Remaining)) {
+					strictest, strictestInfo = headers.header, info
+				}
+
+				for name, values := range headers.header {
+					if _, found := merged[name]; !found && !isRateHeader(lmt, name) {
+						merged[name] = values
+					}
+				}
+
+				admitted = throttleDownload(lmt, admitted, r, info.Key)
+				keys[i] = info.Key
+			}
+
+			copyHeaders(w, merged)
+			copyHeaders(w, strictest)
+			serveChain(lmts, keys, next, admitted, r)
+		})
+	}
+}
+
+// serveChain serves r with next through serveObserved of every limiter of a chain, so they all observe the response.
+func serveChain(lmts []*limiter.Limiter, keys []string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if len(lmts) == 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	serveObserved(lmts[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveChain(lmts[1:], keys[1:], next, w, r)
+	}), w, r, keys[0])
+}
+
+// isRateHeader returns whether the header name set by lmt describes its rate, so only the strictest limiter of a chain sends it.
+func isRateHeader(lmt *limiter.Limiter, name string) bool {
+	switch {
+	case strings.HasPrefix(name, "Ratelimit-"), name == "Retry-After",
+		name == "X-Rate-Limit-Limit", name == "X-Rate-Limit-Duration":
+		return true
+	}
+	return name == http.CanonicalHeaderKey(lmt.GetClientRateHeader())
+}
+
+func copyHeaders(w http.ResponseWriter, headers http.Header) {
+	for name, values := range headers {
+		w.Header()[name] = values
+	}
+}
@@ -0,0 +1,106 @@
+package tollbooth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// RequestInfo describes a request in plain terms, for framework adapters which do not use net/http.
+type RequestInfo struct {
+	// Remote IP address of the client. It is used as is, regardless of the limiter IP lookup.
+	IP string
+
+	// URL path of the request.
+	Path string
+
+	// HTTP method of the request.
+	Method string
+
+	// Request headers.
+	Headers map[string]string
+
+	// Basic auth username, if any.
+	Username string
+
+	// Context holding values for SetContextValues and SetContextKeys. Nil means context.Background().
+	Context context.Context
+}
+
+// Decision is the outcome of Check.
+type Decision struct {
+	// Whether the request may proceed.
+	Allowed bool
+
+	// HTTP status code to respond with when the request is not allowed.
+	StatusCode int
+
+	// Message to respond with when the request is not allowed.
+	Message string
+
+	// Content-Type of Message.
+	ContentType string
+
+	// Response headers to set, whether the request is allowed or not.
+	Headers map[string]string
+}
+
+// Check decides whether a request described by info may proceed, so framework adapters can be written
+// without building a net/http request. It does not call the OnLimitReached function.
+func Check(lmt *limiter.Limiter, info RequestInfo) Decision {
+	ctx := info.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	r := (&http.Request{
+		Method:     info.Method,
+		URL:        &url.URL{Path: info.Path},
+		Header:     make(http.Header, len(info.Headers)),
+		RemoteAddr: info.IP,
+	}).WithContext(contextWithRemoteIP(ctx, info.IP))
+
+	for key, value := range info.Headers {
+		r.Header.Set(key, value)
+	}
+
+	if info.Username != "" {
+		r.SetBasicAuth(info.Username, "")
+	}
+
+	w := &headerRecorder{header: make(http.Header)}
+	httpError := LimitByRequest(lmt, w, r)
+
+	decision := Decision{Allowed: httpError == nil, Headers: make(map[string]string, len(w.header))}
+	for key := range w.header {
+		decision.Headers[key] = w.header.Get(key)
+	}
+
+	if httpError != nil {
+		decision.StatusCode = httpError.StatusCode
+		decision.Message = httpError.Message
+		decision.ContentType = lmt.GetMessageContentType()
+	}
+
+	return decision
+}
+
+// headerRecorder is a http.ResponseWriter which only keeps headers.
+type headerRecorder struct {
+	header http.Header
+}
+
+func (h *headerRecorder) Header() http.Header { return h.header }
+
+func (h *headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+
+func (h *headerRecorder) WriteHeader(int) {}
+
+type remoteIPContextKey struct{}
+
+// contextWithRemoteIP overrides the IP lookup of the limiter for a request.
+func contextWithRemoteIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, remoteIPContextKey{}, ip)
+}
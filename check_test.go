@@ -0,0 +1,45 @@
+package tollbooth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+func TestCheck(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "X-Real-IP"}).
+		SetBasicAuthUsers([]string{"jane"}).
+		SetMessage("slow down")
+
+	info := RequestInfo{
+		IP:       "10.1.2.3",
+		Path:     "/search",
+		Method:   http.MethodGet,
+		Headers:  map[string]string{"X-Request-Id": "abc"},
+		Username: "jane",
+	}
+
+	decision := Check(lmt, info)
+	if !decision.Allowed {
+		t.Fatalf("First request should be allowed. Decision: %+v", decision)
+	}
+	if decision.Headers["Ratelimit-Remaining"] != "0" {
+		t.Errorf("RateLimit-Remaining has wrong value. Headers: %v", decision.Headers)
+	}
+
+	decision = Check(lmt, info)
+	if decision.Allowed || decision.StatusCode != http.StatusTooManyRequests || decision.Message != "slow down" {
+		t.Errorf("Second request should be limited. Decision: %+v", decision)
+	}
+	if decision.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("ContentType has wrong value. Decision: %+v", decision)
+	}
+
+	// Another username gets its own bucket.
+	info.Username = "bob"
+	if decision := Check(lmt, info); !decision.Allowed {
+		t.Errorf("Request from another user should be allowed. Decision: %+v", decision)
+	}
+}
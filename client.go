@@ -0,0 +1,128 @@
+package tollbooth
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// Policy is a rate limit policy advertised by a server.
+type Policy struct {
+	// Number of requests allowed per Window.
+	Limit int
+
+	// Window is the duration of the policy.
+	Window time.Duration
+}
+
+// ParsePolicy parses the RateLimit-Policy header, e.g. "100;w=60", as sent by the middlewares of this package.
+// Only the first policy is used when the server sends several. It returns false if there is no valid policy.
+func ParsePolicy(header http.Header) (Policy, bool) {
+	value := strings.TrimSpace(strings.Split(header.Get("RateLimit-Policy"), ",")[0])
+	if value == "" {
+		return Policy{}, false
+	}
+
+	parameters := strings.Split(value, ";")
+
+	limit, err := strconv.Atoi(strings.TrimSpace(parameters[0]))
+	if err != nil || limit <= 0 {
+		return Policy{}, false
+	}
+
+	policy := Policy{Limit: limit, Window: time.Second}
+	for _, parameter := range parameters[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+		if name != "w" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			policy.Window = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return policy, true
+}
+
+// ClientTransport is a http.RoundTripper pacing requests to every host with the rate this host advertises,
+// so clients slow down before getting rejected. Its zero value is ready to use.
+type ClientTransport struct {
+	// Base sends the requests. Nil means http.DefaultTransport.
+	Base http.RoundTripper
+
+	// RateHeader is the header carrying the recommended requests per second, see limiter.SetClientRateHeader.
+	// It takes precedence over RateLimit-Policy. Empty means only RateLimit-Policy is used.
+	RateHeader string
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// RoundTrip waits until the host of req may receive another request, then sends it.
+func (t *ClientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limiter := t.limiterFor(req.URL.Host); limiter != nil {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		t.learn(req.URL.Host, resp.Header)
+	}
+	return resp, err
+}
+
+func (t *ClientTransport) limiterFor(host string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limiters[host]
+}
+
+// learn updates the pace of host with the rate advertised in header.
+func (t *ClientTransport) learn(host string, header http.Header) {
+	limit, burst, ok := t.advertisedRate(header)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.limiters == nil {
+		t.limiters = make(map[string]*rate.Limiter)
+	}
+
+	limiter, found := t.limiters[host]
+	if !found {
+		t.limiters[host] = rate.NewLimiter(limit, burst)
+		return
+	}
+	limiter.SetLimit(limit)
+	limiter.SetBurst(burst)
+}
+
+// advertisedRate reads the requests per second and burst advertised in header.
+func (t *ClientTransport) advertisedRate(header http.Header) (rate.Limit, int, bool) {
+	if t.RateHeader != "" {
+		if perSecond, err := strconv.ParseFloat(header.Get(t.RateHeader), 64); err == nil && perSecond > 0 {
+			return rate.Limit(perSecond), int(math.Max(1, math.Ceil(perSecond))), true
+		}
+	}
+
+	if policy, ok := ParsePolicy(header); ok {
+		return rate.Limit(float64(policy.Limit) / policy.Window.Seconds()), policy.Limit, true
+	}
+
+	return 0, 0, false
+}
@@ -0,0 +1,169 @@
+// Command tollbooth-demo runs a server with a few preconfigured policies, a traffic generator hitting them,
+// and the debug endpoints, to see how tollbooth limits requests and which headers it sends before integrating it.
+//
+//	go run ./cmd/tollbooth-demo
+//	curl -i -H "X-Real-IP: 10.0.0.1" localhost:8080/strict
+//	open http://localhost:8080/debug/tollbooth?format=html
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didip/tollbooth/v8"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// policy is a limiter mounted on its own path.
+type policy struct {
+	path        string
+	description string
+	lmt         *limiter.Limiter
+}
+
+// newPolicies returns the limiters the demo serves, one per path.
+func newPolicies() ([]policy, error) {
+	lookup := limiter.IPLookup{Name: limiter.LookupXRealIP}
+
+	strict := tollbooth.NewLimiter(1, nil).ForRoute("strict").SetIPLookup(lookup)
+
+	burst := tollbooth.NewLimiter(1, nil).ForRoute("burst").SetIPLookup(lookup)
+	if err := burst.SetLimits(
+		limiter.Rate{Max: 5, Per: time.Second, Burst: 10},
+		limiter.Rate{Max: 100, Per: time.Minute, Burst: 100},
+	); err != nil {
+		return nil, err
+	}
+
+	wait := tollbooth.NewLimiter(2, nil).ForRoute("wait").SetIPLookup(lookup).
+		SetLeakyBucket(true).
+		SetWaitMode(2*time.Second, 50)
+
+	quota := tollbooth.NewLimiter(100, nil).ForRoute("quota").SetIPLookup(lookup)
+	if err := quota.SetQuota(limiter.Quota{Allowance: 20, Period: limiter.QuotaDaily}); err != nil {
+		return nil, err
+	}
+
+	return []policy{
+		{"/strict", "1 request per second", strict},
+		{"/burst", "bursts of 10, 5 requests per second and 100 per minute", burst},
+		{"/wait", "2 requests per second, excess requests wait up to 2s in a queue", wait},
+		{"/quota", "20 requests per day", quota},
+	}, nil
+}
+
+// generator sends traffic to the policies from a few fake clients, and counts the responses.
+type generator struct {
+	sync.Mutex
+	statuses map[string]int
+}
+
+// run sends rps requests per second, spread over clients, until the process exits.
+func (g *generator) run(baseURL string, policies []policy, rps, clients int) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		<-ticker.C
+
+		p := policies[i%len(policies)]
+		ip := fmt.Sprintf("10.0.0.%d", i%clients+1)
+
+		go func() {
+			req, err := http.NewRequest(http.MethodGet, baseURL+p.path, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("X-Real-IP", ip)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("traffic: %v", err)
+				return
+			}
+			resp.Body.Close()
+
+			g.Lock()
+			g.statuses[fmt.Sprintf("%s %d", p.path, resp.StatusCode)]++
+			g.Unlock()
+		}()
+	}
+}
+
+// report logs the responses counted since the previous report.
+func (g *generator) report() {
+	g.Lock()
+	lines := make([]string, 0, len(g.statuses))
+	for status, count := range g.statuses {
+		lines = append(lines, fmt.Sprintf("%s: %d", status, count))
+	}
+	g.statuses = make(map[string]int)
+	g.Unlock()
+
+	sort.Strings(lines)
+	log.Printf("traffic: %s", strings.Join(lines, ", "))
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	rps := flag.Int("rps", 20, "requests per second sent by the traffic generator, 0 disables it")
+	clients := flag.Int("clients", 3, "number of clients simulated by the traffic generator")
+	decisions := flag.Bool("decisions", false, "write every admission decision to stdout as JSON lines")
+	flag.Parse()
+
+	policies, err := newPolicies()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	lmts := make([]*limiter.Limiter, 0, len(policies))
+	for _, p := range policies {
+		p := p
+		if *decisions {
+			p.lmt.SetDecisionLog(os.Stdout, 1)
+		}
+		lmts = append(lmts, p.lmt)
+
+		mux.Handle(p.path, tollbooth.LimitFuncHandler(p.lmt, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello from %s: %s.\n", p.path, p.description)
+		}))
+	}
+
+	expvar.Publish("tollbooth", expvar.Func(func() interface{} {
+		summaries := make([]limiter.Summary, 0, len(lmts))
+		for _, lmt := range lmts {
+			summaries = append(summaries, lmt.Summary(10))
+		}
+		return summaries
+	}))
+	mux.Handle("/debug/tollbooth", tollbooth.SummaryHandler(10, lmts...))
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Printf("listening on http://%s", *addr)
+	for _, p := range policies {
+		log.Printf("  %-8s %s", p.path, p.description)
+	}
+	log.Printf("  /debug/tollbooth and /debug/vars show the limiters, send X-Real-IP to pick the client")
+
+	if *rps > 0 && *clients > 0 {
+		g := &generator{statuses: make(map[string]int)}
+		go g.run("http://"+*addr, policies, *rps, *clients)
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				g.report()
+			}
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
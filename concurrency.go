@@ -0,0 +1,38 @@
+package tollbooth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/didip/tollbooth/v8/errors"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// LimitConcurrencyHandler is a middleware capping the requests in flight with cl, in total and per key.
+// The slot of a request is released when next returns. lmt does not rate-limit here: it only builds
+// the keys, e.g. by IP address, decides which requests are skipped, and provides the rejection response.
+// Wrap the result with LimitHandler to rate-limit too.
+func LimitConcurrencyHandler(lmt *limiter.Limiter, cl *limiter.ConcurrencyLimiter, next http.Handler) http.Handler {
+	middle := func(w http.ResponseWriter, r *http.Request) {
+		if ShouldSkipLimiter(lmt, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var key string
+		if sliceKeys := BuildKeys(lmt, r); len(sliceKeys) > 0 {
+			key = strings.Join(sliceKeys[0], "|")
+		}
+
+		if !cl.Acquire(key) {
+			lmt.ExecOnViolation(key, lmt.RequestID(r))
+			writeLimitReached(lmt, w, r, &errors.HTTPError{Message: lmt.GetMessage(), StatusCode: lmt.GetStatusCode()}, key)
+			return
+		}
+		defer cl.Release(key)
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(middle)
+}
@@ -0,0 +1,36 @@
+package tollbooth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+type connCounterKey struct{}
+
+// ConnContext counts the requests served over every connection, for limiter.SetMaxRequestsPerConn.
+// Set it as the ConnContext of your http.Server.
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connCounterKey{}, new(atomic.Int64))
+}
+
+// capConnection asks the client to reconnect once its connection served the maximum number of requests.
+// "Connection: close" closes HTTP/1.1 connections, and makes the HTTP/2 server send GOAWAY.
+func capConnection(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request) {
+	max := lmt.GetMaxRequestsPerConn()
+	if max <= 0 {
+		return
+	}
+
+	counter, ok := r.Context().Value(connCounterKey{}).(*atomic.Int64)
+	if !ok {
+		return
+	}
+
+	if counter.Add(1) >= max {
+		w.Header().Set("Connection", "close")
+	}
+}
@@ -0,0 +1,84 @@
+package tollbooth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/didip/tollbooth/v8/errors"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+type decisionCacheKey struct{}
+
+// cachedDecision is the outcome of LimitByRequestWithInfo for a limiter.
+type cachedDecision struct {
+	httpError *errors.HTTPError
+	info      limiter.Info
+
+	// Whether the tokens taken for the request were given back.
+	refunded bool
+}
+
+// decisionCache holds the decisions made for a request, by limiter.
+type decisionCache struct {
+	sync.Mutex
+	decisions map[*limiter.Limiter]cachedDecision
+}
+
+// WithDecisionCache returns r with a cache of the rate limiting decisions made for it,
+// so a limiter consulted several times for the same request, e.g. by nested routers, charges it only once.
+// The middlewares of this package add it. Custom middlewares calling LimitByRequestWithInfo
+// should add it too, and pass the returned request down.
+func WithDecisionCache(r *http.Request) *http.Request {
+	if _, found := r.Context().Value(decisionCacheKey{}).(*decisionCache); found {
+		return r
+	}
+
+	cache := &decisionCache{decisions: make(map[*limiter.Limiter]cachedDecision)}
+	return r.WithContext(context.WithValue(r.Context(), decisionCacheKey{}, cache))
+}
+
+// cachedDecisionFor returns the decision made by lmt for r, and false when none is cached.
+func cachedDecisionFor(lmt *limiter.Limiter, r *http.Request) (cachedDecision, bool) {
+	cache, found := r.Context().Value(decisionCacheKey{}).(*decisionCache)
+	if !found {
+		return cachedDecision{}, false
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	decision, found := cache.decisions[lmt]
+	return decision, found
+}
+
+// cacheDecision remembers the decision made by lmt for r, when r has a decision cache.
+func cacheDecision(lmt *limiter.Limiter, r *http.Request, decision cachedDecision) {
+	cache, found := r.Context().Value(decisionCacheKey{}).(*decisionCache)
+	if !found {
+		return
+	}
+
+	cache.Lock()
+	cache.decisions[lmt] = decision
+	cache.Unlock()
+}
+
+// refundOnce gives back the tokens lmt took for r from key, unless they already were,
+// e.g. by a nested middleware of the same limiter or by RefundClientErrors.
+func refundOnce(lmt *limiter.Limiter, r *http.Request, key string) {
+	if cache, found := r.Context().Value(decisionCacheKey{}).(*decisionCache); found {
+		cache.Lock()
+		decision := cache.decisions[lmt]
+		refunded := decision.refunded
+		decision.refunded = true
+		cache.decisions[lmt] = decision
+		cache.Unlock()
+
+		if refunded {
+			return
+		}
+	}
+
+	lmt.Refund(key, lmt.CostForRequest(r))
+}
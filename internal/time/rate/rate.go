@@ -80,6 +80,13 @@ func (lim *Limiter) Burst() int {
 	return lim.burst
 }
 
+// Last returns the last time the limiter's tokens field was updated.
+func (lim *Limiter) Last() time.Time {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.last
+}
+
 // NewLimiter returns a new Limiter that allows events up to rate r and permits
 // bursts of at most b tokens.
 func NewLimiter(r Limit, b int) *Limiter {
@@ -309,6 +316,22 @@ func (lim *Limiter) SetBurstAt(now time.Time, newBurst int) {
 	lim.burst = newBurst
 }
 
+// RefundAt gives n tokens back to the limiter at now, up to its burst.
+func (lim *Limiter) RefundAt(now time.Time, n int) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	now, _, tokens := lim.advance(now)
+
+	tokens += float64(n)
+	if burst := float64(lim.burst); tokens > burst {
+		tokens = burst
+	}
+
+	lim.last = now
+	lim.tokens = tokens
+}
+
 // reserveN is a helper method for AllowN, ReserveN, and WaitN.
 // maxFutureReserve specifies the maximum reservation wait duration allowed.
 // reserveN returns Reservation, not *Reservation, to avoid allocation in AllowN and WaitN.
@@ -4,7 +4,9 @@ package libstring
 import (
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/didip/tollbooth/v8/limiter"
 )
@@ -19,11 +21,39 @@ func StringInSlice(sliceString []string, needle string) bool {
 	return false
 }
 
+// MatchWildcard reports whether value matches pattern, where "*" in pattern matches any sequence of characters.
+// A pattern without "*" matches only the exact value.
+func MatchWildcard(pattern, value string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == value
+	}
+
+	parts := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
 // RemoteIPFromIPLookup picks an ip address explicitly from limiter.IPLookup criteria.
 // This function is intended to replace RemoteIP function.
 func RemoteIPFromIPLookup(ipLookup limiter.IPLookup, r *http.Request) string {
-	switch ipLookup.Name {
-	case "RemoteAddr":
+	header := ipLookup.Header()
+
+	switch {
+	case ipLookup.Name == limiter.LookupRemoteAddr:
 		// 1. Cover the basic use cases for both ipv4 and ipv6
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
@@ -32,8 +62,8 @@ func RemoteIPFromIPLookup(ipLookup limiter.IPLookup, r *http.Request) string {
 		}
 		return ip
 
-	case "X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP":
-		ipAddrListCommaSeparated := r.Header.Values(ipLookup.Name)
+	case header != "":
+		ipAddrListCommaSeparated := r.Header.Values(header)
 
 		ipAddrCommaSeparated := strings.Join(ipAddrListCommaSeparated, ",")
 
@@ -42,6 +72,10 @@ func RemoteIPFromIPLookup(ipLookup limiter.IPLookup, r *http.Request) string {
 			ips[i] = strings.TrimSpace(p)
 		}
 
+		if ipLookup.TrustedHops > 0 {
+			return remoteIPFromTrustedHops(ips, ipLookup.TrustedHops, r)
+		}
+
 		ipIndex := len(ips) - 1 - ipLookup.IndexFromRight
 		if ipIndex < 0 {
 			ipIndex = 0
@@ -53,10 +87,88 @@ func RemoteIPFromIPLookup(ipLookup limiter.IPLookup, r *http.Request) string {
 	return ""
 }
 
+// PeerIdentityFromXFCC picks the URI, e.g. a SPIFFE ID, of the closest peer from an X-Forwarded-Client-Cert value.
+// Proxies append their client's certificate, so the closest peer is the rightmost element.
+// It returns empty string if the element has no URI.
+func PeerIdentityFromXFCC(xfcc string) string {
+	elements := strings.Split(xfcc, ",")
+	closest := elements[len(elements)-1]
+
+	for _, pair := range strings.Split(closest, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && strings.EqualFold(key, "URI") {
+			return strings.Trim(value, `"`)
+		}
+	}
+
+	return ""
+}
+
+// RequestStartFromHeader parses an X-Request-Start value set by the fronting proxy, e.g. "t=1700000000.123".
+// The timestamp can be in seconds, milliseconds or microseconds since epoch, like nginx and Heroku send it.
+// It returns false if the value cannot be parsed.
+func RequestStartFromHeader(value string) (time.Time, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "t=")
+
+	timestamp, err := strconv.ParseFloat(value, 64)
+	if err != nil || timestamp <= 0 {
+		return time.Time{}, false
+	}
+
+	switch {
+	case timestamp > 1e15:
+		return time.UnixMicro(int64(timestamp)), true
+	case timestamp > 1e12:
+		return time.UnixMicro(int64(timestamp * 1e3)), true
+	default:
+		return time.UnixMicro(int64(timestamp * 1e6)), true
+	}
+}
+
+// WaitBudgetFromHeader parses how long a caller is willing to wait, as milliseconds, e.g. "250",
+// or as a duration, e.g. "250ms" or "1.5s". It returns false if the value cannot be parsed or is negative.
+func WaitBudgetFromHeader(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+
+	if milliseconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(milliseconds * float64(time.Millisecond)), milliseconds >= 0
+	}
+
+	budget, err := time.ParseDuration(value)
+	if err != nil || budget < 0 {
+		return 0, false
+	}
+	return budget, true
+}
+
+// remoteIPFromTrustedHops picks the entry appended by the outermost of trustedHops proxies.
+// Each proxy appends the address it received the request from, so the client is trustedHops entries from the right.
+func remoteIPFromTrustedHops(ips []string, trustedHops int, r *http.Request) string {
+	nonEmptyIPs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip != "" {
+			nonEmptyIPs = append(nonEmptyIPs, ip)
+		}
+	}
+
+	if len(nonEmptyIPs) < trustedHops {
+		// The request did not pass through all of our proxies.
+		return RemoteIPFromIPLookup(limiter.IPLookup{Name: limiter.LookupRemoteAddr}, r)
+	}
+
+	return nonEmptyIPs[len(nonEmptyIPs)-trustedHops]
+}
+
 // CanonicalizeIP returns a form of ip suitable for comparison to other IPs.
 // For IPv4 addresses, this is simply the whole string.
 // For IPv6 addresses, this is the /64 prefix.
 func CanonicalizeIP(ip string) string {
+	return CanonicalizeIPWithPrefix(ip, 64)
+}
+
+// CanonicalizeIPWithPrefix is like CanonicalizeIP, but groups IPv6 addresses by a prefix of prefixLength bits.
+// A prefixLength of 128 keeps the whole IPv6 address.
+func CanonicalizeIPWithPrefix(ip string, prefixLength int) string {
 	isIPv6 := false
 	// This is how net.ParseIP decides if an address is IPv6
 	// https://cs.opensource.google/go/go/+/refs/tags/go1.17.7:src/net/ip.go;l=704
@@ -77,24 +189,21 @@ func CanonicalizeIP(ip string) string {
 
 	// By default, the string representation of a net.IPNet (masked IP address) is just
 	// "full_address/mask_bits". But using that will result in different addresses with
-	// the same /64 prefix comparing differently. So we need to zero out the last 64 bits
+	// the same prefix comparing differently. So we need to zero out the bits after the prefix
 	// so that all IPs in the same prefix will be the same.
-	//
-	// Note: When 1.18 is the minimum Go version, this can be written more cleanly like:
-	// netip.PrefixFrom(netip.MustParseAddr(ipv6), 64).Masked().Addr().String()
-	// (With appropriate error checking.)
 
 	ipv6 := net.ParseIP(ip)
 	if ipv6 == nil {
 		return ip
 	}
 
-	const bytesToZero = (128 - 64) / 8
-	for i := len(ipv6) - bytesToZero; i < len(ipv6); i++ {
-		ipv6[i] = 0
+	mask := net.CIDRMask(prefixLength, 128)
+	if mask == nil {
+		// Invalid prefix length, fall back to the whole address.
+		return ipv6.String()
 	}
 
 	// Note that this doesn't have the "/64" suffix customary with a CIDR representation,
 	// but those three bytes add nothing for us.
-	return ipv6.String()
+	return ipv6.Mask(mask).String()
 }
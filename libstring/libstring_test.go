@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/didip/tollbooth/v8/limiter"
 )
@@ -178,3 +179,149 @@ func TestCanonicalizeIP(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerIdentityFromXFCC(t *testing.T) {
+	testCases := map[string]string{
+		`By=spiffe://cluster.local/ns/default/sa/api;Hash=abc;URI=spiffe://cluster.local/ns/default/sa/web`: "spiffe://cluster.local/ns/default/sa/web",
+		`Hash=abc;URI=spiffe://a,By=x;Hash=def;URI="spiffe://b"`:                                            "spiffe://b",
+		`Hash=abc;Subject="CN=web"`: "",
+		``:                          "",
+	}
+
+	for xfcc, expected := range testCases {
+		if identity := PeerIdentityFromXFCC(xfcc); identity != expected {
+			t.Errorf("Did not get the right identity for %q. Identity: %v", xfcc, identity)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	testCases := []struct {
+		pattern, value string
+		expected       bool
+	}{
+		{"mobile-ios", "mobile-ios", true},
+		{"mobile-ios", "mobile-android", false},
+		{"mobile-*", "mobile-android", true},
+		{"mobile-*", "desktop", false},
+		{"*-beta", "ios-beta", true},
+		{"ios-*-beta", "ios-17-beta", true},
+		{"ios-*-beta", "ios-beta", false},
+		{"a*a", "a", false},
+		{"*", "", true},
+	}
+
+	for _, tc := range testCases {
+		if MatchWildcard(tc.pattern, tc.value) != tc.expected {
+			t.Errorf("MatchWildcard(%q, %q) should be %v.", tc.pattern, tc.value, tc.expected)
+		}
+	}
+}
+
+func TestCanonicalizeIPWithPrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		ip           string
+		prefixLength int
+		want         string
+	}{
+		{
+			name:         "IPv4 unchanged",
+			ip:           "1.2.3.4",
+			prefixLength: 48,
+			want:         "1.2.3.4",
+		},
+		{
+			name:         "IPv6 /48",
+			ip:           "2001:0db8:85a3:1234:0000:8a2e:0370:7334",
+			prefixLength: 48,
+			want:         "2001:db8:85a3::",
+		},
+		{
+			name:         "IPv6 whole address",
+			ip:           "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			prefixLength: 128,
+			want:         "2001:db8:85a3::8a2e:370:7334",
+		},
+		{
+			name:         "IPv6 invalid prefix length",
+			ip:           "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+			prefixLength: 129,
+			want:         "2001:db8:85a3::8a2e:370:7334",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalizeIPWithPrefix(tt.ip, tt.prefixLength); got != tt.want {
+				t.Errorf("CanonicalizeIPWithPrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteIPTrustedHops(t *testing.T) {
+	request, err := http.NewRequest("GET", "/", strings.NewReader("Hello, world!"))
+	if err != nil {
+		t.Errorf("Unable to create new HTTP request. Error: %v", err)
+	}
+
+	request.RemoteAddr = "10.0.0.2:4321"
+
+	// A client prepended a fake entry, then passed through our 2 proxies.
+	request.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.1")
+
+	ip := RemoteIPFromIPLookup(limiter.IPLookup{Name: "X-Forwarded-For", TrustedHops: 2}, request)
+	if ip != "1.2.3.4" {
+		t.Errorf("Did not get the right IP. IP: %v", ip)
+	}
+
+	// Fewer entries than trusted hops, so the request did not pass all proxies.
+	ip = RemoteIPFromIPLookup(limiter.IPLookup{Name: "X-Forwarded-For", TrustedHops: 4}, request)
+	if ip != "10.0.0.2" {
+		t.Errorf("Did not fall back to RemoteAddr. IP: %v", ip)
+	}
+}
+
+func TestRequestStartFromHeader(t *testing.T) {
+	expected := time.Unix(1700000000, 500000000)
+
+	for _, value := range []string{"t=1700000000.5", "1700000000500", "t=1700000000500000"} {
+		start, ok := RequestStartFromHeader(value)
+		if !ok || !start.Equal(expected) {
+			t.Errorf("%q should be parsed as %v. Got: %v", value, expected, start)
+		}
+	}
+
+	if _, ok := RequestStartFromHeader("t=soon"); ok {
+		t.Error("Invalid values should not be parsed.")
+	}
+}
+
+func TestWaitBudgetFromHeader(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"250": 250 * time.Millisecond, "1.5s": 1500 * time.Millisecond, " 0 ": 0} {
+		budget, ok := WaitBudgetFromHeader(value)
+		if !ok || budget != expected {
+			t.Errorf("%q should be parsed as %v. Got: %v", value, expected, budget)
+		}
+	}
+
+	for _, value := range []string{"soon", "-5", "-1s"} {
+		if _, ok := WaitBudgetFromHeader(value); ok {
+			t.Errorf("%q should not be parsed.", value)
+		}
+	}
+}
+
+func TestRemoteIPFromLookupHeader(t *testing.T) {
+	request, err := http.NewRequest("GET", "/", strings.NewReader("Hello, world!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Header.Set("True-Client-IP", "10.10.10.10")
+
+	ip := RemoteIPFromIPLookup(limiter.IPLookup{Name: limiter.LookupHeader("True-Client-IP")}, request)
+	if ip != "10.10.10.10" {
+		t.Errorf("Did not get the right IP from a custom header. IP: %v", ip)
+	}
+}
@@ -2,8 +2,16 @@
 package limiter
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cache "github.com/go-pkgz/expirable-cache/v3"
@@ -22,7 +30,8 @@ func New(generalExpirableOptions *ExpirableOptions) *Limiter {
 		SetForwardedForIndexFromBehind(0).
 		SetHeaders(make(map[string][]string)).
 		SetContextValues(make(map[string][]string)).
-		SetIgnoreURL(false)
+		SetIgnoreURL(false).
+		SetBodyReadLimit(4096)
 
 	if generalExpirableOptions != nil {
 		lmt.generalExpirableOptions = generalExpirableOptions
@@ -35,30 +44,180 @@ func New(generalExpirableOptions *ExpirableOptions) *Limiter {
 		lmt.generalExpirableOptions.DefaultExpirationTTL = 87600 * time.Hour
 	}
 
-	lmt.tokenBuckets = cache.NewCache[string, *rate.Limiter]().WithTTL(lmt.generalExpirableOptions.DefaultExpirationTTL)
+	lmt.memory = &memoryAccounting{}
+	lmt.summary = newSummaryStats()
+	lmt.draining = &atomic.Bool{}
+	lmt.pressureEvictions = &atomic.Uint64{}
+	lmt.share = &shareState{}
+	lmt.maintenance = &maintenanceState{}
+	lmt.bucketsMu = &sync.Mutex{}
+	lmt.usageMu = &sync.Mutex{}
+	lmt.violationsMu = &sync.Mutex{}
+	lmt.rejections = newRejections()
+
+	lmt.tokenBuckets = cache.NewCache[string, *rate.Limiter]().WithTTL(lmt.generalExpirableOptions.DefaultExpirationTTL).
+		WithOnEvicted(func(key string, _ *rate.Limiter) { lmt.memory.add(-tokenBucketBytes(key)) })
+
+	lmt.sustainedBuckets = cache.NewCache[string, []*rate.Limiter]().WithTTL(lmt.generalExpirableOptions.DefaultExpirationTTL).
+		WithOnEvicted(func(key string, buckets []*rate.Limiter) { lmt.memory.add(-sustainedBucketsBytes(key, buckets)) })
 
 	lmt.basicAuthUsers = cache.NewCache[string, bool]().WithTTL(lmt.generalExpirableOptions.DefaultExpirationTTL)
 
 	return lmt
 }
 
+// ForRoute returns a Limiter to mount on a single route.
+// It shares the token buckets, basic auth users, header and context value entries of l,
+// but puts name instead of the request path in the keys. Routes mounted with the same name
+// pool one budget, routes mounted with different names split it.
+// Settings are copied at call time, so configure l before calling ForRoute.
+func (l *Limiter) ForRoute(name string) *Limiter {
+	l.RLock()
+	defer l.RUnlock()
+
+	route := &Limiter{settings: l.settings}
+	route.route = name
+	route.summary = newSummaryStats()
+	route.scheduledLimits = append([]scheduledLimit(nil), l.scheduledLimits...)
+
+	// The maps are copied, so setting or removing a header, context value, matcher, method group or key class
+	// response on a route does not change l. The entry caches of every header and context value, the rejection
+	// bodies and headers and the other state created by New stay shared with l, like the token buckets.
+	route.headers = make(map[string]cache.Cache[string, bool], len(l.headers))
+	for header, entries := range l.headers {
+		route.headers[header] = entries
+	}
+
+	route.contextValues = make(map[string]cache.Cache[string, bool], len(l.contextValues))
+	for contextValue, entries := range l.contextValues {
+		route.contextValues[contextValue] = entries
+	}
+
+	route.headerMatchers = make(map[string]func(value string) (string, bool), len(l.headerMatchers))
+	for header, matcher := range l.headerMatchers {
+		route.headerMatchers[header] = matcher
+	}
+
+	route.methodGroups = make(map[string][]string, len(l.methodGroups))
+	for name, methods := range l.methodGroups {
+		route.methodGroups[name] = methods
+	}
+
+	route.keyClassResponses = make(map[KeyClass]keyClassResponse, len(l.keyClassResponses))
+	for class, response := range l.keyClassResponses {
+		route.keyClassResponses[class] = response
+	}
+
+	return route
+}
+
+// GetRoute is thread-safe way of getting the route name set by ForRoute.
+func (l *Limiter) GetRoute() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.route
+}
+
+type keyClassResponse struct {
+	message    string
+	statusCode int
+}
+
+// defaultMethodGroups are the method groups usable in SetMethods without SetMethodGroup.
+var defaultMethodGroups = map[string][]string{
+	"READ":  {http.MethodGet, http.MethodHead, http.MethodOptions},
+	"WRITE": {http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+}
+
+// LookupKind is the name of a lookup method, for IPLookup.Name.
+type LookupKind string
+
+// Names of the lookup methods understood by tollbooth.
+const (
+	// LookupRemoteAddr picks the IP address of the peer.
+	LookupRemoteAddr LookupKind = "RemoteAddr"
+
+	// LookupXFF picks the IP address from X-Forwarded-For.
+	LookupXFF LookupKind = "X-Forwarded-For"
+
+	// LookupXRealIP picks the IP address from X-Real-IP.
+	LookupXRealIP LookupKind = "X-Real-IP"
+
+	// LookupCFConnectingIP picks the IP address from CF-Connecting-IP.
+	LookupCFConnectingIP LookupKind = "CF-Connecting-IP"
+)
+
+// headerLookupPrefix marks lookup names created by LookupHeader.
+const headerLookupPrefix = "header:"
+
+// LookupHeader picks the IP address from header, e.g. LookupHeader("True-Client-IP").
+// Like X-Forwarded-For, the header may hold a comma separated list.
+func LookupHeader(header string) LookupKind {
+	return LookupKind(headerLookupPrefix + header)
+}
+
 // IPLookup is a config struct to define how users want to pick the remote IP address.
 type IPLookup struct {
 	// The name of lookup method.
-	// Possible options are: RemoteAddr, X-Forwarded-For, X-Real-IP, CF-Connecting-IP
-	// All other headers are considered unknown and will be ignored.
-	Name string
+	// Possible options are: LookupRemoteAddr, LookupXFF, LookupXRealIP, LookupCFConnectingIP and LookupHeader(header).
+	// All other names are considered unknown and will be ignored. SetIPLookup does not catch typos, see Validate.
+	Name LookupKind
 
 	// The index position to pick the ip address from a comma separated list.
 	// The index goes from right to left.
 	IndexFromRight int
+
+	// The exact number of proxies we control in front of the server.
+	// When set, it replaces IndexFromRight: the entry appended by the outermost trusted proxy is picked,
+	// whatever clients prepended. Requests with fewer entries did not pass all proxies, their RemoteAddr is used.
+	TrustedHops int
+}
+
+// Header returns the header the IP address is picked from, or empty string for LookupRemoteAddr and unknown names.
+func (lookup IPLookup) Header() string {
+	switch {
+	case lookup.Name == LookupXFF, lookup.Name == LookupXRealIP, lookup.Name == LookupCFConnectingIP:
+		return string(lookup.Name)
+	case strings.HasPrefix(string(lookup.Name), headerLookupPrefix):
+		return strings.TrimPrefix(string(lookup.Name), headerLookupPrefix)
+	default:
+		return ""
+	}
 }
 
 // Limiter is a config struct to limit a particular request handler.
 type Limiter struct {
+	settings
+
+	sync.RWMutex
+}
+
+// settings holds the configuration and state of a Limiter. ForRoute copies it as a whole.
+type settings struct {
 	// Maximum number of requests to limit per second.
 	max float64
 
+	// Time window the limit was expressed in with SetRate. Zero means one second.
+	window time.Duration
+
+	// Separate read and write rates replacing max, burst and window. Zero rates mean the budget is not split.
+	readLimit  Rate
+	writeLimit Rate
+
+	// Separate IPv4 and IPv6 rates replacing max, burst and window. Zero rates mean IP families share the limit.
+	ipv4Limit Rate
+	ipv6Limit Rate
+
+	// Rates replacing max, burst and window during their schedule.
+	scheduledLimits []scheduledLimit
+
+	// Clock the schedules are evaluated against. Nil means time.Now.
+	clock func() time.Time
+
+	// Rate replacing the rate of canaryPercent percent of the keys. Zero percent means there is no canary.
+	canaryLimit   Rate
+	canaryPercent float64
+
 	// Limiter burst size
 	burst int
 
@@ -71,9 +230,18 @@ type Limiter struct {
 	// HTTP status code when limit is reached.
 	statusCode int
 
+	// HTTP messages and status codes replacing the default ones per class of keys.
+	keyClassResponses map[KeyClass]keyClassResponse
+
+	// Upper bound of the random delay added to Retry-After.
+	retryAfterJitter time.Duration
+
 	// A function to call when a request is rejected.
 	onLimitReached func(w http.ResponseWriter, r *http.Request)
 
+	// A function to call with the key of the bucket which ran out of tokens when a request is rejected.
+	onLimitReachedKey func(w http.ResponseWriter, r *http.Request, key string)
+
 	// An option to write back what you want upon reaching a limit.
 	overrideDefaultResponseWriter bool
 
@@ -83,10 +251,32 @@ type Limiter struct {
 
 	forwardedForIndex int
 
+	// How IPv6 addresses are grouped into keys.
+	ipv6Canonicalization IPv6Canonicalization
+
+	// A function to map an OAuth2 Bearer token to its client_id, used instead of the IP address.
+	clientIDResolver func(ctx context.Context, bearerToken string) (string, error)
+
+	// Client IDs resolved by clientIDResolver, by hash of the Bearer token. Empty values cache failures.
+	clientIDs cache.Cache[string, string]
+
+	// Header carrying the service-mesh identity of the peer, used instead of the IP address.
+	// Empty means the IP address is used.
+	meshIdentityHeader string
+
+	// Header carrying the request ID. Empty means request IDs are not propagated.
+	requestIDHeader string
+
+	// HTTP header advertising the recommended client-side rate. Empty means it is not sent.
+	clientRateHeader string
+
 	// List of HTTP Methods to limit (GET, POST, PUT, etc.).
 	// Empty means limit all methods.
 	methods []string
 
+	// Names usable in methods for several HTTP methods.
+	methodGroups map[string][]string
+
 	// Able to configure token bucket expirations.
 	generalExpirableOptions *ExpirableOptions
 
@@ -97,21 +287,182 @@ type Limiter struct {
 	// Empty means skip headers checking.
 	headers map[string]cache.Cache[string, bool]
 
+	// Map of HTTP headers to functions mapping their values to a family name.
+	// All values of one family share a bucket.
+	headerMatchers map[string]func(value string) (string, bool)
+
 	// Map of Context values to limit.
 	contextValues map[string]cache.Cache[string, bool]
 
+	// List of Context keys whose values are all put in the keys, in this order.
+	contextKeys []interface{}
+
 	// Map of limiters with TTL
 	tokenBuckets cache.Cache[string, *rate.Limiter]
 
+	// Guards creating buckets in tokenBuckets and sustainedBuckets, shared with the limiters created by ForRoute.
+	bucketsMu *sync.Mutex
+
+	// Additional limits checked together with max on every key, e.g. a long-window sustained rate.
+	sustainedRates []Rate
+
+	// Map of additional limiters, one per sustained rate, with TTL
+	sustainedBuckets cache.Cache[string, []*rate.Limiter]
+
+	// Number of future tokens a key may borrow, and the share of the refill paying them back.
+	// Zero maxDebt means keys never borrow.
+	loanMaxDebt        int
+	loanRepaymentShare float64
+	loans              cache.Cache[string, *loan]
+
+	// Function called in its own goroutine when a key used up one of usageThresholds of its bucket.
+	usageNotifier   func(UsageEvent)
+	usageThresholds []float64
+	usageNotified   cache.Cache[string, bool]
+	usageMu         *sync.Mutex
+
+	// Function called in its own goroutine when a key gets more than violationRejections within violationWindow.
+	violationAlert      func(ViolationAlert)
+	violationRejections int
+	violationWindow     time.Duration
+	violations          cache.Cache[string, *violationWindow]
+	violationsMu        *sync.Mutex
+
+	// Sampled admission decisions written as JSON lines. Nil means decisions are not logged.
+	decisionLog *decisionLog
+
+	// Decisions counted for Summary. Every route created by ForRoute counts its own.
+	summary *summaryStats
+
+	// Approximate bytes used by tokenBuckets and sustainedBuckets, with the alarms on it.
+	memory *memoryAccounting
+
+	// Number of token buckets from which idle buckets are evicted and TTLs are shortened to pressureTTL.
+	// Zero means there is no memory pressure mode.
+	pressureHighWatermark int
+	pressureTTL           time.Duration
+	pressureSweptAt       time.Time
+	pressureEvictions     *atomic.Uint64
+
+	// Request and response body bytes per second every key may transfer. Nil means transfers are not paced.
+	uploadRate   *byteRate
+	downloadRate *byteRate
+
+	// Number of requests served over one connection before it is closed. Zero or less means unlimited.
+	maxRequestsPerConn int64
+
+	// Maximum time a request may have queued in front of us, according to X-Request-Start. Zero means unlimited.
+	maxQueueTime time.Duration
+
+	// Long-lived allowance of every key, where its usage is kept, and the response of requests over it.
+	quota           Quota
+	quotaStore      QuotaStore
+	quotaMessage    string
+	quotaStatusCode int
+
+	// Bytes of the rejection messages and headers of rejections, shared with the limiters created by ForRoute.
+	rejections *rejections
+
+	// Samples the system load, shared with the limiters created by ForRoute. Nil means no load shedding.
+	loadShedder *loadShedder
+
+	// AIMD state, shared with the limiters created by ForRoute. Nil means the max is not adjusted.
+	adaptive *adaptiveState
+
+	// Whether buckets hold a single token, enforcing a constant rate.
+	leakyBucket bool
+
+	// Minimum gap between the requests of a key. Zero means requests are limited by rate.
+	minInterval time.Duration
+
+	// Gives how many tokens a request takes. Nil means one.
+	costFunc func(r *http.Request) int
+
+	// Gives the max of a key, and the max resolved for every key. Nil means the max of the limiter.
+	maxFunc     func(key string, r *http.Request) float64
+	resolvedMax cache.Cache[string, float64]
+
+	// Gives the burst of a key when it gets its bucket. Nil means the burst of the limiter.
+	burstFunc func(key string, r *http.Request) int
+
+	// Decides whether the response of an admitted request counts against its key. Nil means every response counts.
+	countResponse func(statusCode int) bool
+
+	// Decides whether a new key gets a bucket. Nil admits every key.
+	keyAdmissionFunc func(key string) bool
+
+	// Deployment region, part of every key, and the rates of the regions.
+	region       string
+	regionLimits map[string]Rate
+
+	// Maximum time a request waits for a token instead of being rejected, and how many may wait at once.
+	// Zero means requests never wait.
+	waitMax       time.Duration
+	waitQueueSize int
+	waitQueue     *waitQueue
+	waitPriority  func(r *http.Request) int
+
+	// Request header holding how long the caller is willing to wait.
+	waitBudgetHeader string
+
+	// Maximum number of requests per second across all keys.
+	// Zero means there is no service-level limit.
+	globalMax float64
+
+	// Single token bucket shared by all keys.
+	globalBucket *rate.Limiter
+
+	// Whether all traffic is capped to a trickle across all keys, shared with the limiters created by ForRoute.
+	maintenance *maintenanceState
+
+	// Share of the limits this node may use, shared with the limiters created by ForRoute.
+	share *shareState
+
+	// Whether Drain was called, shared with the limiters created by ForRoute.
+	draining *atomic.Bool
+
 	// Ignore URL on the rate limiter keys
 	ignoreURL bool
 
+	// List of JSON or form fields to extract from the request body into the keys.
+	// Empty means the body is never read.
+	bodyKeyFields []string
+
+	// Maximum number of body bytes read when looking for bodyKeyFields.
+	bodyReadLimit int64
+
+	// Skip CORS preflight requests.
+	skipPreflight bool
+
+	// Function deciding if a request is exempted from limiting.
+	skipFunc func(r *http.Request) bool
+
+	// List of URL paths which are never limited.
+	// Entries ending with "*" match by prefix, all others match exactly.
+	excludedPaths []string
+
+	// Secret used to verify bypass tokens. Empty means bypass tokens are not accepted.
+	bypassSecret []byte
+
+	// Pools carving the limit of every key by request priority.
+	priorityPools PriorityPools
+
+	// Name used instead of the request path in the keys. Set by ForRoute.
+	route string
+
+	// Map of URL path prefixes to their own maximum number of requests per second.
+	// The longest matching prefix wins. Empty means every path uses max.
+	pathLimits map[string]float64
+
+	// Map of HTTP methods to their own maximum number of requests per second. Empty means every method uses max.
+	methodLimits map[string]float64
+
 	tokenBucketExpirationTTL  time.Duration
+	tokenBucketTTLFunc        func(r *http.Request) time.Duration
+	tokenBucketSlidingTTL     bool
 	basicAuthExpirationTTL    time.Duration
 	headerEntryExpirationTTL  time.Duration
 	contextEntryExpirationTTL time.Duration
-
-	sync.RWMutex
 }
 
 // SetTokenBucketExpirationTTL is thread-safe way of setting custom token bucket expiration TTL.
@@ -130,6 +481,47 @@ func (l *Limiter) GetTokenBucketExpirationTTL() time.Duration {
 	return l.tokenBucketExpirationTTL
 }
 
+// SetTokenBucketTTLFunc is thread-safe way of setting a function choosing the token bucket expiration TTL
+// of a request, e.g. a longer retention for paid tenants. A TTL of zero or less falls back to the limiter-wide TTL.
+func (l *Limiter) SetTokenBucketTTLFunc(fn func(r *http.Request) time.Duration) *Limiter {
+	l.Lock()
+	l.tokenBucketTTLFunc = fn
+	l.Unlock()
+
+	return l
+}
+
+// TokenBucketTTLForRequest is thread-safe way of getting the token bucket expiration TTL chosen for a request.
+// It returns zero when no function is set.
+func (l *Limiter) TokenBucketTTLForRequest(r *http.Request) time.Duration {
+	l.RLock()
+	fn := l.tokenBucketTTLFunc
+	l.RUnlock()
+
+	if fn == nil {
+		return 0
+	}
+	return fn(r)
+}
+
+// SetTokenBucketSlidingExpiration is thread-safe way of choosing how token bucket expiration TTL is applied.
+// When enabled, the TTL is refreshed on every access, so only idle buckets expire.
+// When disabled (the default), buckets expire TTL after they were created.
+func (l *Limiter) SetTokenBucketSlidingExpiration(enabled bool) *Limiter {
+	l.Lock()
+	l.tokenBucketSlidingTTL = enabled
+	l.Unlock()
+
+	return l
+}
+
+// GetTokenBucketSlidingExpiration is thread-safe way of getting whether token bucket TTL is refreshed on every access.
+func (l *Limiter) GetTokenBucketSlidingExpiration() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.tokenBucketSlidingTTL
+}
+
 // SetBasicAuthExpirationTTL is thread-safe way of setting custom basic auth expiration TTL.
 func (l *Limiter) SetBasicAuthExpirationTTL(ttl time.Duration) *Limiter {
 	l.Lock()
@@ -179,14 +571,88 @@ func (l *Limiter) GetContextValueEntryExpirationTTL() time.Duration {
 }
 
 // SetMax is thread-safe way of setting maximum number of requests to limit per second.
+// It accepts any value, prefer SetLimit which validates rate and burst together.
 func (l *Limiter) SetMax(max float64) *Limiter {
 	l.Lock()
 	l.max = max
+	l.window = 0
+	l.Unlock()
+
+	return l
+}
+
+// SetRate is thread-safe way of allowing max requests per window, e.g. SetRate(100, 15*time.Minute).
+// Tokens refill evenly over the window and clients may spend all max of them at once.
+func (l *Limiter) SetRate(max int, window time.Duration) *Limiter {
+	if window <= 0 {
+		window = time.Second
+	}
+
+	l.Lock()
+	l.max = float64(max) / window.Seconds()
+	l.burst = int(math.Max(1, float64(max)))
+	l.window = window
 	l.Unlock()
 
 	return l
 }
 
+// ErrInvalidRate is returned by SetLimit for nonsensical rates.
+var ErrInvalidRate = errors.New("invalid rate")
+
+// SetLimit is thread-safe way of setting rate and burst size together, e.g.
+// SetLimit(Rate{Max: 5, Per: time.Second, Burst: 10}).
+// Unlike SetMax and SetBurst, it validates the combination and returns ErrInvalidRate
+// for a non-positive or non-finite Max, a non-positive Per, or a Burst below 1.
+func (l *Limiter) SetLimit(r Rate) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.max = r.Max / r.Per.Seconds()
+	l.burst = r.Burst
+	l.window = r.Per
+	l.Unlock()
+
+	return nil
+}
+
+// Validate returns ErrInvalidRate when r cannot be used as a limit: for a non-positive or non-finite Max,
+// a non-positive Per, or a Burst below 1.
+func (r Rate) Validate() error {
+	switch {
+	case r.Max <= 0 || math.IsInf(r.Max, 0) || math.IsNaN(r.Max):
+		return fmt.Errorf("%w: max must be a positive number, got %v", ErrInvalidRate, r.Max)
+	case r.Per <= 0:
+		return fmt.Errorf("%w: per must be positive, got %v", ErrInvalidRate, r.Per)
+	case r.Burst < 1:
+		return fmt.Errorf("%w: burst must be at least 1, got %v", ErrInvalidRate, r.Burst)
+	}
+	return nil
+}
+
+// GetLimit is thread-safe way of getting rate and burst size together.
+func (l *Limiter) GetLimit() Rate {
+	window := l.GetWindow()
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return Rate{Max: l.max * window.Seconds(), Per: window, Burst: l.burst}
+}
+
+// GetWindow is thread-safe way of getting the time window set with SetRate. It is one second otherwise.
+func (l *Limiter) GetWindow() time.Duration {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.window <= 0 {
+		return time.Second
+	}
+	return l.window
+}
+
 // GetMax is thread-safe way of getting maximum number of requests to limit per second.
 func (l *Limiter) GetMax() float64 {
 	l.RLock()
@@ -195,6 +661,7 @@ func (l *Limiter) GetMax() float64 {
 }
 
 // SetBurst is thread-safe way of setting maximum burst size.
+// It accepts any value, prefer SetLimit which validates rate and burst together.
 func (l *Limiter) SetBurst(burst int) *Limiter {
 	l.Lock()
 	l.burst = burst
@@ -259,6 +726,48 @@ func (l *Limiter) GetStatusCode() int {
 	return l.statusCode
 }
 
+// SetRetryAfterJitter is thread-safe way of setting the upper bound of the random delay added to Retry-After.
+// Clients honoring Retry-After in lockstep, e.g. cron-driven integrations, then come back spread over that interval.
+func (l *Limiter) SetRetryAfterJitter(jitter time.Duration) *Limiter {
+	l.Lock()
+	l.retryAfterJitter = jitter
+	l.Unlock()
+
+	return l
+}
+
+// GetRetryAfterJitter is thread-safe way of getting the upper bound of the random delay added to Retry-After.
+func (l *Limiter) GetRetryAfterJitter() time.Duration {
+	l.RLock()
+	defer l.RUnlock()
+	return l.retryAfterJitter
+}
+
+// SetKeyClassResponse is thread-safe way of setting the HTTP message and status code used instead of
+// the default ones when the limit is reached for a class of keys.
+func (l *Limiter) SetKeyClassResponse(class KeyClass, message string, statusCode int) *Limiter {
+	l.Lock()
+	if l.keyClassResponses == nil {
+		l.keyClassResponses = make(map[KeyClass]keyClassResponse)
+	}
+	l.keyClassResponses[class] = keyClassResponse{message: message, statusCode: statusCode}
+	l.Unlock()
+
+	return l
+}
+
+// GetKeyClassResponse is thread-safe way of getting the HTTP message and status code when the limit is reached
+// for a class of keys. It falls back to the default message and status code.
+func (l *Limiter) GetKeyClassResponse(class KeyClass) (string, int) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if response, found := l.keyClassResponses[class]; found {
+		return response.message, response.statusCode
+	}
+	return l.message, l.statusCode
+}
+
 // SetOnLimitReached is thread-safe way of setting after-rejection function when limit is reached.
 func (l *Limiter) SetOnLimitReached(fn func(w http.ResponseWriter, r *http.Request)) *Limiter {
 	l.Lock()
@@ -279,6 +788,28 @@ func (l *Limiter) ExecOnLimitReached(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// SetOnLimitReachedKey is thread-safe way of setting after-rejection function receiving the key of the bucket
+// which ran out of tokens. The key is empty when the request was rejected by a service-level limit.
+// It runs after the function set by SetOnLimitReached.
+func (l *Limiter) SetOnLimitReachedKey(fn func(w http.ResponseWriter, r *http.Request, key string)) *Limiter {
+	l.Lock()
+	l.onLimitReachedKey = fn
+	l.Unlock()
+
+	return l
+}
+
+// ExecOnLimitReachedKey is thread-safe way of executing after-rejection function receiving the key of the bucket.
+func (l *Limiter) ExecOnLimitReachedKey(w http.ResponseWriter, r *http.Request, key string) {
+	l.RLock()
+	fn := l.onLimitReachedKey
+	l.RUnlock()
+
+	if fn != nil {
+		fn(w, r, key)
+	}
+}
+
 // SetOverrideDefaultResponseWriter is a thread-safe way of setting the response writer override variable.
 func (l *Limiter) SetOverrideDefaultResponseWriter(override bool) *Limiter {
 	l.Lock()
@@ -297,6 +828,7 @@ func (l *Limiter) GetOverrideDefaultResponseWriter() bool {
 
 // SetIPLookup is thread-safe way of setting an explicit way to look up IP address.
 // This method is intended to replace SetIPLookups (version 6 or older).
+// The lookup is not validated, so a typo in its name silently limits nothing; call Validate at boot to catch it.
 func (l *Limiter) SetIPLookup(lookup IPLookup) *Limiter {
 	l.Lock()
 	l.explicitIPLookup = lookup
@@ -313,6 +845,161 @@ func (l *Limiter) GetIPLookup() IPLookup {
 	return l.explicitIPLookup
 }
 
+// SetIPv6Canonicalization is thread-safe way of setting how IPv6 addresses are grouped into keys.
+// By default addresses are grouped by their /64 prefix, which may put unrelated users of some mobile carriers
+// in one bucket. Use IPv6CanonicalizationOff to limit every address on its own, or IPv6Prefix(n) for another prefix.
+func (l *Limiter) SetIPv6Canonicalization(canonicalization IPv6Canonicalization) *Limiter {
+	l.Lock()
+	l.ipv6Canonicalization = canonicalization
+	l.Unlock()
+
+	return l
+}
+
+// GetIPv6Canonicalization is thread-safe way of getting how IPv6 addresses are grouped into keys.
+func (l *Limiter) GetIPv6Canonicalization() IPv6Canonicalization {
+	l.RLock()
+	defer l.RUnlock()
+	return l.ipv6Canonicalization
+}
+
+// SetMeshIdentityHeader is thread-safe way of trusting a service-mesh identity header as the limit key.
+// When set, the IP lookup is skipped. For "X-Forwarded-Client-Cert", the URI (e.g. SPIFFE ID)
+// of the closest peer is used, for any other header the value is used as is.
+// Requests without the header, or without a peer identity in it, are limited by the IP lookup.
+// Only enable it when every request goes through the mesh proxy, which overwrites the header.
+func (l *Limiter) SetMeshIdentityHeader(header string) *Limiter {
+	l.Lock()
+	l.meshIdentityHeader = header
+	l.Unlock()
+
+	return l
+}
+
+// GetMeshIdentityHeader is thread-safe way of getting the trusted service-mesh identity header.
+func (l *Limiter) GetMeshIdentityHeader() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.meshIdentityHeader
+}
+
+// SetRequestIDHeader is thread-safe way of setting the header carrying the request ID, e.g. X-Request-Id.
+// When present, the request ID is echoed in the X-Rate-Limit-Request-Id response header and passed on
+// to the events emitted by the limiter, so rejections can be correlated with application logs.
+func (l *Limiter) SetRequestIDHeader(header string) *Limiter {
+	l.Lock()
+	l.requestIDHeader = header
+	l.Unlock()
+
+	return l
+}
+
+// GetRequestIDHeader is thread-safe way of getting the header carrying the request ID.
+func (l *Limiter) GetRequestIDHeader() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.requestIDHeader
+}
+
+// SetClientRateHeader is thread-safe way of setting the HTTP header advertising the requests per second
+// clients should not exceed, so SDKs can self-throttle proactively, e.g. with tollbooth.ClientTransport.
+func (l *Limiter) SetClientRateHeader(header string) *Limiter {
+	l.Lock()
+	l.clientRateHeader = header
+	l.Unlock()
+
+	return l
+}
+
+// GetClientRateHeader is thread-safe way of getting the HTTP header advertising the recommended client-side rate.
+func (l *Limiter) GetClientRateHeader() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.clientRateHeader
+}
+
+// RequestID returns the request ID of r, or an empty string when no request ID header is set or present.
+func (l *Limiter) RequestID(r *http.Request) string {
+	header := l.GetRequestIDHeader()
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
+
+// Bounds on resolving client IDs, see SetClientIDResolver.
+const (
+	clientIDCacheTTL       = time.Minute
+	clientIDCacheKeys      = 100000
+	clientIDResolveTimeout = 2 * time.Second
+)
+
+// SetClientIDResolver is thread-safe way of setting a function which maps an OAuth2 Bearer token to its client_id,
+// e.g. by calling a token introspection endpoint.
+// When the token resolves, requests are limited by client_id instead of the IP address, so every application
+// gets its own quota. When there is no Bearer token or resolving fails, the IP address is used.
+// The outcome is cached per token for a minute, and resolving is abandoned after 2 seconds.
+func (l *Limiter) SetClientIDResolver(resolver func(ctx context.Context, bearerToken string) (string, error)) *Limiter {
+	l.Lock()
+	l.clientIDResolver = resolver
+	l.clientIDs = cache.NewCache[string, string]().WithTTL(clientIDCacheTTL).WithMaxKeys(clientIDCacheKeys)
+	l.Unlock()
+
+	return l
+}
+
+// ResolveClientID is thread-safe way of resolving the client_id of an OAuth2 Bearer token.
+// It returns empty string when no resolver is set or resolving fails.
+func (l *Limiter) ResolveClientID(ctx context.Context, bearerToken string) string {
+	l.RLock()
+	resolver, clientIDs := l.clientIDResolver, l.clientIDs
+	l.RUnlock()
+
+	if resolver == nil || bearerToken == "" {
+		return ""
+	}
+
+	// Tokens are secrets, only their hash is kept.
+	sum := sha256.Sum256([]byte(bearerToken))
+	tokenHash := string(sum[:])
+
+	if clientID, found := clientIDs.Get(tokenHash); found {
+		return clientID
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, clientIDResolveTimeout)
+	defer cancel()
+
+	clientID, err := resolver(resolveCtx, bearerToken)
+	if err != nil {
+		clientID = ""
+	}
+
+	// A request which went away tells nothing about the token.
+	if ctx.Err() == nil {
+		clientIDs.Set(tokenHash, clientID, 0)
+	}
+
+	return clientID
+}
+
+// SetTrustedHops is thread-safe way of setting the exact number of proxies we control in front of the server.
+// The client IP is then picked from the IP lookup header by skipping exactly those proxies.
+func (l *Limiter) SetTrustedHops(hops int) *Limiter {
+	l.Lock()
+	l.explicitIPLookup.TrustedHops = hops
+	l.Unlock()
+
+	return l
+}
+
+// GetTrustedHops is thread-safe way of getting the exact number of proxies we control in front of the server.
+func (l *Limiter) GetTrustedHops() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.explicitIPLookup.TrustedHops
+}
+
 // SetIgnoreURL is thread-safe way of setting whenever ignore the URL on rate limit keys
 func (l *Limiter) SetIgnoreURL(enabled bool) *Limiter {
 	l.Lock()
@@ -329,6 +1016,255 @@ func (l *Limiter) GetIgnoreURL() bool {
 	return l.ignoreURL
 }
 
+// SetBodyKeyFields is thread-safe way of setting list of JSON or form body fields to limit.
+// The body is read up to GetBodyReadLimit bytes and put back for the next handler.
+func (l *Limiter) SetBodyKeyFields(fields []string) *Limiter {
+	l.Lock()
+	l.bodyKeyFields = fields
+	l.Unlock()
+
+	return l
+}
+
+// GetBodyKeyFields is thread-safe way of getting list of JSON or form body fields to limit.
+func (l *Limiter) GetBodyKeyFields() []string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.bodyKeyFields
+}
+
+// SetBodyReadLimit is thread-safe way of setting maximum number of body bytes read to find body key fields.
+func (l *Limiter) SetBodyReadLimit(limit int64) *Limiter {
+	l.Lock()
+	l.bodyReadLimit = limit
+	l.Unlock()
+
+	return l
+}
+
+// GetBodyReadLimit is thread-safe way of getting maximum number of body bytes read to find body key fields.
+func (l *Limiter) GetBodyReadLimit() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.bodyReadLimit
+}
+
+// SetMethodLimits is thread-safe way of setting maximum number of requests per second by HTTP method,
+// every method getting its own bucket. Methods without a limit use max.
+// Example: map[string]float64{"GET": 100, "POST": 5}
+func (l *Limiter) SetMethodLimits(methodLimits map[string]float64) *Limiter {
+	limits := make(map[string]float64, len(methodLimits))
+	for method, max := range methodLimits {
+		limits[strings.ToUpper(method)] = max
+	}
+
+	l.Lock()
+	l.methodLimits = limits
+	l.Unlock()
+
+	return l
+}
+
+// GetMethodLimits is thread-safe way of getting maximum number of requests per second by HTTP method.
+func (l *Limiter) GetMethodLimits() map[string]float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.methodLimits
+}
+
+// GetMethodLimit returns the maximum number of requests per second of method, and false when it has none.
+func (l *Limiter) GetMethodLimit(method string) (float64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	max, found := l.methodLimits[strings.ToUpper(method)]
+	return max, found
+}
+
+// SetPathLimits is thread-safe way of setting maximum number of requests per second by URL path prefix.
+// Example: map[string]float64{"/search": 2, "/static/": 100}
+func (l *Limiter) SetPathLimits(pathLimits map[string]float64) *Limiter {
+	l.Lock()
+	l.pathLimits = pathLimits
+	l.Unlock()
+
+	return l
+}
+
+// GetPathLimits is thread-safe way of getting maximum number of requests per second by URL path prefix.
+func (l *Limiter) GetPathLimits() map[string]float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.pathLimits
+}
+
+// GetPathLimit returns the longest path prefix matching path and its maximum number of requests per second.
+func (l *Limiter) GetPathLimit(path string) (string, float64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	matchedPrefix := ""
+	matchedMax := 0.0
+	found := false
+
+	for prefix, max := range l.pathLimits {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(matchedPrefix)) {
+			matchedPrefix = prefix
+			matchedMax = max
+			found = true
+		}
+	}
+
+	return matchedPrefix, matchedMax, found
+}
+
+// SetSkipFunc is thread-safe way of setting a function deciding if a request is exempted from limiting.
+// It runs before keys are built, so exempted requests never touch a bucket.
+func (l *Limiter) SetSkipFunc(fn func(r *http.Request) bool) *Limiter {
+	l.Lock()
+	l.skipFunc = fn
+	l.Unlock()
+
+	return l
+}
+
+// ExecSkipFunc is thread-safe way of executing the function deciding if a request is exempted from limiting.
+// It returns false when no function is set.
+func (l *Limiter) ExecSkipFunc(r *http.Request) bool {
+	l.RLock()
+	fn := l.skipFunc
+	l.RUnlock()
+
+	return fn != nil && fn(r)
+}
+
+// SetMaxRequestsPerConn is thread-safe way of setting how many requests are served over one keep-alive
+// or HTTP/2 connection before the client is asked to reconnect, to rotate abusive long-lived connections.
+// It needs tollbooth.ConnContext as the ConnContext of the http.Server. Zero or less means unlimited.
+func (l *Limiter) SetMaxRequestsPerConn(max int64) *Limiter {
+	l.Lock()
+	l.maxRequestsPerConn = max
+	l.Unlock()
+
+	return l
+}
+
+// GetMaxRequestsPerConn is thread-safe way of getting how many requests are served over one connection.
+func (l *Limiter) GetMaxRequestsPerConn() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxRequestsPerConn
+}
+
+// SetMaxQueueTime is thread-safe way of setting how long a request may have queued in the fronting proxy,
+// according to its X-Request-Start header. Older requests are rejected with 503 before spending any token,
+// since their client has likely given up already. Zero disables it.
+func (l *Limiter) SetMaxQueueTime(max time.Duration) *Limiter {
+	l.Lock()
+	l.maxQueueTime = max
+	l.Unlock()
+
+	return l
+}
+
+// GetMaxQueueTime is thread-safe way of getting how long a request may have queued in the fronting proxy.
+func (l *Limiter) GetMaxQueueTime() time.Duration {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxQueueTime
+}
+
+// SetSkipPreflight is thread-safe way of setting whether CORS preflight requests skip the limiter.
+// A preflight is an OPTIONS request carrying both Origin and Access-Control-Request-Method headers.
+func (l *Limiter) SetSkipPreflight(enabled bool) *Limiter {
+	l.Lock()
+	l.skipPreflight = enabled
+	l.Unlock()
+
+	return l
+}
+
+// GetSkipPreflight is thread-safe way of getting whether CORS preflight requests skip the limiter.
+func (l *Limiter) GetSkipPreflight() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.skipPreflight
+}
+
+// SetExcludedPaths is thread-safe way of setting list of URL paths which are never limited.
+// Entries ending with "*" match by prefix, e.g. "/debug/*", all others match exactly, e.g. "/healthz".
+func (l *Limiter) SetExcludedPaths(paths []string) *Limiter {
+	l.Lock()
+	l.excludedPaths = paths
+	l.Unlock()
+
+	return l
+}
+
+// GetExcludedPaths is thread-safe way of getting list of URL paths which are never limited.
+func (l *Limiter) GetExcludedPaths() []string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.excludedPaths
+}
+
+// IsExcludedPath returns whether path matches one of the excluded paths.
+func (l *Limiter) IsExcludedPath(path string) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, excludedPath := range l.excludedPaths {
+		if prefix := strings.TrimSuffix(excludedPath, "*"); prefix != excludedPath {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == excludedPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetPriorityPools is thread-safe way of carving the limit of every key into pools selected per request.
+// Example: SetPriorityPools(PriorityPools{
+// Shares: map[string]float64{"interactive": 0.8, "batch": 0.2}, Default: "interactive", Select: PoolFromHeader("X-Priority")}).
+func (l *Limiter) SetPriorityPools(pools PriorityPools) *Limiter {
+	l.Lock()
+	l.priorityPools = pools
+	l.Unlock()
+
+	return l
+}
+
+// GetPriorityPools is thread-safe way of getting the pools carving the limit of every key.
+func (l *Limiter) GetPriorityPools() PriorityPools {
+	l.RLock()
+	defer l.RUnlock()
+	return l.priorityPools
+}
+
+// PriorityPoolForRequest returns the pool name and share of the limit selected by r.
+// It returns false when no pools are set, or r selects no pool and the default pool is missing from the shares.
+func (l *Limiter) PriorityPoolForRequest(r *http.Request) (string, float64, bool) {
+	pools := l.GetPriorityPools()
+	if len(pools.Shares) == 0 || pools.Select == nil {
+		return "", 0, false
+	}
+
+	name := pools.Select(r)
+	share, found := pools.Shares[name]
+	if !found {
+		name = pools.Default
+		share, found = pools.Shares[name]
+	}
+	if !found {
+		return "", 0, false
+	}
+
+	return name, share, true
+}
+
 // SetForwardedForIndexFromBehind is thread-safe way of setting which X-Forwarded-For index to choose.
 func (l *Limiter) SetForwardedForIndexFromBehind(forwardedForIndex int) *Limiter {
 	l.Lock()
@@ -361,6 +1297,49 @@ func (l *Limiter) GetMethods() []string {
 	return l.methods
 }
 
+// SetMethodGroup is thread-safe way of defining a name usable in SetMethods for several HTTP methods,
+// in addition to the predefined READ (GET, HEAD, OPTIONS) and WRITE (POST, PUT, PATCH, DELETE) groups.
+func (l *Limiter) SetMethodGroup(name string, methods []string) *Limiter {
+	l.Lock()
+	if l.methodGroups == nil {
+		l.methodGroups = make(map[string][]string)
+	}
+	l.methodGroups[strings.ToUpper(name)] = methods
+	l.Unlock()
+
+	return l
+}
+
+// MatchesMethod returns a bool indicating if requests with method are limited.
+// Methods are matched case-insensitively, "*" matches every method and group names match their methods.
+// When no methods are set, every method matches.
+func (l *Limiter) MatchesMethod(method string) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.methods) == 0 {
+		return true
+	}
+
+	for _, limited := range l.methods {
+		if limited == "*" || strings.EqualFold(limited, method) {
+			return true
+		}
+
+		group, found := l.methodGroups[strings.ToUpper(limited)]
+		if !found {
+			group = defaultMethodGroups[strings.ToUpper(limited)]
+		}
+		for _, groupMethod := range group {
+			if strings.EqualFold(groupMethod, method) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // SetBasicAuthUsers is thread-safe way of setting list of basic auth usernames to limit.
 func (l *Limiter) SetBasicAuthUsers(basicAuthUsers []string) *Limiter {
 	ttl := l.GetBasicAuthExpirationTTL()
@@ -389,6 +1368,43 @@ func (l *Limiter) RemoveBasicAuthUsers(basicAuthUsers []string) *Limiter {
 	return l
 }
 
+// SetGlobalMax is thread-safe way of setting maximum number of requests per second across all keys.
+// It acts as a service-level kill switch on top of the per-key limits. Zero disables it.
+func (l *Limiter) SetGlobalMax(max float64) *Limiter {
+	l.Lock()
+	l.globalMax = max
+	if max > 0 {
+		opts := l.applyShare(BucketOptions{Max: max, Burst: int(math.Max(1, max))})
+		l.globalBucket = rate.NewLimiter(rate.Limit(opts.Max), opts.Burst)
+	} else {
+		l.globalBucket = nil
+	}
+	l.Unlock()
+
+	return l
+}
+
+// GetGlobalMax is thread-safe way of getting maximum number of requests per second across all keys.
+func (l *Limiter) GetGlobalMax() float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.globalMax
+}
+
+// GlobalLimitReached returns a bool indicating if the service-level Bucket ran out of tokens.
+// It always returns false when no global max is set.
+func (l *Limiter) GlobalLimitReached() bool {
+	l.RLock()
+	globalBucket := l.globalBucket
+	l.RUnlock()
+
+	if globalBucket == nil {
+		return false
+	}
+
+	return !globalBucket.Allow()
+}
+
 // DeleteExpiredTokenBuckets is thread-safe way of deleting expired token buckets
 func (l *Limiter) DeleteExpiredTokenBuckets() {
 	l.tokenBuckets.DeleteExpired()
@@ -422,6 +1438,7 @@ func (l *Limiter) GetHeaders() map[string][]string {
 }
 
 // SetHeader is thread-safe way of setting entries of 1 HTTP header.
+// Entries may contain "*" wildcards, e.g. "mobile-*", so families of values share a bucket.
 func (l *Limiter) SetHeader(header string, entries []string) *Limiter {
 	l.RLock()
 	existing, found := l.headers[header]
@@ -456,6 +1473,29 @@ func (l *Limiter) GetHeader(header string) []string {
 	return entriesAsGoCache.Keys()
 }
 
+// SetHeaderMatcher is thread-safe way of limiting 1 HTTP header by families of values.
+// The matcher maps a header value to its family name, all values of a family share a bucket.
+// Returning false leaves the value unmatched. Use SetHeader with "*" wildcards for simple prefix families.
+func (l *Limiter) SetHeaderMatcher(header string, matcher func(value string) (string, bool)) *Limiter {
+	l.SetHeader(header, nil)
+
+	l.Lock()
+	if l.headerMatchers == nil {
+		l.headerMatchers = make(map[string]func(value string) (string, bool))
+	}
+	l.headerMatchers[header] = matcher
+	l.Unlock()
+
+	return l
+}
+
+// GetHeaderMatcher is thread-safe way of getting the value matcher of 1 HTTP header.
+func (l *Limiter) GetHeaderMatcher(header string) func(value string) (string, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.headerMatchers[header]
+}
+
 // RemoveHeader is thread-safe way of removing entries of 1 HTTP header.
 func (l *Limiter) RemoveHeader(header string) *Limiter {
 	ttl := l.GetHeaderEntryExpirationTTL()
@@ -465,6 +1505,7 @@ func (l *Limiter) RemoveHeader(header string) *Limiter {
 
 	l.Lock()
 	l.headers[header] = cache.NewCache[string, bool]().WithTTL(ttl)
+	delete(l.headerMatchers, header)
 	l.Unlock()
 
 	return l
@@ -514,6 +1555,24 @@ func (l *Limiter) GetContextValues() map[string][]string {
 	return results
 }
 
+// SetContextKeys is thread-safe way of setting list of Context keys to limit by, e.g. tenant and role.
+// Unlike SetContextValues, every value found under these keys is put in the keys, in the given order.
+// Keys may be of any comparable type, including the unexported key types recommended by the context package.
+func (l *Limiter) SetContextKeys(keys ...interface{}) *Limiter {
+	l.Lock()
+	l.contextKeys = keys
+	l.Unlock()
+
+	return l
+}
+
+// GetContextKeys is thread-safe way of getting list of Context keys to limit by.
+func (l *Limiter) GetContextKeys() []interface{} {
+	l.RLock()
+	defer l.RUnlock()
+	return l.contextKeys
+}
+
 // SetContextValue is thread-safe way of setting entries of 1 Context value.
 func (l *Limiter) SetContextValue(contextValue string, entries []string) *Limiter {
 	l.RLock()
@@ -580,16 +1639,36 @@ func (l *Limiter) RemoveContextValuesEntries(contextValue string, entriesForRemo
 	return l
 }
 
-func (l *Limiter) limitReachedWithTokenBucketTTL(key string, tokenBucketTTL time.Duration) bool {
-	lmtMax := l.GetMax()
-	lmtBurst := l.GetBurst()
+func (l *Limiter) limitReachedWithTokenBucketTTL(key string, opts BucketOptions, tokenBucketTTL time.Duration) bool {
+	l.maybeSyncShare()
+
+	if !l.admitsKey(key) {
+		return true
+	}
+
 	l.Lock()
 	defer l.Unlock()
 
+	// Routes created by ForRoute have their own lock, but share the buckets.
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	tokenBucketTTL = l.pressureTTLFor(tokenBucketTTL)
+
 	if _, found := l.tokenBuckets.Get(key); !found {
+		if l.draining.Load() {
+			return true
+		}
+
+		// Expired buckets stay in the cache until they are replaced or evicted.
+		if !l.tokenBuckets.Contains(key) {
+			l.memory.add(tokenBucketBytes(key))
+		}
+
+		opts = l.applyMinInterval(l.applyLeak(l.applyAdaptive(l.applyShare(opts))))
 		l.tokenBuckets.Set(
 			key,
-			rate.NewLimiter(rate.Limit(lmtMax), lmtBurst),
+			rate.NewLimiter(rate.Limit(opts.Max), opts.Burst),
 			tokenBucketTTL,
 		)
 	}
@@ -599,18 +1678,113 @@ func (l *Limiter) limitReachedWithTokenBucketTTL(key string, tokenBucketTTL time
 		return false
 	}
 
-	return !expiringMap.Allow()
+	if l.tokenBucketSlidingTTL {
+		l.tokenBuckets.Set(key, expiringMap, tokenBucketTTL)
+	}
+
+	if sustainedBuckets := l.sustainedBucketsFor(key, tokenBucketTTL); len(sustainedBuckets) > 0 {
+		if !allowAll(append([]*rate.Limiter{expiringMap}, sustainedBuckets...), opts.Cost) {
+			return true
+		}
+	} else if !expiringMap.AllowN(time.Now(), tokenCost(opts.Cost, expiringMap.Burst())) && !l.borrow(key, expiringMap, tokenBucketTTL, opts.Cost) {
+		return true
+	}
+
+	l.share.addUsage(1)
+	return false
 }
 
 // LimitReached returns a bool indicating if the Bucket identified by key ran out of tokens.
 func (l *Limiter) LimitReached(key string) bool {
-	ttl := l.GetTokenBucketExpirationTTL()
+	return l.LimitReachedWithOptions(key, BucketOptions{Max: l.GetMax(), Burst: l.GetBurst()})
+}
+
+// LimitReachedWithOptions returns a bool indicating if the Bucket identified by key ran out of tokens.
+// Unlike LimitReached, a missing Bucket is created using opts instead of the limiter-wide max and burst.
+func (l *Limiter) LimitReachedWithOptions(key string, opts BucketOptions) bool {
+	return l.limitReachedWithTokenBucketTTL(key, opts, l.bucketTTL(opts.TTL))
+}
+
+// bucketTTL returns the expiration TTL of a bucket: ttl, or the limiter-wide TTL when ttl is zero.
+func (l *Limiter) bucketTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = l.GetTokenBucketExpirationTTL()
+	}
 
 	if ttl <= 0 {
 		ttl = l.generalExpirableOptions.DefaultExpirationTTL
 	}
 
-	return l.limitReachedWithTokenBucketTTL(key, ttl)
+	return ttl
+}
+
+// InspectKey returns the state of the Bucket identified by key, without refreshing its TTL.
+// It returns false when there is no such Bucket, e.g. because it expired.
+func (l *Limiter) InspectKey(key string) (BucketState, bool) {
+	bucket, found := l.tokenBuckets.Peek(key)
+	if !found {
+		return BucketState{}, false
+	}
+
+	now := time.Now()
+	expiresAt, _ := l.tokenBuckets.GetExpiration(key)
+
+	return BucketState{
+		Tokens:     bucket.TokensAt(now),
+		Burst:      bucket.Burst(),
+		Max:        float64(bucket.Limit()),
+		LastUpdate: bucket.Last(),
+		TTL:        expiresAt.Sub(now),
+	}, true
+}
+
+// Keys returns up to limit keys of the Buckets starting with prefix, in sorted order.
+// A limit of zero or less returns all of them.
+func (l *Limiter) Keys(prefix string, limit int) []string {
+	keys := make([]string, 0)
+	for _, key := range l.tokenBuckets.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, found := l.tokenBuckets.Peek(key); found {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Remaining returns the tokens left in the Bucket identified by key and the time at which it is full again,
+// without taking a token. A missing Bucket is full: it has as many tokens as the limiter-wide burst.
+func (l *Limiter) Remaining(key string) (float64, time.Time) {
+	now := time.Now()
+
+	bucket, found := l.tokenBuckets.Peek(key)
+	if !found {
+		return float64(l.GetBurst()), now
+	}
+
+	sustainedBuckets, _ := l.sustainedBuckets.Peek(key)
+	buckets := append([]*rate.Limiter{bucket}, sustainedBuckets...)
+
+	reset := now
+	for _, bucket := range buckets {
+		missing := float64(bucket.Burst()) - bucket.TokensAt(now)
+		if missing <= 0 || bucket.Limit() <= 0 {
+			continue
+		}
+
+		if full := now.Add(time.Duration(missing / float64(bucket.Limit()) * float64(time.Second))); full.After(reset) {
+			reset = full
+		}
+	}
+
+	return minTokens(buckets, now), reset
 }
 
 // Tokens returns current amount of tokens left in the Bucket identified by key.
@@ -620,5 +1794,7 @@ func (l *Limiter) Tokens(key string) int {
 		return 0
 	}
 
-	return int(expiringMap.TokensAt(time.Now()))
+	sustainedBuckets, _ := l.sustainedBuckets.Get(key)
+
+	return int(minTokens(append([]*rate.Limiter{expiringMap}, sustainedBuckets...), time.Now()))
 }
@@ -0,0 +1,199 @@
+package limiter
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// ErrInvalidAdaptive is returned by SetAdaptive for options which could never adjust the max.
+var ErrInvalidAdaptive = errors.New("invalid adaptive options")
+
+// adaptiveWindow accumulates the responses of the current interval.
+type adaptiveWindow struct {
+	start     time.Time
+	responses int
+	failures  int
+	latency   time.Duration
+}
+
+// adaptiveState is shared with the limiters created by ForRoute, since they share the buckets.
+type adaptiveState struct {
+	sync.Mutex
+	opts AdaptiveOptions
+
+	// Effective max relative to the configured max.
+	factor float64
+	window adaptiveWindow
+
+	// Factor the buckets are scaled to, it lags behind factor until a background rescale catches up.
+	scaled    float64
+	rescaling bool
+}
+
+// SetAdaptive is thread-safe way of letting the downstream health drive the limits (AIMD):
+// the effective max grows by opts.Increase after every healthy interval, up to the configured max,
+// and is multiplied by opts.Decrease after every unhealthy one, down to opts.Min.
+// Every bucket is rescaled accordingly, in the background. Responses are reported with ObserveResponse,
+// which the middlewares of tollbooth do on their own.
+// It returns ErrInvalidAdaptive when Interval is not positive, Decrease is not in the (0, 1) range,
+// or no threshold is set.
+func (l *Limiter) SetAdaptive(opts AdaptiveOptions) error {
+	if opts.Interval <= 0 || opts.Decrease <= 0 || opts.Decrease >= 1 || opts.Min < 0 ||
+		(opts.LatencyThreshold <= 0 && opts.ErrorRateThreshold <= 0) {
+		return ErrInvalidAdaptive
+	}
+
+	l.Lock()
+	l.adaptive = &adaptiveState{opts: opts, factor: 1, scaled: 1, window: adaptiveWindow{start: time.Now()}}
+	l.Unlock()
+
+	return nil
+}
+
+// GetAdaptive is thread-safe way of getting the adaptive options. It returns false when adaptive mode is off.
+func (l *Limiter) GetAdaptive() (AdaptiveOptions, bool) {
+	l.RLock()
+	state := l.adaptive
+	l.RUnlock()
+
+	if state == nil {
+		return AdaptiveOptions{}, false
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	return state.opts, true
+}
+
+// AdaptiveMax is thread-safe way of getting the effective max, in requests per second.
+// It is the configured max when adaptive mode is off.
+func (l *Limiter) AdaptiveMax() float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.max * l.adaptive.currentFactor()
+}
+
+// ObserveResponse reports how long the handler took for an admitted request, and whether it failed.
+// Once an interval has elapsed, the effective max is adjusted, and the buckets are rescaled in the background.
+// It does nothing when adaptive mode is off.
+func (l *Limiter) ObserveResponse(latency time.Duration, failed bool) {
+	l.RLock()
+	state, max := l.adaptive, l.max
+	l.RUnlock()
+
+	if state == nil {
+		return
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	state.window.responses++
+	state.window.latency += latency
+	if failed {
+		state.window.failures++
+	}
+
+	if time.Since(state.window.start) < state.opts.Interval {
+		return
+	}
+
+	state.adjust(max)
+	state.window = adaptiveWindow{start: time.Now()}
+
+	if state.factor != state.scaled && !state.rescaling {
+		state.rescaling = true
+		go l.rescaleAdaptive(state)
+	}
+}
+
+// rescaleAdaptive rescales every bucket to the effective max of state.
+// Buckets are not created meanwhile, so none is scaled twice or missed.
+func (l *Limiter) rescaleAdaptive(state *adaptiveState) {
+	l.RLock()
+	buckets := l.tokenBuckets
+	l.RUnlock()
+
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	state.Lock()
+	ratio := state.factor / state.scaled
+	state.scaled = state.factor
+	state.rescaling = false
+	state.Unlock()
+
+	if ratio == 1 {
+		return
+	}
+
+	for _, bucket := range buckets.Values() {
+		bucket.SetLimit(bucket.Limit() * rate.Limit(ratio))
+	}
+}
+
+// currentFactor returns the effective max relative to the configured max, 1 when s is nil.
+func (s *adaptiveState) currentFactor() float64 {
+	if s == nil {
+		return 1
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.factor
+}
+
+// healthy reports whether the responses of the current interval are healthy. It requires that s is locked.
+func (s *adaptiveState) healthy() bool {
+	window := s.window
+
+	if s.opts.LatencyThreshold > 0 && window.latency/time.Duration(window.responses) >= s.opts.LatencyThreshold {
+		return false
+	}
+	if s.opts.ErrorRateThreshold > 0 && float64(window.failures)/float64(window.responses) >= s.opts.ErrorRateThreshold {
+		return false
+	}
+	return true
+}
+
+// adjust moves the effective max of a limiter configured with max after an interval. It requires that s is locked.
+func (s *adaptiveState) adjust(max float64) {
+	if max <= 0 {
+		return
+	}
+
+	current := max * s.factor
+
+	next := current + s.opts.Increase
+	if !s.healthy() {
+		next = current * s.opts.Decrease
+	}
+	next = math.Max(s.opts.Min, math.Min(max, next))
+
+	if next == current || next <= 0 {
+		return
+	}
+
+	s.factor = next / max
+}
+
+// scaledFactor returns the factor the buckets are scaled to, 1 when s is nil.
+func (s *adaptiveState) scaledFactor() float64 {
+	if s == nil {
+		return 1
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.scaled
+}
+
+// applyAdaptive scales opts down like the existing buckets. It requires that l and l.bucketsMu are locked.
+func (l *Limiter) applyAdaptive(opts BucketOptions) BucketOptions {
+	opts.Max *= l.adaptive.scaledFactor()
+	return opts
+}
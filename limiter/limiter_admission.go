@@ -0,0 +1,34 @@
+package limiter
+
+// SetKeyAdmissionFunc is thread-safe way of setting a function deciding whether a new key gets a bucket.
+// It is called before a bucket is created, and rejects the request without creating any state
+// when it returns false, e.g. to stop attackers from exhausting memory with made-up keys.
+// Keys which already have a bucket are not checked again.
+func (l *Limiter) SetKeyAdmissionFunc(fn func(key string) bool) *Limiter {
+	l.Lock()
+	l.keyAdmissionFunc = fn
+	l.Unlock()
+
+	return l
+}
+
+// GetKeyAdmissionFunc is thread-safe way of getting the function deciding whether a new key gets a bucket.
+func (l *Limiter) GetKeyAdmissionFunc() func(key string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.keyAdmissionFunc
+}
+
+// admitsKey reports whether key has a bucket, or may get one.
+// The function is called without holding the lock, so it may use the limiter.
+func (l *Limiter) admitsKey(key string) bool {
+	fn := l.GetKeyAdmissionFunc()
+	if fn == nil {
+		return true
+	}
+
+	if _, found := l.tokenBuckets.Peek(key); found {
+		return true
+	}
+	return fn(key)
+}
@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// Bucket is the token bucket of a key, see Limiter.Bucket.
+type Bucket interface {
+	// AllowN reports whether n tokens are available at now, and takes them if so.
+	AllowN(now time.Time, n int) bool
+
+	// ReserveN takes n tokens, possibly in the future. See Reservation.DelayFrom to know when they are available.
+	ReserveN(now time.Time, n int) Reservation
+
+	// TokensAt returns the number of tokens available at now.
+	TokensAt(now time.Time) float64
+
+	// Limit returns the number of tokens added per second, and Burst the maximum number of tokens.
+	Limit() float64
+	Burst() int
+
+	// SetLimit and SetBurst change the bucket of this key only.
+	SetLimit(max float64)
+	SetBurst(burst int)
+}
+
+// Reservation holds tokens taken by Bucket.ReserveN.
+type Reservation interface {
+	// OK returns whether the tokens can ever be provided.
+	OK() bool
+
+	// DelayFrom returns how long to wait from now before the tokens are available.
+	DelayFrom(now time.Time) time.Duration
+
+	// CancelAt gives back the tokens as much as possible.
+	CancelAt(now time.Time)
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+}
+
+func (b bucket) AllowN(now time.Time, n int) bool { return b.limiter.AllowN(now, n) }
+
+func (b bucket) ReserveN(now time.Time, n int) Reservation { return b.limiter.ReserveN(now, n) }
+
+func (b bucket) TokensAt(now time.Time) float64 { return b.limiter.TokensAt(now) }
+
+func (b bucket) Limit() float64 { return float64(b.limiter.Limit()) }
+
+func (b bucket) Burst() int { return b.limiter.Burst() }
+
+func (b bucket) SetLimit(max float64) { b.limiter.SetLimit(rate.Limit(max)) }
+
+func (b bucket) SetBurst(burst int) { b.limiter.SetBurst(burst) }
+
+// Bucket returns the token bucket identified by key, for flows tollbooth does not cover,
+// e.g. reserving tokens ahead of time. The bucket keeps its expiration. It returns nil when there is no such bucket.
+func (l *Limiter) Bucket(key string) Bucket {
+	limiter, found := l.tokenBuckets.Peek(key)
+	if !found {
+		return nil
+	}
+	return bucket{limiter: limiter}
+}
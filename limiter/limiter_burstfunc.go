@@ -0,0 +1,38 @@
+package limiter
+
+import "net/http"
+
+// SetBurstFunc is thread-safe way of setting the function giving the burst of a key, e.g. a larger burst
+// for authenticated users. The function is called when a key gets its bucket, the bucket keeps the burst until it expires.
+// A result of zero or less keeps the burst of l.
+func (l *Limiter) SetBurstFunc(fn func(key string, r *http.Request) int) *Limiter {
+	l.Lock()
+	l.burstFunc = fn
+	l.Unlock()
+
+	return l
+}
+
+// GetBurstFunc is thread-safe way of getting the function giving the burst of a key.
+func (l *Limiter) GetBurstFunc() func(key string, r *http.Request) int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.burstFunc
+}
+
+// BurstOptionsForKey replaces the burst of opts with the one the function set by SetBurstFunc gives for key,
+// or with the burst of the existing bucket of key.
+func (l *Limiter) BurstOptionsForKey(key string, r *http.Request, opts BucketOptions) BucketOptions {
+	fn := l.GetBurstFunc()
+	if fn == nil {
+		return opts
+	}
+
+	if bucket, found := l.tokenBuckets.Peek(key); found {
+		opts.Burst = bucket.Burst()
+	} else if burst := fn(key, r); burst > 0 {
+		opts.Burst = burst
+	}
+
+	return opts
+}
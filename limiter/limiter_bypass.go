@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BypassHeader is the request header carrying a bypass token.
+const BypassHeader = "X-RateLimit-Bypass"
+
+// NewBypassToken creates a token which lets requests skip any limiter configured with the same secret until expiresAt.
+// The token has the form "<unix expiry>.<signature>", where signature is the base64url encoded HMAC-SHA256 of the expiry.
+func NewBypassToken(secret []byte, expiresAt time.Time) string {
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + signBypassExpiry(secret, expiry)
+}
+
+func signBypassExpiry(secret []byte, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetBypassSecret is thread-safe way of setting the secret used to verify bypass tokens.
+// Requests with a valid, unexpired token in the X-RateLimit-Bypass header are never limited.
+// An empty secret disables bypass tokens.
+func (l *Limiter) SetBypassSecret(secret []byte) *Limiter {
+	l.Lock()
+	l.bypassSecret = secret
+	l.Unlock()
+
+	return l
+}
+
+// GetBypassSecret is thread-safe way of getting the secret used to verify bypass tokens.
+func (l *Limiter) GetBypassSecret() []byte {
+	l.RLock()
+	defer l.RUnlock()
+	return l.bypassSecret
+}
+
+// IsValidBypassToken returns whether token was signed with the bypass secret and has not expired yet.
+func (l *Limiter) IsValidBypassToken(token string) bool {
+	secret := l.GetBypassSecret()
+	if len(secret) == 0 || token == "" {
+		return false
+	}
+
+	expiry, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(signBypassExpiry(secret, expiry)))
+}
@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBypassToken(t *testing.T) {
+	secret := []byte("top-secret")
+	lmt := New(nil).SetMax(1)
+
+	token := NewBypassToken(secret, time.Now().Add(time.Hour))
+
+	if lmt.IsValidBypassToken(token) {
+		t.Error("Bypass tokens should be rejected when no secret is set.")
+	}
+
+	lmt.SetBypassSecret(secret)
+
+	if !lmt.IsValidBypassToken(token) {
+		t.Errorf("Bypass token should be valid. Token: %v", token)
+	}
+
+	if lmt.IsValidBypassToken(NewBypassToken([]byte("wrong-secret"), time.Now().Add(time.Hour))) {
+		t.Error("Bypass token signed with another secret should be rejected.")
+	}
+
+	if lmt.IsValidBypassToken(NewBypassToken(secret, time.Now().Add(-time.Second))) {
+		t.Error("Expired bypass token should be rejected.")
+	}
+
+	for _, token := range []string{"", "garbage", "123.", ".abc"} {
+		if lmt.IsValidBypassToken(token) {
+			t.Errorf("Malformed bypass token should be rejected. Token: %v", token)
+		}
+	}
+}
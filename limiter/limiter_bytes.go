@@ -0,0 +1,126 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// byteBucketTTL is how long an idle byte bucket is kept. It holds one second of bytes,
+// so it is full again long before it expires.
+const byteBucketTTL = time.Minute
+
+// byteRate paces a stream of bytes per key.
+type byteRate struct {
+	sync.Mutex
+	bytesPerSecond int
+	buckets        cache.Cache[string, *rate.Limiter]
+}
+
+func newByteRate(bytesPerSecond int) *byteRate {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &byteRate{
+		bytesPerSecond: bytesPerSecond,
+		buckets:        cache.NewCache[string, *rate.Limiter]().WithTTL(byteBucketTTL),
+	}
+}
+
+// wait blocks until n bytes may be transferred for key, or ctx is done.
+func (b *byteRate) wait(ctx context.Context, key string, n int) error {
+	b.Lock()
+	bucket, found := b.buckets.Get(key)
+	if !found {
+		bucket = rate.NewLimiter(rate.Limit(b.bytesPerSecond), b.bytesPerSecond)
+	}
+	b.buckets.Set(key, bucket, byteBucketTTL)
+	b.Unlock()
+
+	// WaitN cannot wait for more than the burst at once.
+	for n > 0 {
+		chunk := n
+		if chunk > b.bytesPerSecond {
+			chunk = b.bytesPerSecond
+		}
+		if err := bucket.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// SetUploadRate is thread-safe way of setting how many request body bytes per second every key may upload.
+// Admitted requests then have their body paced, to protect storage backends from firehose uploads.
+// Zero or less disables it.
+func (l *Limiter) SetUploadRate(bytesPerSecond int) *Limiter {
+	l.Lock()
+	l.uploadRate = newByteRate(bytesPerSecond)
+	l.Unlock()
+
+	return l
+}
+
+// GetUploadRate is thread-safe way of getting how many request body bytes per second every key may upload.
+func (l *Limiter) GetUploadRate() int {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.uploadRate == nil {
+		return 0
+	}
+	return l.uploadRate.bytesPerSecond
+}
+
+// WaitUpload blocks until key may upload n more bytes, or ctx is done.
+// It returns immediately when no upload rate is set.
+func (l *Limiter) WaitUpload(ctx context.Context, key string, n int) error {
+	l.RLock()
+	uploadRate := l.uploadRate
+	l.RUnlock()
+
+	if uploadRate == nil {
+		return nil
+	}
+	return uploadRate.wait(ctx, key, n)
+}
+
+// SetDownloadRate is thread-safe way of setting how many response bytes per second every key may download.
+// The middlewares then pace the response of admitted requests, e.g. on file-serving endpoints.
+// Zero or less disables it.
+func (l *Limiter) SetDownloadRate(bytesPerSecond int) *Limiter {
+	l.Lock()
+	l.downloadRate = newByteRate(bytesPerSecond)
+	l.Unlock()
+
+	return l
+}
+
+// GetDownloadRate is thread-safe way of getting how many response bytes per second every key may download.
+func (l *Limiter) GetDownloadRate() int {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.downloadRate == nil {
+		return 0
+	}
+	return l.downloadRate.bytesPerSecond
+}
+
+// WaitDownload blocks until key may download n more bytes, or ctx is done.
+// It returns immediately when no download rate is set.
+func (l *Limiter) WaitDownload(ctx context.Context, key string, n int) error {
+	l.RLock()
+	downloadRate := l.downloadRate
+	l.RUnlock()
+
+	if downloadRate == nil {
+		return nil
+	}
+	return downloadRate.wait(ctx, key, n)
+}
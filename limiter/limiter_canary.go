@@ -0,0 +1,57 @@
+package limiter
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// SetCanaryLimit is thread-safe way of trying a new rate on percent of the keys, e.g. 5 for 5%,
+// while the other keys keep their current rate, so limit changes can be canaried safely.
+// The canary rate replaces the limiter-wide rate, limits of regions, schedules, methods and paths still apply on top.
+// Keys are picked by hashing, so a key stays in or out of the canary as long as percent does not change.
+// Buckets created before a change of percent keep their rate until they expire.
+// It returns ErrInvalidRate when r is invalid, see SetLimit, or when percent is not between 0 and 100.
+func (l *Limiter) SetCanaryLimit(r Rate, percent float64) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100, got %v", ErrInvalidRate, percent)
+	}
+
+	l.Lock()
+	l.canaryLimit = r
+	l.canaryPercent = percent
+	l.Unlock()
+
+	return nil
+}
+
+// GetCanaryLimit is thread-safe way of getting the canary rate and the percent of keys it applies to.
+// It returns false when there is no canary.
+func (l *Limiter) GetCanaryLimit() (Rate, float64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.canaryPercent <= 0 {
+		return Rate{}, 0, false
+	}
+	return l.canaryLimit, l.canaryPercent, true
+}
+
+// CanaryLimitForKey returns the canary rate when key is part of the canary.
+func (l *Limiter) CanaryLimitForKey(key string) (Rate, bool) {
+	r, percent, found := l.GetCanaryLimit()
+	if !found {
+		return Rate{}, false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	// Hundredths of percent, so that fractional percents are honored.
+	if float64(hash.Sum32()%10000) >= percent*100 {
+		return Rate{}, false
+	}
+	return r, true
+}
@@ -0,0 +1,74 @@
+package limiter
+
+import "sync"
+
+// ConcurrencyLimiter caps the number of requests in flight, in total and per key.
+// Unlike the token bucket of Limiter, it bounds how many requests run at the same time,
+// however long they take.
+type ConcurrencyLimiter struct {
+	sync.Mutex
+
+	// Maximum number of requests in flight in total and per key. Zero means no cap.
+	max       int
+	maxPerKey int
+
+	inFlight       int
+	inFlightPerKey map[string]int
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter allowing max requests in flight in total,
+// and maxPerKey per key. Zero means no cap.
+func NewConcurrencyLimiter(max, maxPerKey int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		max:            max,
+		maxPerKey:      maxPerKey,
+		inFlightPerKey: make(map[string]int),
+	}
+}
+
+// Acquire takes a slot for a request of key without blocking. It returns false when no slot is free.
+// Every successful Acquire must be followed by a Release with the same key.
+func (c *ConcurrencyLimiter) Acquire(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.max > 0 && c.inFlight >= c.max {
+		return false
+	}
+	if c.maxPerKey > 0 && c.inFlightPerKey[key] >= c.maxPerKey {
+		return false
+	}
+
+	c.inFlight++
+	c.inFlightPerKey[key]++
+	return true
+}
+
+// Release gives back the slot of a request of key.
+func (c *ConcurrencyLimiter) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inFlightPerKey[key] <= 0 {
+		return
+	}
+
+	c.inFlight--
+	if c.inFlightPerKey[key]--; c.inFlightPerKey[key] == 0 {
+		delete(c.inFlightPerKey, key)
+	}
+}
+
+// InFlight returns the number of requests in flight.
+func (c *ConcurrencyLimiter) InFlight() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.inFlight
+}
+
+// InFlightForKey returns the number of requests of key in flight.
+func (c *ConcurrencyLimiter) InFlightForKey(key string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.inFlightPerKey[key]
+}
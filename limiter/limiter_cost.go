@@ -0,0 +1,66 @@
+package limiter
+
+import "net/http"
+
+// SetCostFunc is thread-safe way of setting the function giving how many tokens a request takes,
+// so expensive endpoints consume more of the budget than cheap ones. Costs below one take one token,
+// costs above the burst of a bucket take the whole burst. A nil fn makes every request take one token.
+func (l *Limiter) SetCostFunc(fn func(r *http.Request) int) *Limiter {
+	l.Lock()
+	l.costFunc = fn
+	l.Unlock()
+
+	return l
+}
+
+// GetCostFunc is thread-safe way of getting the function giving how many tokens a request takes.
+func (l *Limiter) GetCostFunc() func(r *http.Request) int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.costFunc
+}
+
+// CostForRequest returns how many tokens r takes, one when no cost function is set.
+func (l *Limiter) CostForRequest(r *http.Request) int {
+	fn := l.GetCostFunc()
+	if fn == nil {
+		return 1
+	}
+
+	if cost := fn(r); cost > 1 {
+		return cost
+	}
+	return 1
+}
+
+// tokenCost returns how many tokens a request of the given cost takes from a bucket holding up to burst tokens.
+func tokenCost(cost, burst int) int {
+	if cost > burst {
+		cost = burst
+	}
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
+// ContentLengthCost returns a cost function for SetCostFunc charging one token per bytesPerToken bytes of
+// the request body, rounded up, so large uploads take more of the budget than tiny pings.
+// Requests without a body take one token, bodies of unknown length such as chunked ones take unknownCost tokens.
+// Costs are capped at maxCost, zero means no cap.
+func ContentLengthCost(bytesPerToken int64, maxCost, unknownCost int) func(r *http.Request) int {
+	return func(r *http.Request) int {
+		if r.ContentLength < 0 {
+			return unknownCost
+		}
+		if bytesPerToken <= 0 || r.ContentLength == 0 {
+			return 1
+		}
+
+		cost := (r.ContentLength + bytesPerToken - 1) / bytesPerToken
+		if maxCost > 0 && cost > int64(maxCost) {
+			return maxCost
+		}
+		return int(cost)
+	}
+}
@@ -0,0 +1,32 @@
+package limiter
+
+// SetCountResponse is thread-safe way of counting only the requests whose response matches fn, e.g. only 401s
+// to slow down brute-force attacks on a login form, or only 200s to limit successful exports.
+// The token of a request is taken when it is admitted, so requests in flight count, and given back once
+// the middlewares of tollbooth see a response fn does not match. A nil fn counts every request.
+func (l *Limiter) SetCountResponse(fn func(statusCode int) bool) *Limiter {
+	l.Lock()
+	l.countResponse = fn
+	l.Unlock()
+
+	return l
+}
+
+// GetCountResponse is thread-safe way of getting the function deciding which responses count.
+func (l *Limiter) GetCountResponse() func(statusCode int) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.countResponse
+}
+
+// CountStatuses returns a function for SetCountResponse matching the given status codes.
+func CountStatuses(statusCodes ...int) func(statusCode int) bool {
+	counted := make(map[int]bool, len(statusCodes))
+	for _, statusCode := range statusCodes {
+		counted[statusCode] = true
+	}
+
+	return func(statusCode int) bool {
+		return counted[statusCode]
+	}
+}
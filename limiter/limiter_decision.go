@@ -0,0 +1,65 @@
+package limiter
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DecisionEvent is one admission decision written to the decision log, see SetDecisionLog.
+// Fields are flat so that JSON lines convert to CSV or Parquet as is.
+type DecisionEvent struct {
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	KeyClass  KeyClass  `json:"key_class"`
+	Max       float64   `json:"max"`
+	Burst     int       `json:"burst"`
+	Window    float64   `json:"window_seconds"`
+	Remaining int       `json:"remaining"`
+	Admitted  bool      `json:"admitted"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// decisionLog writes JSON lines, one write at a time.
+type decisionLog struct {
+	sync.Mutex
+	encoder    *json.Encoder
+	sampleRate float64
+}
+
+// SetDecisionLog is thread-safe way of writing a sample of the admission decisions to w as JSON lines,
+// so capacity planners can replay traffic and simulate alternative limits offline.
+// A sampleRate of 0.01 writes one decision out of a hundred, 1 writes all of them. A nil w disables it.
+func (l *Limiter) SetDecisionLog(w io.Writer, sampleRate float64) *Limiter {
+	l.Lock()
+	if w == nil {
+		l.decisionLog = nil
+	} else {
+		l.decisionLog = &decisionLog{encoder: json.NewEncoder(w), sampleRate: sampleRate}
+	}
+	l.Unlock()
+
+	return l
+}
+
+// LogDecision is thread-safe way of writing event to the decision log, if it is sampled.
+// Write errors are ignored, so a broken log never fails requests.
+func (l *Limiter) LogDecision(event DecisionEvent) {
+	l.RLock()
+	log := l.decisionLog
+	l.RUnlock()
+
+	if log == nil || rand.Float64() >= log.sampleRate {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	log.Lock()
+	defer log.Unlock()
+	log.encoder.Encode(event)
+}
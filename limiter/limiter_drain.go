@@ -0,0 +1,52 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks whether a share sync in progress is done.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain winds the limiter down for server shutdown. It stops creating buckets, so only keys which already
+// have one are admitted, waits for a share sync in progress, then reports the local usage left to the
+// ShareSyncer. It returns ctx.Err() when ctx is done first, or the error of the last sync.
+// Limiters created with ForRoute are drained together with l.
+func (l *Limiter) Drain(ctx context.Context) error {
+	l.draining.Store(true)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		l.share.Lock()
+		if !l.share.syncing {
+			// Never reset, so no periodic sync starts after the last one.
+			l.share.syncing = true
+			break
+		}
+		l.share.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	syncer, usage := l.share.syncer, l.share.usage
+	l.share.usage = 0
+	l.share.Unlock()
+
+	if syncer == nil || usage == 0 {
+		return nil
+	}
+
+	_, err := syncer.SyncShare(ctx, usage)
+	return err
+}
+
+// IsDraining returns whether Drain was called.
+func (l *Limiter) IsDraining() bool {
+	return l.draining.Load()
+}
@@ -0,0 +1,40 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	syncer := &fixedShareSyncer{share: 1, usage: make(chan float64, 2)}
+	lmt := New(nil).SetMax(10).SetBurst(10).SetShareSyncer(syncer, time.Hour)
+
+	// The first request triggers the initial sync, the next ones are counted for the next sync.
+	lmt.LimitReached("a")
+	<-syncer.usage
+	lmt.LimitReached("a")
+	lmt.LimitReached("a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := lmt.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage := <-syncer.usage; usage < 2 {
+		t.Errorf("Drain should report the local usage left. Value: %v", usage)
+	}
+
+	if !lmt.IsDraining() || !lmt.ForRoute("search").IsDraining() {
+		t.Error("Limiter and its routes should be draining.")
+	}
+
+	if lmt.LimitReached("a") {
+		t.Error("Keys with a bucket should still be admitted while draining.")
+	}
+	if !lmt.LimitReached("b") {
+		t.Error("No bucket should be created while draining.")
+	}
+}
@@ -0,0 +1,31 @@
+package limiter
+
+import "time"
+
+// SetMinInterval is thread-safe way of enforcing a minimum gap between the requests of a key instead of a rate,
+// e.g. at most one password reset every 5 seconds. It replaces every other rate, burst and burst loan of l.
+// Combine it with SetMethods to debounce a single method. A zero interval disables it.
+func (l *Limiter) SetMinInterval(interval time.Duration) *Limiter {
+	l.Lock()
+	l.minInterval = interval
+	l.Unlock()
+
+	return l
+}
+
+// GetMinInterval is thread-safe way of getting the minimum gap between the requests of a key.
+func (l *Limiter) GetMinInterval() time.Duration {
+	l.RLock()
+	defer l.RUnlock()
+	return l.minInterval
+}
+
+// applyMinInterval replaces the rate of opts with one request per minimum interval. It requires that l is locked.
+func (l *Limiter) applyMinInterval(opts BucketOptions) BucketOptions {
+	if l.minInterval > 0 {
+		opts.Max = 1 / l.minInterval.Seconds()
+		opts.Burst = 1
+		opts.Window = l.minInterval
+	}
+	return opts
+}
@@ -0,0 +1,55 @@
+package limiter
+
+import "net"
+
+// SetIPFamilyLimits is thread-safe way of giving IPv4 sources and IPv6 groups their own rate,
+// since far more users share an IPv4 address, e.g. behind a carrier-grade NAT, than an IPv6 /64 prefix.
+// IPv6 addresses are grouped as set with SetIPv6Canonicalization. They replace the limiter-wide rate,
+// scheduled limits, read/write limits and path limits still take precedence.
+// It returns ErrInvalidRate when either rate is invalid, see SetLimit.
+func (l *Limiter) SetIPFamilyLimits(ipv4, ipv6 Rate) error {
+	if err := ipv4.Validate(); err != nil {
+		return err
+	}
+	if err := ipv6.Validate(); err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.ipv4Limit = ipv4
+	l.ipv6Limit = ipv6
+	l.Unlock()
+
+	return nil
+}
+
+// GetIPFamilyLimits is thread-safe way of getting the IPv4 and IPv6 rates.
+// It returns false when IP families share the limiter-wide rate.
+func (l *Limiter) GetIPFamilyLimits() (Rate, Rate, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.ipv4Limit.Max <= 0 {
+		return Rate{}, Rate{}, false
+	}
+	return l.ipv4Limit, l.ipv6Limit, true
+}
+
+// IPFamilyLimitForIP returns the rate of the family of ip.
+// It returns false when IP families share the limiter-wide rate, or ip cannot be parsed.
+func (l *Limiter) IPFamilyLimitForIP(ip string) (Rate, bool) {
+	ipv4, ipv6, found := l.GetIPFamilyLimits()
+	if !found {
+		return Rate{}, false
+	}
+
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return Rate{}, false
+	case parsed.To4() != nil:
+		return ipv4, true
+	default:
+		return ipv6, true
+	}
+}
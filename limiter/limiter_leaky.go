@@ -0,0 +1,37 @@
+package limiter
+
+// SetLeakyBucket is thread-safe way of enforcing a constant rate: buckets hold a single token,
+// so requests of a key are admitted at most once every 1/max seconds, without the bursts
+// a token bucket allows. Burst settings and burst loans are ignored while it is enabled.
+// Combine it with SetWaitMode to delay excess requests instead of rejecting them,
+// so they leave at a constant rate as from a leaky bucket queue.
+func (l *Limiter) SetLeakyBucket(enabled bool) *Limiter {
+	l.Lock()
+	l.leakyBucket = enabled
+	l.Unlock()
+
+	return l
+}
+
+// GetLeakyBucket is thread-safe way of getting whether a constant rate is enforced.
+func (l *Limiter) GetLeakyBucket() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.leakyBucket
+}
+
+// applyLeak removes the burst of opts when a constant rate is enforced. It requires that l is locked.
+func (l *Limiter) applyLeak(opts BucketOptions) BucketOptions {
+	if l.leakyBucket {
+		opts.Burst = 1
+	}
+	return opts
+}
+
+// PacedOptions is thread-safe way of applying the constant rate and the minimum interval of l to opts,
+// as LimitReachedWithOptions does when it creates a bucket, e.g. to describe the bucket in response headers.
+func (l *Limiter) PacedOptions(opts BucketOptions) BucketOptions {
+	l.RLock()
+	defer l.RUnlock()
+	return l.applyMinInterval(l.applyLeak(opts))
+}
@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// loan is the debt state of a key which borrowed tokens.
+type loan struct {
+	// Whether the key reached the debt cap and is paying back.
+	repaying bool
+
+	// Rate the key may still use while paying back.
+	allowance *rate.Limiter
+}
+
+// SetBurstLoan is thread-safe way of letting a key borrow up to maxDebt future tokens once its bucket is empty,
+// instead of being rejected right away. Once the debt cap is reached, the key runs at (1 - repaymentShare) of its rate
+// until the debt is paid back, e.g. 0.5 pays back with half of the refill. A maxDebt of zero disables loans.
+// Keys with sustained limits never borrow.
+func (l *Limiter) SetBurstLoan(maxDebt int, repaymentShare float64) *Limiter {
+	l.Lock()
+	l.loanMaxDebt = maxDebt
+	l.loanRepaymentShare = repaymentShare
+	l.loans = cache.NewCache[string, *loan]().WithTTL(l.generalExpirableOptions.DefaultExpirationTTL)
+	l.Unlock()
+
+	return l
+}
+
+// GetBurstLoan is thread-safe way of getting how many tokens a key may borrow, and the share of the refill paying them back.
+func (l *Limiter) GetBurstLoan() (int, float64) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.loanMaxDebt, l.loanRepaymentShare
+}
+
+// borrow lends the tokens of a request of the given cost to the bucket of key when its loan allows it.
+// It must be called with the lock held.
+func (l *Limiter) borrow(key string, bucket *rate.Limiter, ttl time.Duration, cost int) bool {
+	if l.loanMaxDebt <= 0 || l.leakyBucket || l.minInterval > 0 {
+		return false
+	}
+
+	now := time.Now()
+	tokens := bucket.TokensAt(now)
+	cost = tokenCost(cost, bucket.Burst())
+
+	current, found := l.loans.Get(key)
+	if found && current.repaying && tokens >= 0 {
+		// The debt is paid back, the key may borrow again.
+		l.loans.Invalidate(key)
+		found = false
+	}
+
+	if tokens-float64(cost) < -float64(l.loanMaxDebt) {
+		if !found || !current.repaying {
+			current = &loan{repaying: true, allowance: rate.NewLimiter(bucket.Limit()*rate.Limit(1-l.loanRepaymentShare), 1)}
+			l.loans.Set(key, current, ttl)
+		}
+		return false
+	}
+
+	if found && current.repaying && !current.allowance.AllowN(now, 1) {
+		return false
+	}
+
+	if !found {
+		l.loans.Set(key, &loan{}, ttl)
+	}
+
+	bucket.ReserveN(now, cost)
+	return true
+}
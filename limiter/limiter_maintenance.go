@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// defaultMaintenanceMessage is sent to rejected requests when no maintenance message is set.
+const defaultMaintenanceMessage = "Service is under maintenance, please try again later."
+
+// maintenanceState is shared with the limiters created by ForRoute, so switching maintenance mode on
+// caps every route with one trickle.
+type maintenanceState struct {
+	sync.RWMutex
+
+	enabled bool
+	max     float64
+	message string
+	bucket  *rate.Limiter
+}
+
+// SetMaintenance is thread-safe way of setting how many requests per second get through across all keys
+// while maintenance mode is on, and the message rejected requests get. Zero lets no request through.
+// It does not switch maintenance mode on, see SetMaintenanceMode.
+// Limiters created with ForRoute share the maintenance settings of l.
+func (l *Limiter) SetMaintenance(max float64, message string) *Limiter {
+	l.maintenance.Lock()
+	l.maintenance.max = max
+	l.maintenance.message = message
+	l.maintenance.bucket = rate.NewLimiter(rate.Limit(math.Max(0, max)), int(math.Max(0, math.Ceil(max))))
+	l.maintenance.Unlock()
+
+	return l
+}
+
+// GetMaintenance is thread-safe way of getting how many requests per second get through while maintenance mode is on,
+// and the message rejected requests get.
+func (l *Limiter) GetMaintenance() (float64, string) {
+	l.maintenance.RLock()
+	defer l.maintenance.RUnlock()
+
+	if l.maintenance.message == "" {
+		return l.maintenance.max, defaultMaintenanceMessage
+	}
+	return l.maintenance.max, l.maintenance.message
+}
+
+// SetMaintenanceMode is thread-safe way of switching maintenance mode on or off.
+// While it is on, all traffic is capped to the trickle set with SetMaintenance,
+// so operators can use the limiter as a brownout lever during incidents.
+// It switches the limiters created with ForRoute together with l.
+func (l *Limiter) SetMaintenanceMode(enabled bool) *Limiter {
+	l.maintenance.Lock()
+	l.maintenance.enabled = enabled
+	if l.maintenance.bucket == nil {
+		l.maintenance.bucket = rate.NewLimiter(0, 0)
+	}
+	l.maintenance.Unlock()
+
+	return l
+}
+
+// GetMaintenanceMode is thread-safe way of getting whether maintenance mode is on.
+func (l *Limiter) GetMaintenanceMode() bool {
+	l.maintenance.RLock()
+	defer l.maintenance.RUnlock()
+	return l.maintenance.enabled
+}
+
+// MaintenanceLimitReached returns a bool indicating if a request should be rejected because of maintenance mode.
+// It always returns false when maintenance mode is off.
+func (l *Limiter) MaintenanceLimitReached() bool {
+	l.maintenance.RLock()
+	enabled, maintenanceBucket := l.maintenance.enabled, l.maintenance.bucket
+	l.maintenance.RUnlock()
+
+	if !enabled {
+		return false
+	}
+
+	return !maintenanceBucket.Allow()
+}
@@ -0,0 +1,81 @@
+package limiter
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// SetMaxFunc is thread-safe way of setting the function giving the max of a key, in requests per second,
+// so premium users or internal callers get higher limits from the same limiter. The burst is scaled alike.
+// The function is called when a key gets its bucket, and again after RefreshMax. A result of zero or less keeps the max of l.
+func (l *Limiter) SetMaxFunc(fn func(key string, r *http.Request) float64) *Limiter {
+	l.Lock()
+	l.maxFunc = fn
+	l.resolvedMax = cache.NewCache[string, float64]().WithTTL(l.generalExpirableOptions.DefaultExpirationTTL)
+	l.Unlock()
+
+	return l
+}
+
+// GetMaxFunc is thread-safe way of getting the function giving the max of a key.
+func (l *Limiter) GetMaxFunc() func(key string, r *http.Request) float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxFunc
+}
+
+// RefreshMax forgets the max resolved for keys, so the function set by SetMaxFunc is called again
+// on their next request, e.g. after a user upgraded their plan. Their buckets keep their tokens.
+func (l *Limiter) RefreshMax(keys ...string) {
+	l.RLock()
+	resolved := l.resolvedMax
+	l.RUnlock()
+
+	if resolved == nil {
+		return
+	}
+	for _, key := range keys {
+		resolved.Invalidate(key)
+	}
+}
+
+// MaxOptionsForKey replaces the max of opts with the one the function set by SetMaxFunc resolved for key,
+// scaling the burst alike. A freshly resolved max is applied to the existing bucket of key too.
+func (l *Limiter) MaxOptionsForKey(key string, r *http.Request, opts BucketOptions) BucketOptions {
+	l.RLock()
+	fn, resolved := l.maxFunc, l.resolvedMax
+	l.RUnlock()
+
+	if fn == nil || opts.Max <= 0 {
+		return opts
+	}
+
+	max, found := resolved.Get(key)
+	if !found {
+		max = fn(key, r)
+		resolved.Set(key, max, l.bucketTTL(opts.TTL))
+	}
+	if max <= 0 {
+		return opts
+	}
+
+	opts.Burst = int(math.Max(1, math.Round(float64(opts.Burst)*max/opts.Max)))
+	opts.Max = max
+
+	if !found {
+		l.Lock()
+		l.bucketsMu.Lock()
+		if bucket, exists := l.tokenBuckets.Peek(key); exists {
+			bucketOpts := l.applyMinInterval(l.applyLeak(l.applyAdaptive(l.applyShare(opts))))
+			bucket.SetLimit(rate.Limit(bucketOpts.Max))
+			bucket.SetBurst(bucketOpts.Burst)
+		}
+		l.bucketsMu.Unlock()
+		l.Unlock()
+	}
+
+	return opts
+}
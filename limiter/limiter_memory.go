@@ -0,0 +1,69 @@
+package limiter
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// bucketEntryBytes approximates the memory held by one token bucket and its cache entry, without the key.
+const bucketEntryBytes = 256
+
+// memoryAccounting tracks the approximate bytes used by the buckets of a limiter and the ForRoute limiters sharing them.
+type memoryAccounting struct {
+	usage atomic.Int64
+
+	sync.Mutex
+	thresholds []int64
+	onAlarm    func(usage, threshold int64)
+	crossed    int
+}
+
+// add records delta bytes and fires the alarm of every threshold crossed upwards since the last call.
+// A threshold fires again only after usage went back below it.
+func (m *memoryAccounting) add(delta int64) {
+	usage := m.usage.Add(delta)
+
+	m.Lock()
+	defer m.Unlock()
+
+	crossed := sort.Search(len(m.thresholds), func(i int) bool { return m.thresholds[i] > usage })
+	if crossed > m.crossed && m.onAlarm != nil {
+		for _, threshold := range m.thresholds[m.crossed:crossed] {
+			go m.onAlarm(usage, threshold)
+		}
+	}
+	m.crossed = crossed
+}
+
+func tokenBucketBytes(key string) int64 {
+	return int64(len(key) + bucketEntryBytes)
+}
+
+func sustainedBucketsBytes(key string, buckets []*rate.Limiter) int64 {
+	return int64(len(key) + len(buckets)*bucketEntryBytes)
+}
+
+// SetMemoryAlarm is thread-safe way of setting a function called when the approximate memory used by the buckets
+// crosses one of thresholds, in bytes, upwards. It is called in its own goroutine with the usage and the crossed threshold,
+// so operators get an early warning before the process runs out of memory.
+// A threshold fires again only after usage went back below it.
+func (l *Limiter) SetMemoryAlarm(fn func(usage, threshold int64), thresholds ...int64) *Limiter {
+	sorted := append([]int64(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	l.memory.Lock()
+	l.memory.onAlarm = fn
+	l.memory.thresholds = sorted
+	l.memory.crossed = sort.Search(len(sorted), func(i int) bool { return sorted[i] > l.memory.usage.Load() })
+	l.memory.Unlock()
+
+	return l
+}
+
+// MemoryUsage returns the approximate number of bytes used by the token buckets and their keys.
+func (l *Limiter) MemoryUsage() int64 {
+	return l.memory.usage.Load()
+}
@@ -1,6 +1,10 @@
 package limiter
 
 import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -12,3 +16,257 @@ type ExpirableOptions struct {
 	// Deprecated: not used anymore
 	ExpireJobInterval time.Duration
 }
+
+// BucketOptions are options used when a token bucket is created for a key
+type BucketOptions struct {
+	// Maximum number of requests to limit per second.
+	Max float64
+
+	// Time window the limit is advertised in, e.g. in response headers.
+	// Zero means one second.
+	Window time.Duration
+
+	// Bucket burst size.
+	Burst int
+
+	// Bucket expiration TTL. Zero means the limiter-wide TTL.
+	TTL time.Duration
+
+	// Number of tokens the request takes. Zero means one.
+	Cost int
+}
+
+// WithRate returns opts with the max, burst and window of rate.
+func (opts BucketOptions) WithRate(rate Rate) BucketOptions {
+	opts.Max = rate.Max / rate.Per.Seconds()
+	opts.Burst = rate.Burst
+	opts.Window = rate.Per
+	return opts
+}
+
+// Rate is a validated combination of request rate and burst size, used with SetLimit
+type Rate struct {
+	// Maximum number of requests per Per.
+	Max float64
+
+	// Time window of Max.
+	Per time.Duration
+
+	// Maximum number of requests allowed at once.
+	Burst int
+}
+
+// PriorityPools carves the limit of every key into pools with their own share of max and burst,
+// so e.g. background jobs can never starve interactive traffic
+type PriorityPools struct {
+	// Share of the limit per pool name, e.g. map[string]float64{"interactive": 0.8, "batch": 0.2}.
+	Shares map[string]float64
+
+	// Pool used when Select returns a name missing from Shares.
+	// When Default is missing from Shares too, the request gets the whole limit, unpooled.
+	Default string
+
+	// Select picks the pool name of a request, e.g. PoolFromHeader("X-Priority").
+	Select func(r *http.Request) string
+}
+
+// PoolFromHeader selects the pool named by the value of header.
+func PoolFromHeader(header string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// PoolFromContext selects the pool named by the Context value of key.
+func PoolFromContext(key interface{}) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		value := r.Context().Value(key)
+		if value == nil {
+			return ""
+		}
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// IPv6Canonicalization decides how many leading bits of an IPv6 address identify a client.
+// The zero value groups addresses by their /64 prefix
+type IPv6Canonicalization int
+
+// IPv6CanonicalizationOff keeps whole IPv6 addresses, so every address gets its own bucket.
+const IPv6CanonicalizationOff IPv6Canonicalization = 128
+
+// IPv6Prefix groups IPv6 addresses by their prefix of prefixLength bits, e.g. IPv6Prefix(56).
+func IPv6Prefix(prefixLength int) IPv6Canonicalization {
+	return IPv6Canonicalization(prefixLength)
+}
+
+// PrefixLength returns the number of leading bits identifying a client.
+func (c IPv6Canonicalization) PrefixLength() int {
+	if c <= 0 {
+		return 64
+	}
+	return int(c)
+}
+
+// KeyClass tells which kind of client identity the limit was reached for,
+// so that end users and API integrators can get different guidance.
+type KeyClass string
+
+const (
+	// KeyClassIP is used when clients are only identified by their IP address, or mesh identity.
+	KeyClassIP KeyClass = "ip"
+
+	// KeyClassHeader is used when the keys contain limited headers, e.g. an API key.
+	KeyClassHeader KeyClass = "header"
+
+	// KeyClassClientID is used when the IP address was replaced by the client ID resolved from the Bearer token.
+	KeyClassClientID KeyClass = "client_id"
+
+	// KeyClassIdentity is used when the IP address was replaced by the identity found by tollbooth.AfterAuth.
+	KeyClassIdentity KeyClass = "identity"
+
+	// KeyClassBasicAuthUser is used when the keys contain a limited basic auth username.
+	KeyClassBasicAuthUser KeyClass = "basic_auth_user"
+
+	// KeyClassGlobal is used when the service-level limit set by SetGlobalMax was reached.
+	KeyClassGlobal KeyClass = "global"
+)
+
+// BucketState describes a token bucket, see InspectKey.
+type BucketState struct {
+	// Tokens left in the bucket now.
+	Tokens float64
+
+	// Maximum number of tokens, and tokens added per second.
+	Burst int
+	Max   float64
+
+	// Last time tokens were taken from or added to the bucket. Zero when the bucket was never used.
+	LastUpdate time.Time
+
+	// Time left before the bucket expires.
+	TTL time.Duration
+}
+
+// Info describes how a request was counted by the limiter, see tollbooth.LimitByRequestWithInfo.
+type Info struct {
+	// Key of the bucket the request was counted in.
+	// Empty when the request skipped the limiter or was rejected by the service-level limit.
+	Key string
+
+	// Maximum number of requests within the time window, and the number of requests left.
+	Limit     int
+	Remaining int
+
+	// Time window of Limit. Zero means one second.
+	Window time.Duration
+
+	// Time at which the bucket is full again.
+	ResetAt time.Time
+}
+
+// SetHeader sets RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy describing info
+// as seen at https://datatracker.ietf.org/doc/html/draft-ietf-httpapi-ratelimit-headers
+func (info Info) SetHeader(header http.Header) {
+	windowSeconds := 1
+	if info.Window > time.Second {
+		windowSeconds = int(math.Round(info.Window.Seconds()))
+	}
+
+	header.Set("RateLimit-Limit", strconv.Itoa(info.Limit))
+	header.Set("RateLimit-Reset", strconv.Itoa(windowSeconds))
+	header.Set("RateLimit-Remaining", strconv.Itoa(info.Remaining))
+	header.Set("RateLimit-Policy", strconv.Itoa(info.Limit)+";w="+strconv.Itoa(windowSeconds))
+}
+
+// Schedule is a recurring time window, e.g. business hours, see SetScheduledLimit.
+type Schedule struct {
+	// Name identifies the window in the keys of its buckets, e.g. "business-hours".
+	Name string
+
+	// Days on which the window starts. Empty means every day.
+	Days []time.Weekday
+
+	// Start and End of the window, as durations since midnight, e.g. 9*time.Hour and 17*time.Hour.
+	// An End before Start makes the window run past midnight.
+	Start time.Duration
+	End   time.Duration
+
+	// Location of the times above. Nil means time.Local.
+	Location *time.Location
+}
+
+// AdaptiveOptions configures how SetAdaptive moves the effective max between Min and the configured max.
+type AdaptiveOptions struct {
+	// Lowest effective max, in requests per second.
+	Min float64
+
+	// Requests per second added to the effective max after every healthy interval.
+	Increase float64
+
+	// Factor the effective max is multiplied by after every unhealthy interval, e.g. 0.5.
+	Decrease float64
+
+	// An interval is unhealthy when the average latency reaches LatencyThreshold,
+	// or the share of failed responses reaches ErrorRateThreshold. Zero disables a check.
+	LatencyThreshold   time.Duration
+	ErrorRateThreshold float64
+
+	// Length of the intervals responses are evaluated over.
+	Interval time.Duration
+}
+
+// LoadShedding configures when SetLoadShedding rejects requests, whatever their keys.
+type LoadShedding struct {
+	// Maximum number of goroutines. Zero means no cap.
+	MaxGoroutines int
+
+	// Maximum bytes of live heap objects. Zero means no cap.
+	MaxHeapBytes uint64
+
+	// Maximum CPU utilization in the [0, 1] range, as reported by CPUUtilization. Zero means no cap.
+	MaxCPU float64
+
+	// Reports the CPU utilization of the process or host, e.g. with gopsutil,
+	// since the standard library offers none. Nil means the CPU is not checked.
+	CPUUtilization func() float64
+
+	// How often the load is sampled, requests in between reuse the last sample. Zero means every request.
+	SampleInterval time.Duration
+
+	// Message rejected requests get. Empty means a default message.
+	Message string
+}
+
+// QuotaPeriod is the calendar period after which a quota allowance resets.
+type QuotaPeriod string
+
+const (
+	// QuotaDaily resets allowances at midnight.
+	QuotaDaily QuotaPeriod = "daily"
+
+	// QuotaMonthly resets allowances at midnight on the first day of the month.
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// Quota is a long-lived allowance per key, see SetQuota.
+type Quota struct {
+	// Number of requests per period.
+	Allowance int64
+
+	// Calendar period of Allowance.
+	Period QuotaPeriod
+
+	// Location of the calendar boundaries. Nil means time.UTC.
+	Location *time.Location
+}
+
+// QuotaUsage describes the quota of a key, see ConsumeQuota.
+type QuotaUsage struct {
+	// Requests per period, and requests left in the current period.
+	Allowance int64
+	Remaining int64
+
+	// Start of the next period.
+	ResetAt time.Time
+}
@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// SetMemoryPressure is thread-safe way of protecting the process against key floods, e.g. during an attack with spoofed IPs.
+// Once the number of token buckets reaches highWatermark, idle buckets are evicted and
+// new or refreshed buckets expire after pressureTTL instead of the configured TTL, until the number drops below highWatermark.
+// A highWatermark of zero or less disables it.
+func (l *Limiter) SetMemoryPressure(highWatermark int, pressureTTL time.Duration) *Limiter {
+	l.Lock()
+	l.pressureHighWatermark = highWatermark
+	l.pressureTTL = pressureTTL
+	l.Unlock()
+
+	return l
+}
+
+// GetMemoryPressure is thread-safe way of getting the watermark and TTL used under memory pressure.
+func (l *Limiter) GetMemoryPressure() (int, time.Duration) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.pressureHighWatermark, l.pressureTTL
+}
+
+// UnderMemoryPressure returns a bool indicating if the number of token buckets reached the high watermark.
+func (l *Limiter) UnderMemoryPressure() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.underMemoryPressure()
+}
+
+// GetMemoryPressureEvictions returns the number of idle buckets evicted under memory pressure.
+func (l *Limiter) GetMemoryPressureEvictions() uint64 {
+	return l.pressureEvictions.Load()
+}
+
+// underMemoryPressure requires that l is locked.
+func (l *Limiter) underMemoryPressure() bool {
+	return l.pressureHighWatermark > 0 && l.tokenBuckets.Len() >= l.pressureHighWatermark
+}
+
+// pressureTTLFor returns the TTL to give to a bucket, shortened under memory pressure. It requires that l is locked.
+// Idle buckets are evicted first, at most once per pressure TTL since each sweep walks every bucket.
+func (l *Limiter) pressureTTLFor(ttl time.Duration) time.Duration {
+	if !l.underMemoryPressure() {
+		return ttl
+	}
+
+	now := time.Now()
+	if now.Sub(l.pressureSweptAt) >= l.pressureTTL {
+		l.pressureSweptAt = now
+		l.evictIdleBuckets(now)
+	}
+
+	if l.underMemoryPressure() && l.pressureTTL > 0 && l.pressureTTL < ttl {
+		return l.pressureTTL
+	}
+	return ttl
+}
+
+// evictIdleBuckets removes the expired buckets and the full ones. It requires that l is locked.
+// A full bucket behaves like the one created on the next request, so removing it grants no extra requests.
+func (l *Limiter) evictIdleBuckets(now time.Time) {
+	l.tokenBuckets.DeleteExpired()
+	l.sustainedBuckets.DeleteExpired()
+
+	for _, key := range l.tokenBuckets.Keys() {
+		bucket, found := l.tokenBuckets.Peek(key)
+		if !found || !isFull(bucket, now) {
+			continue
+		}
+
+		sustainedBuckets, _ := l.sustainedBuckets.Peek(key)
+		if !allFull(sustainedBuckets, now) {
+			continue
+		}
+
+		l.tokenBuckets.Invalidate(key)
+		l.sustainedBuckets.Invalidate(key)
+		l.pressureEvictions.Add(1)
+	}
+}
+
+func isFull(bucket *rate.Limiter, now time.Time) bool {
+	return bucket.TokensAt(now) >= float64(bucket.Burst())
+}
+
+func allFull(buckets []*rate.Limiter, now time.Time) bool {
+	for _, bucket := range buckets {
+		if !isFull(bucket, now) {
+			return false
+		}
+	}
+	return true
+}
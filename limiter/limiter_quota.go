@@ -0,0 +1,196 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// ErrInvalidQuota is returned by SetQuota for a quota without allowance or with an unknown period.
+var ErrInvalidQuota = errors.New("invalid quota")
+
+// defaultQuotaExhaustedMessage is sent to requests over their quota when no message is set.
+const defaultQuotaExhaustedMessage = "You have exhausted your quota."
+
+// QuotaStore persists the usage of quotas, e.g. in a database, so allowances survive restarts
+// and are shared by every node.
+type QuotaStore interface {
+	// Increment adds n to the usage of key in the period starting at periodStart, and returns the new usage.
+	// Usage of earlier periods can be discarded.
+	Increment(ctx context.Context, key string, periodStart time.Time, n int64) (int64, error)
+}
+
+// quotaUsage is the usage of a key in a period.
+type quotaUsage struct {
+	periodStart time.Time
+	used        int64
+}
+
+// defaultQuotaStoreKeys is how many keys a MemoryQuotaStore tracks when no size is given.
+const defaultQuotaStoreKeys = 100000
+
+// MemoryQuotaStore is a QuotaStore keeping usage in memory. It is the default store,
+// which forgets the usage on restart.
+//
+// It tracks a bounded number of keys. Once full, the usage of the least recently used key is forgotten,
+// and that key gets a fresh allowance. With keys as numerous as IP addresses, size it for the clients
+// of a whole period, or use a persistent store.
+type MemoryQuotaStore struct {
+	mu          sync.Mutex
+	periodStart time.Time
+	usage       cache.Cache[string, quotaUsage]
+}
+
+// NewMemoryQuotaStore creates an empty MemoryQuotaStore tracking at most maxKeys keys,
+// 100000 when maxKeys is not positive.
+func NewMemoryQuotaStore(maxKeys int) *MemoryQuotaStore {
+	if maxKeys <= 0 {
+		maxKeys = defaultQuotaStoreKeys
+	}
+	return &MemoryQuotaStore{usage: cache.NewCache[string, quotaUsage]().WithMaxKeys(maxKeys).WithLRU()}
+}
+
+// Increment adds n to the usage of key in the period starting at periodStart.
+// Usage of earlier periods is discarded once a later period starts.
+func (s *MemoryQuotaStore) Increment(_ context.Context, key string, periodStart time.Time, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if periodStart.After(s.periodStart) {
+		s.periodStart = periodStart
+		for _, k := range s.usage.Keys() {
+			if usage, found := s.usage.Peek(k); found && usage.periodStart.Before(periodStart) {
+				s.usage.Remove(k)
+			}
+		}
+	}
+
+	usage, _ := s.usage.Get(key)
+	if !usage.periodStart.Equal(periodStart) {
+		usage = quotaUsage{periodStart: periodStart}
+	}
+	usage.used += n
+	s.usage.Set(key, usage, 0)
+
+	return usage.used, nil
+}
+
+// bounds returns the start of the period of q containing t, and the start of the next one.
+func (q Quota) bounds(t time.Time) (time.Time, time.Time) {
+	location := q.Location
+	if location == nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+
+	if q.Period == QuotaMonthly {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 1, 0)
+	}
+
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// SetQuota is thread-safe way of giving every client a long-lived allowance on top of its rate limit,
+// e.g. 10000 requests per month, resetting on calendar boundaries. The middlewares of tollbooth count it
+// per client identity, across every path and method. Usage is kept in the store set with
+// SetQuotaStore, in memory by default. Requests over their quota get the response set with SetQuotaExhaustedResponse.
+// It returns ErrInvalidQuota when the allowance is not positive or the period is unknown.
+func (l *Limiter) SetQuota(quota Quota) error {
+	if quota.Allowance <= 0 || (quota.Period != QuotaDaily && quota.Period != QuotaMonthly) {
+		return ErrInvalidQuota
+	}
+
+	l.Lock()
+	l.quota = quota
+	if l.quotaStore == nil {
+		l.quotaStore = NewMemoryQuotaStore(0)
+	}
+	l.Unlock()
+
+	return nil
+}
+
+// GetQuota is thread-safe way of getting the quota of every key. It returns false when no quota is set.
+func (l *Limiter) GetQuota() (Quota, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.quota, l.quota.Allowance > 0
+}
+
+// SetQuotaStore is thread-safe way of setting where the usage of quotas is kept.
+func (l *Limiter) SetQuotaStore(store QuotaStore) *Limiter {
+	l.Lock()
+	l.quotaStore = store
+	l.Unlock()
+
+	return l
+}
+
+// GetQuotaStore is thread-safe way of getting where the usage of quotas is kept.
+func (l *Limiter) GetQuotaStore() QuotaStore {
+	l.RLock()
+	defer l.RUnlock()
+	return l.quotaStore
+}
+
+// SetQuotaExhaustedResponse is thread-safe way of setting the message and status code of requests over their quota,
+// so clients can tell an exhausted quota, which only resets with the next period, from a rate limit.
+func (l *Limiter) SetQuotaExhaustedResponse(message string, statusCode int) *Limiter {
+	l.Lock()
+	l.quotaMessage = message
+	l.quotaStatusCode = statusCode
+	l.Unlock()
+
+	return l
+}
+
+// GetQuotaExhaustedResponse is thread-safe way of getting the message and status code of requests over their quota.
+// It defaults to a quota message with the status code of the limiter.
+func (l *Limiter) GetQuotaExhaustedResponse() (string, int) {
+	l.RLock()
+	defer l.RUnlock()
+
+	message, statusCode := l.quotaMessage, l.quotaStatusCode
+	if message == "" {
+		message = defaultQuotaExhaustedMessage
+	}
+	if statusCode == 0 {
+		statusCode = l.statusCode
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusTooManyRequests
+	}
+	return message, statusCode
+}
+
+// ConsumeQuota takes n requests from the quota of key, and reports whether key exceeded its quota.
+// It returns false when no quota is set. When the store fails, the error is returned
+// and the caller decides whether to fail open.
+func (l *Limiter) ConsumeQuota(ctx context.Context, key string, n int64) (QuotaUsage, bool, error) {
+	l.RLock()
+	quota, store := l.quota, l.quotaStore
+	l.RUnlock()
+
+	if quota.Allowance <= 0 || store == nil {
+		return QuotaUsage{}, false, nil
+	}
+
+	periodStart, resetAt := quota.bounds(l.Now())
+
+	used, err := store.Increment(ctx, key, periodStart, n)
+	if err != nil {
+		return QuotaUsage{}, false, err
+	}
+
+	usage := QuotaUsage{Allowance: quota.Allowance, Remaining: quota.Allowance - used, ResetAt: resetAt}
+	if usage.Remaining < 0 {
+		usage.Remaining = 0
+	}
+	return usage, used > quota.Allowance, nil
+}
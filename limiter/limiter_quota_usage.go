@@ -0,0 +1,195 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrQuotaUsageNotSupported is returned by ImportUsage and ExportUsage when no quota is set,
+// or the quota store cannot list and overwrite usage, see QuotaUsageStore.
+var ErrQuotaUsageNotSupported = errors.New("quota store does not support importing and exporting usage")
+
+// quotaUsageHeader is the header row of the CSV written by ExportUsage.
+var quotaUsageHeader = []string{"key", "period_start", "used"}
+
+// QuotaRecord is the usage of a key in a period, as exported by ExportUsage.
+type QuotaRecord struct {
+	Key         string    `json:"key"`
+	PeriodStart time.Time `json:"period_start"`
+	Used        int64     `json:"used"`
+}
+
+// QuotaUsageStore is a QuotaStore which can also list and overwrite usage, for ImportUsage and ExportUsage.
+type QuotaUsageStore interface {
+	QuotaStore
+
+	// Usage returns the usage of every key it tracks.
+	Usage(ctx context.Context) ([]QuotaRecord, error)
+
+	// SetUsage overwrites the usage of a key in a period.
+	SetUsage(ctx context.Context, record QuotaRecord) error
+}
+
+// Usage returns the usage of every key in the latest period, sorted by key.
+func (s *MemoryQuotaStore) Usage(_ context.Context) ([]QuotaRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]QuotaRecord, 0, s.usage.Len())
+	for _, key := range s.usage.Keys() {
+		if usage, found := s.usage.Peek(key); found {
+			records = append(records, QuotaRecord{Key: key, PeriodStart: usage.periodStart, Used: usage.used})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records, nil
+}
+
+// SetUsage overwrites the usage of a key in a period. Usage of a period earlier than the latest one is ignored.
+func (s *MemoryQuotaStore) SetUsage(ctx context.Context, record QuotaRecord) error {
+	// Incrementing by zero starts the period, and discards usage of earlier periods.
+	if _, err := s.Increment(ctx, record.Key, record.PeriodStart, 0); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record.PeriodStart.Before(s.periodStart) {
+		return nil
+	}
+	s.usage.Set(record.Key, quotaUsage{periodStart: record.PeriodStart, used: record.Used}, 0)
+	return nil
+}
+
+// quotaUsageStore returns the store of the quota when it supports importing and exporting usage.
+func (l *Limiter) quotaUsageStore() (QuotaUsageStore, error) {
+	l.RLock()
+	quota, store := l.quota, l.quotaStore
+	l.RUnlock()
+
+	usageStore, ok := store.(QuotaUsageStore)
+	if quota.Allowance <= 0 || !ok {
+		return nil, ErrQuotaUsageNotSupported
+	}
+	return usageStore, nil
+}
+
+// ExportUsage writes the quota usage of every key as CSV, with a key,period_start,used header row
+// and period starts in RFC 3339, e.g. to reconcile it with a billing system.
+// It returns ErrQuotaUsageNotSupported when the quota store is not a QuotaUsageStore.
+func (l *Limiter) ExportUsage(w io.Writer) error {
+	store, err := l.quotaUsageStore()
+	if err != nil {
+		return err
+	}
+
+	records, err := store.Usage(context.Background())
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(quotaUsageHeader); err != nil {
+		return err
+	}
+	for _, record := range records {
+		row := []string{record.Key, record.PeriodStart.Format(time.RFC3339), strconv.FormatInt(record.Used, 10)}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportUsageJSON writes the quota usage of every key as a JSON array of QuotaRecord, readable by ImportUsage.
+// It returns ErrQuotaUsageNotSupported when the quota store is not a QuotaUsageStore.
+func (l *Limiter) ExportUsageJSON(w io.Writer) error {
+	store, err := l.quotaUsageStore()
+	if err != nil {
+		return err
+	}
+
+	records, err := store.Usage(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(records)
+}
+
+// ImportUsage overwrites the quota usage of the keys read from r, e.g. to restore it after a migration.
+// r holds either the CSV written by ExportUsage, or the JSON array written by ExportUsageJSON.
+// It returns ErrQuotaUsageNotSupported when the quota store is not a QuotaUsageStore.
+func (l *Limiter) ImportUsage(r io.Reader) error {
+	store, err := l.quotaUsageStore()
+	if err != nil {
+		return err
+	}
+
+	records, err := readQuotaRecords(r)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := store.SetUsage(context.Background(), record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readQuotaRecords reads a JSON array of QuotaRecord, or CSV rows like the ones written by ExportUsage.
+func readQuotaRecords(r io.Reader) ([]QuotaRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var records []QuotaRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]QuotaRecord, 0, len(rows))
+	for i, row := range rows {
+		if len(row) != len(quotaUsageHeader) {
+			return nil, fmt.Errorf("quota usage row %d: expected %d fields, got %d", i+1, len(quotaUsageHeader), len(row))
+		}
+		if i == 0 && row[0] == quotaUsageHeader[0] {
+			continue
+		}
+
+		periodStart, err := time.Parse(time.RFC3339, row[1])
+		if err != nil {
+			return nil, fmt.Errorf("quota usage row %d: %w", i+1, err)
+		}
+		used, err := strconv.ParseInt(row[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("quota usage row %d: %w", i+1, err)
+		}
+
+		records = append(records, QuotaRecord{Key: row[0], PeriodStart: periodStart, Used: used})
+	}
+	return records, nil
+}
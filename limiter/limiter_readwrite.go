@@ -0,0 +1,51 @@
+package limiter
+
+import "net/http"
+
+// SetReadWriteLimits is thread-safe way of splitting the budget of every key into a read bucket,
+// for GET, HEAD and OPTIONS requests, and a write bucket for all other methods, each with its own rate.
+// They replace the limiter-wide rate, path limits still take precedence.
+// It returns ErrInvalidRate when either rate is invalid, see SetLimit.
+func (l *Limiter) SetReadWriteLimits(read, write Rate) error {
+	if err := read.Validate(); err != nil {
+		return err
+	}
+	if err := write.Validate(); err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.readLimit = read
+	l.writeLimit = write
+	l.Unlock()
+
+	return nil
+}
+
+// GetReadWriteLimits is thread-safe way of getting the read and write rates.
+// It returns false when the budget is not split.
+func (l *Limiter) GetReadWriteLimits() (Rate, Rate, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.readLimit.Max <= 0 {
+		return Rate{}, Rate{}, false
+	}
+	return l.readLimit, l.writeLimit, true
+}
+
+// ReadWriteLimitForMethod returns "read" or "write" and the rate of the bucket for method.
+// It returns false when the budget is not split.
+func (l *Limiter) ReadWriteLimitForMethod(method string) (string, Rate, bool) {
+	read, write, found := l.GetReadWriteLimits()
+	if !found {
+		return "", Rate{}, false
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read", read, true
+	default:
+		return "write", write, true
+	}
+}
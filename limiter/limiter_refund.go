@@ -0,0 +1,38 @@
+package limiter
+
+import "time"
+
+// Refund gives n tokens back to the buckets of key, up to their burst, e.g. for requests which failed
+// cheaply and should not count fully against the budget of the client. It does nothing when key has no bucket.
+func (l *Limiter) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if bucket, found := l.tokenBuckets.Peek(key); found {
+		bucket.RefundAt(now, n)
+	}
+
+	if sustainedBuckets, found := l.sustainedBuckets.Peek(key); found {
+		for _, bucket := range sustainedBuckets {
+			bucket.RefundAt(now, n)
+		}
+	}
+}
+
+// RefundGlobal gives back the token GlobalLimitReached took for an admitted request, up to the global burst,
+// e.g. for requests rejected afterwards by their quota. It does nothing when there is no global limit.
+func (l *Limiter) RefundGlobal() {
+	l.RLock()
+	globalBucket := l.globalBucket
+	l.RUnlock()
+
+	if globalBucket != nil {
+		globalBucket.RefundAt(time.Now(), 1)
+	}
+}
@@ -0,0 +1,62 @@
+package limiter
+
+// SetRegion is thread-safe way of setting the deployment region, e.g. "eu-west-1".
+// The region becomes part of every key, so clients get a budget per region,
+// and picks the rate set for it with SetRegionLimits.
+func (l *Limiter) SetRegion(region string) *Limiter {
+	l.Lock()
+	l.region = region
+	l.Unlock()
+
+	return l
+}
+
+// GetRegion is thread-safe way of getting the deployment region.
+func (l *Limiter) GetRegion() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.region
+}
+
+// SetRegionLimits is thread-safe way of giving regions their own rate, so every deployment can share
+// the same configuration. The rate of the region set with SetRegion replaces the limiter-wide rate,
+// the other limits still take precedence. Regions without an entry use the limiter-wide rate.
+// It returns ErrInvalidRate when a rate is invalid, see SetLimit.
+func (l *Limiter) SetRegionLimits(limits map[string]Rate) error {
+	for _, limit := range limits {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	copied := make(map[string]Rate, len(limits))
+	for region, limit := range limits {
+		copied[region] = limit
+	}
+
+	l.Lock()
+	l.regionLimits = copied
+	l.Unlock()
+
+	return nil
+}
+
+// GetRegionLimits is thread-safe way of getting the rates of the regions.
+func (l *Limiter) GetRegionLimits() map[string]Rate {
+	l.RLock()
+	defer l.RUnlock()
+	return l.regionLimits
+}
+
+// RegionLimit returns the rate of the region set with SetRegion.
+// It returns false when no region is set, or the region has no rate of its own.
+func (l *Limiter) RegionLimit() (Rate, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.region == "" {
+		return Rate{}, false
+	}
+	limit, found := l.regionLimits[l.region]
+	return limit, found
+}
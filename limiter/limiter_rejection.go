@@ -0,0 +1,95 @@
+package limiter
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRejections bounds the cached rejection bodies and headers, in case messages and limits keep changing at runtime.
+const maxRejections = 64
+
+// rejections caches the bytes of rejection messages and the headers of rejections,
+// shared with the limiters created by ForRoute.
+type rejections struct {
+	sync.RWMutex
+	bodies  map[string][]byte
+	headers map[rejectionHeaderKey]http.Header
+}
+
+// rejectionHeaderKey holds the configured values the headers of a rejection are rendered from.
+type rejectionHeaderKey struct {
+	limit  int
+	window time.Duration
+}
+
+func newRejections() *rejections {
+	return &rejections{bodies: make(map[string][]byte), headers: make(map[rejectionHeaderKey]http.Header)}
+}
+
+// RejectionBody returns message as bytes, reusing the same bytes for every rejection with that message,
+// so a flood of rejected requests does not allocate a body each. The returned bytes must not be modified.
+// Messages are cached as they are used, so changing the configured messages needs no invalidation.
+func (l *Limiter) RejectionBody(message string) []byte {
+	cache := l.rejections
+	if cache == nil {
+		return []byte(message)
+	}
+
+	cache.RLock()
+	body, found := cache.bodies[message]
+	cache.RUnlock()
+	if found {
+		return body
+	}
+
+	body = []byte(message)
+
+	cache.Lock()
+	if len(cache.bodies) >= maxRejections {
+		cache.bodies = make(map[string][]byte)
+	}
+	cache.bodies[message] = body
+	cache.Unlock()
+
+	return body
+}
+
+// RejectionHeader returns RateLimit-Limit, RateLimit-Reset and RateLimit-Policy describing info, see Info.SetHeader.
+// They only depend on the limit and its window, so like RejectionBody the header is rendered once and reused
+// for every rejection under the same limit. RateLimit-Remaining and Retry-After vary per request and are left out.
+// The returned header and its values are shared and must not be modified, copy its values instead.
+func (l *Limiter) RejectionHeader(info Info) http.Header {
+	key := rejectionHeaderKey{limit: info.Limit, window: info.Window}
+
+	cache := l.rejections
+	if cache == nil {
+		return renderRejectionHeader(key)
+	}
+
+	cache.RLock()
+	header, found := cache.headers[key]
+	cache.RUnlock()
+	if found {
+		return header
+	}
+
+	header = renderRejectionHeader(key)
+
+	cache.Lock()
+	if len(cache.headers) >= maxRejections {
+		cache.headers = make(map[rejectionHeaderKey]http.Header)
+	}
+	cache.headers[key] = header
+	cache.Unlock()
+
+	return header
+}
+
+// renderRejectionHeader renders the headers of a rejection which only depend on the limit.
+func renderRejectionHeader(key rejectionHeaderKey) http.Header {
+	header := make(http.Header)
+	Info{Limit: key.limit, Window: key.window}.SetHeader(header)
+	header.Del("RateLimit-Remaining")
+	return header
+}
@@ -1,7 +1,9 @@
 package limiter
 
 import (
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestSetGetMessage(t *testing.T) {
@@ -188,3 +190,328 @@ func TestSetGetContextValues(t *testing.T) {
 		t.Errorf("ContextValues field is incorrect. Value: %v", entries)
 	}
 }
+
+func TestSetGetPathLimits(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if _, _, found := lmt.GetPathLimit("/search"); found {
+		t.Errorf("PathLimits field is incorrect. Value: %v", lmt.GetPathLimits())
+	}
+
+	lmt.SetPathLimits(map[string]float64{"/": 5, "/search": 2, "/static/": 100})
+
+	if len(lmt.GetPathLimits()) != 3 {
+		t.Errorf("PathLimits field is incorrect. Value: %v", lmt.GetPathLimits())
+	}
+
+	if prefix, max, _ := lmt.GetPathLimit("/static/css/app.css"); prefix != "/static/" || max != 100 {
+		t.Errorf("Longest prefix should win. Prefix: %v, Max: %v", prefix, max)
+	}
+
+	if prefix, max, _ := lmt.GetPathLimit("/about"); prefix != "/" || max != 5 {
+		t.Errorf("Root prefix should match. Prefix: %v, Max: %v", prefix, max)
+	}
+}
+
+func TestSetGetGlobalMax(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if lmt.GetGlobalMax() != 0 || lmt.GlobalLimitReached() {
+		t.Errorf("GlobalMax field is incorrect. Value: %v", lmt.GetGlobalMax())
+	}
+
+	if lmt.SetGlobalMax(1).GetGlobalMax() != 1 {
+		t.Errorf("GlobalMax field is incorrect. Value: %v", lmt.GetGlobalMax())
+	}
+
+	if lmt.GlobalLimitReached() {
+		t.Error("First time count should not reached the global limit.")
+	}
+
+	if !lmt.GlobalLimitReached() {
+		t.Error("Second time count should reached the global limit.")
+	}
+
+	if lmt.SetGlobalMax(0).GlobalLimitReached() {
+		t.Error("Disabled global limit should never be reached.")
+	}
+}
+
+func TestSetGetExcludedPaths(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if len(lmt.GetExcludedPaths()) != 0 || lmt.IsExcludedPath("/healthz") {
+		t.Errorf("ExcludedPaths field is incorrect. Value: %v", lmt.GetExcludedPaths())
+	}
+
+	lmt.SetExcludedPaths([]string{"/healthz", "/debug/*"})
+
+	for path, expected := range map[string]bool{
+		"/healthz":         true,
+		"/healthz/deep":    false,
+		"/debug/pprof/":    true,
+		"/debug":           false,
+		"/api/v1/accounts": false,
+	} {
+		if lmt.IsExcludedPath(path) != expected {
+			t.Errorf("IsExcludedPath(%v) should be %v.", path, expected)
+		}
+	}
+}
+
+func TestSetGetRate(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if lmt.GetWindow() != time.Second {
+		t.Errorf("Window field is incorrect. Value: %v", lmt.GetWindow())
+	}
+
+	lmt.SetRate(90, 15*time.Minute)
+
+	if lmt.GetMax() != 0.1 || lmt.GetBurst() != 90 || lmt.GetWindow() != 15*time.Minute {
+		t.Errorf("Rate is incorrect. Max: %v, Burst: %v, Window: %v", lmt.GetMax(), lmt.GetBurst(), lmt.GetWindow())
+	}
+
+	// SetMax goes back to requests per second.
+	if lmt.SetMax(2).GetWindow() != time.Second {
+		t.Errorf("Window field is incorrect. Value: %v", lmt.GetWindow())
+	}
+}
+
+func TestSetGetLimit(t *testing.T) {
+	lmt := New(nil)
+
+	if err := lmt.SetLimit(Rate{Max: 10, Per: 2 * time.Second, Burst: 20}); err != nil {
+		t.Fatalf("Valid rate should be accepted. Error: %v", err)
+	}
+
+	if lmt.GetMax() != 5 || lmt.GetBurst() != 20 || lmt.GetWindow() != 2*time.Second {
+		t.Errorf("Limit is incorrect. Max: %v, Burst: %v, Window: %v", lmt.GetMax(), lmt.GetBurst(), lmt.GetWindow())
+	}
+
+	if rate := lmt.GetLimit(); rate != (Rate{Max: 10, Per: 2 * time.Second, Burst: 20}) {
+		t.Errorf("Limit is incorrect. Value: %v", rate)
+	}
+
+	for _, invalid := range []Rate{
+		{Max: 0, Per: time.Second, Burst: 1},
+		{Max: -1, Per: time.Second, Burst: 1},
+		{Max: 1, Per: 0, Burst: 1},
+		{Max: 1, Per: time.Second, Burst: 0},
+	} {
+		if err := lmt.SetLimit(invalid); !errors.Is(err, ErrInvalidRate) {
+			t.Errorf("Invalid rate should be rejected. Rate: %v, Error: %v", invalid, err)
+		}
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidRate) {
+			t.Errorf("Invalid rate should not validate. Rate: %v, Error: %v", invalid, err)
+		}
+	}
+
+	// Rejected rates leave the previous limit in place.
+	if lmt.GetMax() != 5 || lmt.GetBurst() != 20 {
+		t.Errorf("Limit is incorrect. Max: %v, Burst: %v", lmt.GetMax(), lmt.GetBurst())
+	}
+}
+
+func TestSetGetTrustedHops(t *testing.T) {
+	lmt := New(nil).SetIPLookup(IPLookup{Name: "X-Forwarded-For"})
+
+	if lmt.SetTrustedHops(2).GetTrustedHops() != 2 {
+		t.Errorf("TrustedHops field is incorrect. Value: %v", lmt.GetTrustedHops())
+	}
+
+	if lookup := lmt.GetIPLookup(); lookup.Name != "X-Forwarded-For" || lookup.TrustedHops != 2 {
+		t.Errorf("IPLookup field is incorrect. Value: %v", lookup)
+	}
+}
+
+func TestSetGetMemoryPressure(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if watermark, _ := lmt.GetMemoryPressure(); watermark != 0 || lmt.UnderMemoryPressure() {
+		t.Errorf("MemoryPressure field is incorrect. Value: %v", watermark)
+	}
+
+	if watermark, ttl := lmt.SetMemoryPressure(1000, time.Second).GetMemoryPressure(); watermark != 1000 || ttl != time.Second {
+		t.Errorf("MemoryPressure field is incorrect. Watermark: %v, TTL: %v", watermark, ttl)
+	}
+}
+
+func TestSetGetReadWriteLimits(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	// Check default
+	if _, _, found := lmt.GetReadWriteLimits(); found {
+		t.Error("ReadWriteLimits should not be set by default.")
+	}
+
+	read := Rate{Max: 10, Per: time.Second, Burst: 10}
+	write := Rate{Max: 1, Per: time.Second, Burst: 1}
+
+	if err := lmt.SetReadWriteLimits(read, Rate{}); !errors.Is(err, ErrInvalidRate) {
+		t.Errorf("Invalid write rate should be rejected. Error: %v", err)
+	}
+
+	if err := lmt.SetReadWriteLimits(read, write); err != nil {
+		t.Fatalf("Valid rates should be accepted. Error: %v", err)
+	}
+
+	for method, expected := range map[string]string{"GET": "read", "HEAD": "read", "POST": "write", "PATCH": "write"} {
+		if readWrite, _, _ := lmt.ReadWriteLimitForMethod(method); readWrite != expected {
+			t.Errorf("Method %v should use the %v bucket, got %v.", method, expected, readWrite)
+		}
+	}
+}
+
+func TestMatchesMethod(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	if !lmt.MatchesMethod("DELETE") {
+		t.Error("Every method should match when no methods are set.")
+	}
+
+	lmt.SetMethods([]string{"get", "WRITE", "admin"}).SetMethodGroup("admin", []string{"PURGE"})
+
+	for method, expected := range map[string]bool{
+		"GET":     true,
+		"Get":     true,
+		"POST":    true,
+		"DELETE":  true,
+		"PURGE":   true,
+		"HEAD":    false,
+		"OPTIONS": false,
+	} {
+		if lmt.MatchesMethod(method) != expected {
+			t.Errorf("MatchesMethod(%v) should be %v.", method, expected)
+		}
+	}
+
+	if !lmt.SetMethods([]string{"*"}).MatchesMethod("HEAD") {
+		t.Error("Wildcard should match every method.")
+	}
+}
+
+func TestSetGetDownloadRate(t *testing.T) {
+	lmt := New(nil)
+
+	if lmt.GetDownloadRate() != 0 {
+		t.Errorf("Download rate should be disabled by default. Value: %v", lmt.GetDownloadRate())
+	}
+
+	lmt.SetDownloadRate(1024)
+	if lmt.GetDownloadRate() != 1024 {
+		t.Errorf("Download rate is not set correctly. Value: %v", lmt.GetDownloadRate())
+	}
+
+	lmt.SetDownloadRate(0)
+	if lmt.GetDownloadRate() != 0 {
+		t.Errorf("Zero should disable the download rate. Value: %v", lmt.GetDownloadRate())
+	}
+}
+
+func TestSetGetMaxRequestsPerConn(t *testing.T) {
+	lmt := New(nil).SetMaxRequestsPerConn(100)
+
+	if lmt.GetMaxRequestsPerConn() != 100 {
+		t.Errorf("Max requests per connection is not set correctly. Value: %v", lmt.GetMaxRequestsPerConn())
+	}
+}
+
+func TestSetGetMaintenance(t *testing.T) {
+	lmt := New(nil)
+	route := lmt.ForRoute("search")
+
+	if _, message := lmt.GetMaintenance(); message != defaultMaintenanceMessage {
+		t.Errorf("Maintenance message should default to %q. Value: %q", defaultMaintenanceMessage, message)
+	}
+
+	lmt.SetMaintenance(5, "Back soon.").SetMaintenanceMode(true)
+
+	if max, message := lmt.GetMaintenance(); max != 5 || message != "Back soon." {
+		t.Errorf("Maintenance is not set correctly. Value: %v %q", max, message)
+	}
+	if !lmt.GetMaintenanceMode() {
+		t.Error("Maintenance mode should be on.")
+	}
+	if !route.GetMaintenanceMode() {
+		t.Error("Maintenance mode should be on for routes created before it was switched on.")
+	}
+}
+
+func TestSetGetIPFamilyLimits(t *testing.T) {
+	lmt := New(nil)
+
+	if _, found := lmt.IPFamilyLimitForIP("10.1.2.3"); found {
+		t.Error("IP families should share the limiter-wide rate by default.")
+	}
+
+	if err := lmt.SetIPFamilyLimits(Rate{Max: 10, Per: time.Second, Burst: 10}, Rate{Max: 1, Per: time.Second, Burst: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rate, _ := lmt.IPFamilyLimitForIP("10.1.2.3"); rate.Max != 10 {
+		t.Errorf("IPv4 rate is not set correctly. Value: %v", rate)
+	}
+	if rate, _ := lmt.IPFamilyLimitForIP("2001:db8::1"); rate.Max != 1 {
+		t.Errorf("IPv6 rate is not set correctly. Value: %v", rate)
+	}
+	if _, found := lmt.IPFamilyLimitForIP("spiffe://cluster/ns/default/sa/web"); found {
+		t.Error("Identities other than IP addresses should not get a family rate.")
+	}
+}
+
+func TestSetGetRegion(t *testing.T) {
+	lmt := New(nil)
+
+	if err := lmt.SetRegionLimits(map[string]Rate{"us-east-1": {Max: 10, Per: time.Second, Burst: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := lmt.RegionLimit(); found {
+		t.Error("Limiters without a region should use the limiter-wide rate.")
+	}
+
+	lmt.SetRegion("us-east-1")
+	if lmt.GetRegion() != "us-east-1" {
+		t.Errorf("Region field is incorrect. Value: %v", lmt.GetRegion())
+	}
+	if rate, _ := lmt.RegionLimit(); rate.Max != 10 {
+		t.Errorf("Region rate is not set correctly. Value: %v", rate)
+	}
+
+	lmt.SetRegion("ap-south-1")
+	if _, found := lmt.RegionLimit(); found {
+		t.Error("Regions without a rate should use the limiter-wide rate.")
+	}
+
+	if err := lmt.SetRegionLimits(map[string]Rate{"us-east-1": {Max: 10}}); !errors.Is(err, ErrInvalidRate) {
+		t.Errorf("Invalid rates should be rejected. Got: %v", err)
+	}
+}
+
+func TestSetGetLimits(t *testing.T) {
+	lmt := New(nil)
+
+	if err := lmt.SetLimits(Rate{Max: 1000, Per: time.Hour, Burst: 1000}, Rate{Max: 10, Per: time.Second, Burst: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := lmt.GetLimits()
+	if len(limits) != 2 || limits[0].Max != 10 || limits[0].Burst != 20 || limits[1].Per != time.Hour {
+		t.Errorf("Limits should be sorted by window, the shortest first. Got: %v", limits)
+	}
+	if lmt.GetMax() != 10 {
+		t.Errorf("The shortest window should set max. Value: %v", lmt.GetMax())
+	}
+
+	if err := lmt.SetLimits(); !errors.Is(err, ErrInvalidRate) {
+		t.Errorf("At least one limit should be required. Got: %v", err)
+	}
+	if err := lmt.SetLimits(Rate{Max: 10, Per: time.Second}); !errors.Is(err, ErrInvalidRate) {
+		t.Errorf("Invalid limits should be rejected. Got: %v", err)
+	}
+}
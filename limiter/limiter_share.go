@@ -0,0 +1,153 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// ShareSyncer decides how large a share of the configured limits this node may use.
+//
+// Implementations typically report localUsage, the number of requests admitted by this node since the
+// previous sync, to a shared store such as Redis, and return this node's share of the cluster-wide limit,
+// for example 1/N for N live nodes or a share weighted by recent traffic.
+// The returned share must be in the (0, 1] range, otherwise it is ignored.
+type ShareSyncer interface {
+	SyncShare(ctx context.Context, localUsage float64) (float64, error)
+}
+
+// shareState is the share of the limits this node may use. It is shared with the limiters created by ForRoute,
+// since they share the buckets, so one syncer rescales them all.
+type shareState struct {
+	sync.Mutex
+
+	share        float64
+	syncer       ShareSyncer
+	syncInterval time.Duration
+	syncedAt     time.Time
+	syncing      bool
+	usage        float64
+}
+
+// current requires that s is locked.
+func (s *shareState) current() float64 {
+	if s.share <= 0 {
+		return 1
+	}
+	return s.share
+}
+
+// addUsage counts admitted requests towards the usage reported at the next sync.
+func (s *shareState) addUsage(n float64) {
+	s.Lock()
+	s.usage += n
+	s.Unlock()
+}
+
+// SetShareSyncer is thread-safe way of enabling eventually-consistent counting across nodes.
+// Every node counts locally against its share of the limits, and the shares are rebalanced
+// through syncer at most once per interval, in the background of regular requests.
+// When a sync fails, the last known share is kept. Limiters created with ForRoute use the same syncer.
+func (l *Limiter) SetShareSyncer(syncer ShareSyncer, interval time.Duration) *Limiter {
+	l.share.Lock()
+	l.share.syncer = syncer
+	l.share.syncInterval = interval
+	l.share.syncedAt = time.Time{}
+	l.share.Unlock()
+
+	return l
+}
+
+// GetShare is thread-safe way of getting the share of the limits this node currently uses.
+func (l *Limiter) GetShare() float64 {
+	l.share.Lock()
+	defer l.share.Unlock()
+	return l.share.current()
+}
+
+// applyShare scales opts down to the share of this node.
+func (l *Limiter) applyShare(opts BucketOptions) BucketOptions {
+	share := l.GetShare()
+	if share == 1 {
+		return opts
+	}
+
+	opts.Max *= share
+	opts.Burst = int(math.Max(1, math.Round(float64(opts.Burst)*share)))
+
+	return opts
+}
+
+// maybeSyncShare starts a background sync when the sync interval has elapsed.
+func (l *Limiter) maybeSyncShare() {
+	s := l.share
+
+	s.Lock()
+	if s.syncer == nil || s.syncing || time.Since(s.syncedAt) < s.syncInterval {
+		s.Unlock()
+		return
+	}
+
+	syncer := s.syncer
+	timeout := s.syncInterval
+	usage := s.usage
+
+	s.syncing = true
+	s.usage = 0
+	s.Unlock()
+
+	go l.syncShare(syncer, usage, timeout)
+}
+
+// syncShare fetches a new share and rescales every existing bucket to it.
+func (l *Limiter) syncShare(syncer ShareSyncer, usage float64, timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	share, err := syncer.SyncShare(ctx, usage)
+
+	l.RLock()
+	globalBucket := l.globalBucket
+	l.RUnlock()
+
+	// Buckets are neither created nor rescaled by another sync meanwhile, so none is scaled twice or missed.
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	l.share.Lock()
+	l.share.syncing = false
+	l.share.syncedAt = time.Now()
+
+	if err != nil || share <= 0 || share > 1 {
+		l.share.Unlock()
+		return
+	}
+
+	ratio := share / l.share.current()
+	l.share.share = share
+	l.share.Unlock()
+
+	if ratio == 1 {
+		return
+	}
+
+	buckets := l.tokenBuckets.Values()
+	for _, sustainedBuckets := range l.sustainedBuckets.Values() {
+		buckets = append(buckets, sustainedBuckets...)
+	}
+	if globalBucket != nil {
+		buckets = append(buckets, globalBucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.SetLimit(bucket.Limit() * rate.Limit(ratio))
+		bucket.SetBurst(int(math.Max(1, math.Round(float64(bucket.Burst())*ratio))))
+	}
+}
@@ -0,0 +1,71 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fixedShareSyncer struct {
+	share float64
+	usage chan float64
+}
+
+func (s *fixedShareSyncer) SyncShare(_ context.Context, localUsage float64) (float64, error) {
+	s.usage <- localUsage
+	return s.share, nil
+}
+
+func TestShareSyncer(t *testing.T) {
+	syncer := &fixedShareSyncer{share: 0.5, usage: make(chan float64, 2)}
+	lmt := New(nil).SetMax(4).SetBurst(4).SetShareSyncer(syncer, time.Hour)
+
+	if lmt.GetShare() != 1 {
+		t.Errorf("Share should start at 1. Value: %v", lmt.GetShare())
+	}
+
+	// The first request triggers the initial sync.
+	if lmt.LimitReached("a") {
+		t.Error("First time count should not reached the limit.")
+	}
+
+	if usage := <-syncer.usage; usage != 0 {
+		t.Errorf("No usage should be reported before the first request is counted. Value: %v", usage)
+	}
+
+	for i := 0; i < 100 && lmt.GetShare() != 0.5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lmt.GetShare() != 0.5 {
+		t.Fatalf("Share was not synced. Value: %v", lmt.GetShare())
+	}
+
+	// New buckets only get half of the burst.
+	for i := 0; i < 2; i++ {
+		if lmt.LimitReached("b") {
+			t.Errorf("Request %d should not reached the limit.", i+1)
+		}
+	}
+	if !lmt.LimitReached("b") {
+		t.Error("Third request should reached the limit of this node's share.")
+	}
+}
+
+func TestShareSyncerForRoute(t *testing.T) {
+	syncer := &fixedShareSyncer{share: 0.5, usage: make(chan float64, 2)}
+	lmt := New(nil).SetMax(4).SetBurst(4).SetShareSyncer(syncer, time.Hour)
+	route := lmt.ForRoute("search")
+
+	// A request on the route triggers the sync of l.
+	if route.LimitReached("a") {
+		t.Error("First time count should not reached the limit.")
+	}
+	<-syncer.usage
+
+	for i := 0; i < 100 && lmt.GetShare() != 0.5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lmt.GetShare() != 0.5 || route.GetShare() != 0.5 {
+		t.Fatalf("Share was not synced to both limiters. Values: %v, %v", lmt.GetShare(), route.GetShare())
+	}
+}
@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// defaultLoadSheddingMessage is sent to shed requests when no message is set.
+const defaultLoadSheddingMessage = "Server is overloaded, please try again later."
+
+// heapObjectsMetric is the runtime metric of the bytes of live heap objects, cheap to read unlike runtime.ReadMemStats.
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// loadShedder samples the system load, shared with the limiters created by ForRoute.
+type loadShedder struct {
+	sync.Mutex
+	opts       LoadShedding
+	sampledAt  time.Time
+	overloaded bool
+}
+
+// SetLoadShedding is thread-safe way of rejecting every request with 503 while the process is overloaded,
+// i.e. its goroutines, live heap or CPU utilization exceed the caps of opts, whatever the per-key limits.
+// Handlers can check Overloaded to degrade instead, e.g. skip expensive optional work.
+func (l *Limiter) SetLoadShedding(opts LoadShedding) *Limiter {
+	l.Lock()
+	l.loadShedder = &loadShedder{opts: opts}
+	l.Unlock()
+
+	return l
+}
+
+// GetLoadShedding is thread-safe way of getting the load shedding caps. It returns false when load shedding is off.
+func (l *Limiter) GetLoadShedding() (LoadShedding, bool) {
+	l.RLock()
+	shedder := l.loadShedder
+	l.RUnlock()
+
+	if shedder == nil {
+		return LoadShedding{}, false
+	}
+
+	shedder.Lock()
+	defer shedder.Unlock()
+	return shedder.opts, true
+}
+
+// LoadSheddingMessage returns the message shed requests get.
+func (l *Limiter) LoadSheddingMessage() string {
+	if opts, _ := l.GetLoadShedding(); opts.Message != "" {
+		return opts.Message
+	}
+	return defaultLoadSheddingMessage
+}
+
+// Overloaded reports whether the process exceeds one of the load shedding caps.
+// It returns false when load shedding is off.
+func (l *Limiter) Overloaded() bool {
+	l.RLock()
+	shedder := l.loadShedder
+	l.RUnlock()
+
+	if shedder == nil {
+		return false
+	}
+
+	shedder.Lock()
+	defer shedder.Unlock()
+
+	if now := time.Now(); shedder.sampledAt.IsZero() || now.Sub(shedder.sampledAt) >= shedder.opts.SampleInterval {
+		shedder.overloaded = shedder.opts.exceeded()
+		shedder.sampledAt = now
+	}
+	return shedder.overloaded
+}
+
+// exceeded samples the load and reports whether it exceeds one of the caps.
+func (opts LoadShedding) exceeded() bool {
+	if opts.MaxGoroutines > 0 && runtime.NumGoroutine() > opts.MaxGoroutines {
+		return true
+	}
+
+	if opts.MaxHeapBytes > 0 {
+		sample := []metrics.Sample{{Name: heapObjectsMetric}}
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 && sample[0].Value.Uint64() > opts.MaxHeapBytes {
+			return true
+		}
+	}
+
+	return opts.MaxCPU > 0 && opts.CPUUtilization != nil && opts.CPUUtilization() > opts.MaxCPU
+}
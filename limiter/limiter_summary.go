@@ -0,0 +1,113 @@
+package limiter
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// summaryTrackedKeys is how many rejected keys are counted for Summary, the least recently rejected are forgotten first.
+const summaryTrackedKeys = 1000
+
+// KeyCount is the number of rejections of a key.
+type KeyCount struct {
+	Key     string `json:"key"`
+	Limited uint64 `json:"limited"`
+}
+
+// Summary is a compact view of a limiter, for internal admin pages, see tollbooth.SummaryHandler.
+type Summary struct {
+	Route     string     `json:"route,omitempty"`
+	Max       float64    `json:"max_per_second"`
+	Burst     int        `json:"burst"`
+	Window    float64    `json:"window_seconds"`
+	GlobalMax float64    `json:"global_max,omitempty"`
+	Methods   []string   `json:"methods,omitempty"`
+	Allowed   uint64     `json:"allowed"`
+	Limited   uint64     `json:"limited"`
+	TopKeys   []KeyCount `json:"top_keys"`
+}
+
+// summaryStats counts the decisions of a limiter.
+type summaryStats struct {
+	allowed atomic.Uint64
+	limited atomic.Uint64
+
+	// Guards adding keys, so two first rejections of a key share a counter.
+	keysMu sync.Mutex
+	keys   cache.Cache[string, *atomic.Uint64]
+}
+
+func newSummaryStats() *summaryStats {
+	return &summaryStats{keys: cache.NewCache[string, *atomic.Uint64]().WithMaxKeys(summaryTrackedKeys)}
+}
+
+// CountDecision is thread-safe way of counting a decision of the limiter on key for Summary.
+func (l *Limiter) CountDecision(key string, admitted bool) {
+	if admitted {
+		l.summary.allowed.Add(1)
+		return
+	}
+
+	l.summary.limited.Add(1)
+
+	// Rejections by the global limit belong to no key.
+	if key == "" {
+		return
+	}
+
+	l.summary.keysMu.Lock()
+	count, found := l.summary.keys.Get(key)
+	if !found {
+		count = &atomic.Uint64{}
+		l.summary.keys.Set(key, count, 0)
+	}
+	l.summary.keysMu.Unlock()
+
+	count.Add(1)
+}
+
+// Summary returns the config of the limiter, the number of allowed and limited requests,
+// and the topKeys most limited keys.
+func (l *Limiter) Summary(topKeys int) Summary {
+	l.RLock()
+	window := l.window
+	if window <= 0 {
+		window = time.Second
+	}
+
+	summary := Summary{
+		Route:     l.route,
+		Max:       l.max,
+		Burst:     l.burst,
+		Window:    window.Seconds(),
+		GlobalMax: l.globalMax,
+		Methods:   append([]string(nil), l.methods...),
+		Allowed:   l.summary.allowed.Load(),
+		Limited:   l.summary.limited.Load(),
+		TopKeys:   make([]KeyCount, 0),
+	}
+	keys := l.summary.keys.Keys()
+	l.RUnlock()
+
+	for _, key := range keys {
+		if count, found := l.summary.keys.Peek(key); found {
+			summary.TopKeys = append(summary.TopKeys, KeyCount{Key: key, Limited: count.Load()})
+		}
+	}
+
+	sort.Slice(summary.TopKeys, func(i, j int) bool {
+		if summary.TopKeys[i].Limited != summary.TopKeys[j].Limited {
+			return summary.TopKeys[i].Limited > summary.TopKeys[j].Limited
+		}
+		return summary.TopKeys[i].Key < summary.TopKeys[j].Key
+	})
+
+	if topKeys >= 0 && len(summary.TopKeys) > topKeys {
+		summary.TopKeys = summary.TopKeys[:topKeys]
+	}
+	return summary
+}
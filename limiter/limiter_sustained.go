@@ -0,0 +1,184 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+)
+
+// SetSustainedRate is thread-safe way of adding a long-window limit checked together with max on every key,
+// e.g. SetMax(10) with SetSustainedRate(1000, time.Hour) allows short bursts but not sustained abuse.
+// A request is only admitted when every bucket of its key has a token.
+// Calling it again replaces the previous sustained rate, a max of zero or less removes it.
+func (l *Limiter) SetSustainedRate(max int, window time.Duration) *Limiter {
+	if window <= 0 {
+		window = time.Second
+	}
+
+	l.Lock()
+	if max > 0 {
+		l.sustainedRates = []Rate{{Max: float64(max), Per: window, Burst: max}}
+	} else {
+		l.sustainedRates = nil
+	}
+	l.sustainedBuckets.Purge()
+	l.Unlock()
+
+	return l
+}
+
+// GetSustainedRate is thread-safe way of getting the long-window limit checked together with max.
+// It returns false when no sustained rate is set.
+func (l *Limiter) GetSustainedRate() (Rate, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.sustainedRates) == 0 {
+		return Rate{}, false
+	}
+	return l.sustainedRates[0], true
+}
+
+// SetLimits is thread-safe way of setting several windows at once, e.g.
+// SetLimits(Rate{Max: 10, Per: time.Second, Burst: 10}, Rate{Max: 1000, Per: time.Hour, Burst: 1000}).
+// The shortest window replaces the rate set with SetLimit, the others replace the sustained rates.
+// A request is only admitted when every window of its key has a token, and tokens are taken from all of them or none.
+// It returns ErrInvalidRate when a limit is invalid, see SetLimit.
+func (l *Limiter) SetLimits(limits ...Rate) error {
+	if len(limits) == 0 {
+		return fmt.Errorf("%w: at least one limit is required", ErrInvalidRate)
+	}
+	for _, limit := range limits {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	sorted := append([]Rate(nil), limits...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Per < sorted[j].Per })
+
+	l.Lock()
+	l.max = sorted[0].Max / sorted[0].Per.Seconds()
+	l.burst = sorted[0].Burst
+	l.window = sorted[0].Per
+	l.sustainedRates = sorted[1:]
+	if len(l.sustainedRates) == 0 {
+		l.sustainedRates = nil
+	}
+	l.sustainedBuckets.Purge()
+	l.Unlock()
+
+	return nil
+}
+
+// GetLimits is thread-safe way of getting every window, the shortest first.
+func (l *Limiter) GetLimits() []Rate {
+	l.RLock()
+	defer l.RUnlock()
+
+	window := l.window
+	if window <= 0 {
+		window = time.Second
+	}
+
+	limits := []Rate{{Max: l.max * window.Seconds(), Per: window, Burst: l.burst}}
+	return append(limits, l.sustainedRates...)
+}
+
+// StrictestSustainedLimit returns the sustained rate of key with the fewest tokens left, when it has fewer tokens
+// than the main bucket of key. It returns false when the main bucket is the strictest, or key has no sustained buckets.
+func (l *Limiter) StrictestSustainedLimit(key string) (Rate, bool) {
+	l.RLock()
+	rates := l.sustainedRates
+	l.RUnlock()
+
+	bucket, found := l.tokenBuckets.Peek(key)
+	if !found {
+		return Rate{}, false
+	}
+	sustainedBuckets, _ := l.sustainedBuckets.Peek(key)
+
+	now := time.Now()
+	tokens := bucket.TokensAt(now)
+
+	strictest, found := Rate{}, false
+	for i, sustainedBucket := range sustainedBuckets {
+		if i >= len(rates) {
+			break
+		}
+		if sustainedTokens := sustainedBucket.TokensAt(now); sustainedTokens < tokens {
+			strictest, found, tokens = rates[i], true, sustainedTokens
+		}
+	}
+
+	return strictest, found
+}
+
+// sustainedBucketsFor returns the sustained buckets of key, creating them when missing. It requires that l is locked.
+// They always use sliding expiration of at least their window: a bucket idle for its whole window is full again,
+// so only then it can expire without granting extra requests.
+func (l *Limiter) sustainedBucketsFor(key string, ttl time.Duration) []*rate.Limiter {
+	if len(l.sustainedRates) == 0 {
+		return nil
+	}
+
+	for _, sustainedRate := range l.sustainedRates {
+		if sustainedRate.Per > ttl {
+			ttl = sustainedRate.Per
+		}
+	}
+
+	buckets, found := l.sustainedBuckets.Get(key)
+	if !found {
+		buckets = make([]*rate.Limiter, 0, len(l.sustainedRates))
+		for _, sustainedRate := range l.sustainedRates {
+			opts := l.applyShare(BucketOptions{}.WithRate(sustainedRate))
+			buckets = append(buckets, rate.NewLimiter(rate.Limit(opts.Max), opts.Burst))
+		}
+
+		if !l.sustainedBuckets.Contains(key) {
+			l.memory.add(sustainedBucketsBytes(key, buckets))
+		}
+	}
+
+	l.sustainedBuckets.Set(key, buckets, ttl)
+
+	return buckets
+}
+
+// allowAll takes cost tokens from every bucket, or none of them when any bucket lacks them.
+func allowAll(buckets []*rate.Limiter, cost int) bool {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(buckets))
+
+	allowed := true
+	for _, bucket := range buckets {
+		reservation := bucket.ReserveN(now, tokenCost(cost, bucket.Burst()))
+		reservations = append(reservations, reservation)
+
+		if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+			allowed = false
+			break
+		}
+	}
+
+	if !allowed {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+
+	return allowed
+}
+
+// minTokens returns the lowest number of tokens of buckets at now.
+func minTokens(buckets []*rate.Limiter, now time.Time) float64 {
+	tokens := math.Inf(1)
+	for _, bucket := range buckets {
+		tokens = math.Min(tokens, bucket.TokensAt(now))
+	}
+	return tokens
+}
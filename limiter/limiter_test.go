@@ -1,7 +1,13 @@
 package limiter
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -128,3 +134,916 @@ func TestMuchHigherMaxRequestsWithCustomTokenBucketTTL(t *testing.T) {
 	}
 
 }
+
+func TestTokenBucketSlidingExpiration(t *testing.T) {
+	key := "127.0.0.1|/"
+
+	for _, sliding := range []bool{false, true} {
+		lmt := New(nil).SetMax(1).SetBurst(1).
+			SetTokenBucketExpirationTTL(time.Hour).
+			SetTokenBucketSlidingExpiration(sliding)
+
+		lmt.LimitReached(key)
+		createdExpiration, _ := lmt.tokenBuckets.GetExpiration(key)
+
+		<-time.After(10 * time.Millisecond)
+		lmt.LimitReached(key)
+		accessedExpiration, _ := lmt.tokenBuckets.GetExpiration(key)
+
+		if refreshed := accessedExpiration.After(createdExpiration); refreshed != sliding {
+			t.Errorf("Expiration refreshed should be %v with sliding expiration %v.", sliding, sliding)
+		}
+	}
+}
+
+func TestSustainedRate(t *testing.T) {
+	lmt := New(nil).SetMax(0.01).SetBurst(5).SetSustainedRate(3, time.Hour)
+	key := "127.0.0.1|/"
+
+	for i := 0; i < 3; i++ {
+		if lmt.LimitReached(key) {
+			t.Errorf("Request %d should not reached the limit.", i+1)
+		}
+	}
+
+	if lmt.Tokens(key) != 0 {
+		t.Errorf("Tokens should reflect the sustained bucket. Value: %v", lmt.Tokens(key))
+	}
+
+	// The short window still has tokens, but the sustained one does not.
+	if !lmt.LimitReached(key) {
+		t.Error("Fourth request should reached the sustained limit.")
+	}
+
+	// A rejected request must not consume a token from the short window.
+	lmt.SetSustainedRate(0, 0)
+	for i := 0; i < 2; i++ {
+		if lmt.LimitReached(key) {
+			t.Errorf("Short window should have 2 tokens left, request %d was limited.", i+1)
+		}
+	}
+	if !lmt.LimitReached(key) {
+		t.Error("Short window should be exhausted.")
+	}
+}
+
+func TestForRouteSharesBuckets(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(1)
+	routes := []*Limiter{lmt.ForRoute("search"), lmt.ForRoute("search")}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	start := make(chan struct{})
+
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(route *Limiter) {
+			defer wg.Done()
+			<-start
+			if !route.LimitReached("a") {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}(routes[i%len(routes)])
+	}
+	close(start)
+	wg.Wait()
+
+	if admitted != 1 {
+		t.Errorf("Sibling routes should create a single bucket per key. Admitted: %v", admitted)
+	}
+	if usage := lmt.MemoryUsage(); usage != bucketEntryBytes+1 {
+		t.Errorf("MemoryUsage is incorrect. Value: %v", usage)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	lmt := New(nil).SetMax(1000).SetBurst(1).SetMemoryPressure(3, time.Minute)
+
+	for _, key := range []string{"a", "b", "c"} {
+		lmt.LimitReached(key)
+	}
+
+	if !lmt.UnderMemoryPressure() {
+		t.Error("Limiter should be under memory pressure at the high watermark.")
+	}
+
+	// All buckets are full again, so they are evicted before the new one is created.
+	time.Sleep(10 * time.Millisecond)
+	lmt.LimitReached("d")
+
+	if lmt.GetMemoryPressureEvictions() != 3 || lmt.UnderMemoryPressure() {
+		t.Errorf("Idle buckets should be evicted. Evictions: %v", lmt.GetMemoryPressureEvictions())
+	}
+
+	// Drained buckets are kept, but new ones expire after the pressure TTL.
+	lmt = New(nil).SetMax(0.001).SetBurst(1).SetMemoryPressure(3, time.Minute)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lmt.LimitReached(key)
+	}
+
+	if lmt.GetMemoryPressureEvictions() != 0 {
+		t.Errorf("Drained buckets should not be evicted. Evictions: %v", lmt.GetMemoryPressureEvictions())
+	}
+
+	if expiration, _ := lmt.tokenBuckets.GetExpiration("d"); time.Until(expiration) > time.Minute {
+		t.Errorf("New bucket should expire after the pressure TTL. Expiration: %v", expiration)
+	}
+
+	if expiration, _ := lmt.tokenBuckets.GetExpiration("a"); time.Until(expiration) <= time.Minute {
+		t.Errorf("Bucket created before the pressure should keep its TTL. Expiration: %v", expiration)
+	}
+}
+
+func TestMemoryAlarm(t *testing.T) {
+	alarms := make(chan int64, 10)
+
+	lmt := New(nil).SetMax(1).SetBurst(1).
+		SetMemoryAlarm(func(_, threshold int64) { alarms <- threshold }, 2*bucketEntryBytes, 4*bucketEntryBytes)
+
+	for _, key := range []string{"a", "b", "c"} {
+		lmt.LimitReached(key)
+	}
+
+	if usage := lmt.MemoryUsage(); usage != 3*(bucketEntryBytes+1) {
+		t.Errorf("MemoryUsage is incorrect. Value: %v", usage)
+	}
+
+	select {
+	case threshold := <-alarms:
+		if threshold != 2*bucketEntryBytes {
+			t.Errorf("Wrong threshold crossed. Value: %v", threshold)
+		}
+	case <-time.After(time.Second):
+		t.Error("Crossing a threshold should fire the alarm.")
+	}
+
+	// Buckets seen again do not add to the usage.
+	lmt.LimitReached("a")
+
+	lmt.tokenBuckets.Invalidate("a")
+	if usage := lmt.MemoryUsage(); usage != 2*(bucketEntryBytes+1) {
+		t.Errorf("Evicted buckets should be released. Value: %v", usage)
+	}
+
+	select {
+	case threshold := <-alarms:
+		t.Errorf("No other threshold should be crossed. Value: %v", threshold)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan UsageEvent, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event UsageEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Webhook body should be JSON. Error: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	WebhookNotifier(server.URL, nil)(UsageEvent{Key: "127.0.0.1|/", Threshold: 0.8, Usage: 0.9})
+
+	if event := <-received; event.Key != "127.0.0.1|/" || event.Threshold != 0.8 {
+		t.Errorf("Webhook event is incorrect. Value: %+v", event)
+	}
+}
+
+func TestInspectKey(t *testing.T) {
+	lmt := New(&ExpirableOptions{DefaultExpirationTTL: time.Hour}).SetMax(0.001).SetBurst(3)
+
+	if _, found := lmt.InspectKey("127.0.0.1|/"); found {
+		t.Error("Unknown keys should not be found.")
+	}
+
+	lmt.LimitReached("127.0.0.1|/")
+
+	state, found := lmt.InspectKey("127.0.0.1|/")
+	if !found {
+		t.Fatal("Bucket should be found.")
+	}
+
+	if state.Tokens < 1.9 || state.Tokens > 2.1 || state.Burst != 3 || state.Max != 0.001 {
+		t.Errorf("Bucket state is incorrect. Value: %+v", state)
+	}
+
+	if time.Since(state.LastUpdate) > time.Second || state.TTL <= 59*time.Minute || state.TTL > time.Hour {
+		t.Errorf("Bucket state is incorrect. Value: %+v", state)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(3)
+
+	if tokens, reset := lmt.Remaining("127.0.0.1|/"); tokens != 3 || time.Until(reset) > 0 {
+		t.Errorf("Missing bucket should be full. Tokens: %v, Reset: %v", tokens, reset)
+	}
+
+	lmt.LimitReached("127.0.0.1|/")
+	lmt.LimitReached("127.0.0.1|/")
+
+	tokens, reset := lmt.Remaining("127.0.0.1|/")
+	if tokens < 0.9 || tokens > 1.1 {
+		t.Errorf("Remaining tokens are incorrect. Value: %v", tokens)
+	}
+
+	if until := time.Until(reset); until <= time.Second || until > 2*time.Second {
+		t.Errorf("Two missing tokens should be back within two seconds. Reset: %v", until)
+	}
+
+	// Remaining does not take a token.
+	if again, _ := lmt.Remaining("127.0.0.1|/"); again < tokens {
+		t.Errorf("Remaining should not take a token. Value: %v", again)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	lmt := New(nil).SetMax(1)
+
+	for _, key := range []string{"tenant-b|10.0.0.2", "tenant-a|10.0.0.2", "tenant-a|10.0.0.1", "tenant-c|10.0.0.1"} {
+		lmt.LimitReached(key)
+	}
+
+	if keys := lmt.Keys("tenant-a|", 0); fmt.Sprint(keys) != "[tenant-a|10.0.0.1 tenant-a|10.0.0.2]" {
+		t.Errorf("Keys are incorrect. Value: %v", keys)
+	}
+
+	if keys := lmt.Keys("", 2); fmt.Sprint(keys) != "[tenant-a|10.0.0.1 tenant-a|10.0.0.2]" {
+		t.Errorf("Keys should be limited. Value: %v", keys)
+	}
+
+	if keys := lmt.Keys("tenant-d|", 0); len(keys) != 0 {
+		t.Errorf("Keys should be empty. Value: %v", keys)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(1)
+
+	if lmt.Bucket("127.0.0.1|/") != nil {
+		t.Error("Missing bucket should be nil.")
+	}
+
+	lmt.LimitReached("127.0.0.1|/")
+
+	bucket := lmt.Bucket("127.0.0.1|/")
+	if bucket == nil || bucket.Limit() != 1 || bucket.Burst() != 1 {
+		t.Fatalf("Bucket is incorrect. Value: %v", bucket)
+	}
+
+	now := time.Now()
+	reservation := bucket.ReserveN(now, 1)
+	if !reservation.OK() || reservation.DelayFrom(now) <= 0 {
+		t.Error("Drained bucket should make the reservation wait.")
+	}
+	reservation.CancelAt(now)
+
+	bucket.SetLimit(1000)
+	time.Sleep(5 * time.Millisecond)
+
+	if lmt.LimitReached("127.0.0.1|/") {
+		t.Error("Limit set on the bucket should apply to the key.")
+	}
+}
+
+func TestScheduleContains(t *testing.T) {
+	night := Schedule{Name: "night", Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC}
+
+	for at, expected := range map[time.Time]bool{
+		time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC): true,  // Friday night.
+		time.Date(2024, 3, 2, 5, 0, 0, 0, time.UTC):  true,  // Saturday morning, the window started on Friday.
+		time.Date(2024, 3, 2, 23, 0, 0, 0, time.UTC): false, // Saturday night.
+		time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC): false, // Friday noon.
+	} {
+		if night.Contains(at) != expected {
+			t.Errorf("Contains(%v) should be %v.", at, expected)
+		}
+	}
+}
+
+func TestScheduledLimit(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	lmt := New(nil).SetClock(func() time.Time { return now })
+
+	if err := lmt.SetScheduledLimit(Schedule{Name: "business-hours"}, Rate{Max: 1, Per: time.Second, Burst: 1}); err == nil {
+		t.Error("Schedules without duration should be rejected.")
+	}
+
+	if err := lmt.SetScheduledLimit(
+		Schedule{Name: "business-hours", Start: 9 * time.Hour, End: 17 * time.Hour, Location: time.UTC},
+		Rate{Max: 10, Per: time.Second, Burst: 10},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if name, rate, found := lmt.ScheduledLimit(); !found || name != "business-hours" || rate.Max != 10 {
+		t.Errorf("Business hours should be on at 10:00. Got: %v %v %v", name, rate, found)
+	}
+
+	now = now.Add(8 * time.Hour)
+	if _, _, found := lmt.ScheduledLimit(); found {
+		t.Error("Business hours should be off at 18:00.")
+	}
+}
+
+func TestCanaryLimitForKey(t *testing.T) {
+	lmt := New(nil)
+
+	if err := lmt.SetCanaryLimit(Rate{Max: 1, Per: time.Second, Burst: 1}, 101); err == nil {
+		t.Error("Percents above 100 should be rejected.")
+	}
+
+	if _, found := lmt.CanaryLimitForKey("127.0.0.1|/|"); found {
+		t.Error("No key should be canaried without canary.")
+	}
+
+	if err := lmt.SetCanaryLimit(Rate{Max: 1, Per: time.Second, Burst: 1}, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if rate, found := lmt.CanaryLimitForKey("127.0.0.1|/|"); !found || rate.Max != 1 {
+		t.Errorf("Every key should be canaried at 100%%. Got: %v %v", rate, found)
+	}
+}
+
+func TestBurstLoan(t *testing.T) {
+	lmt := New(nil).SetMax(100).SetBurst(10).SetBurstLoan(10, 0.5)
+
+	admitted := 0
+	for i := 0; i < 30; i++ {
+		if !lmt.LimitReached("127.0.0.1|/|") {
+			admitted++
+		}
+	}
+
+	// The burst of 10, then 10 borrowed tokens.
+	if admitted != 20 {
+		t.Errorf("Key should borrow up to the debt cap. Admitted: %v", admitted)
+	}
+
+	if state, _ := lmt.InspectKey("127.0.0.1|/|"); state.Tokens > -9 {
+		t.Errorf("Key should be in debt. Tokens: %v", state.Tokens)
+	}
+
+	// While paying back, the key gets half of its rate: one request now, then nothing for 20ms.
+	time.Sleep(30 * time.Millisecond)
+	if lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Key should keep part of its rate while paying back.")
+	}
+	if !lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Key should not get its full rate while paying back.")
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	var log strings.Builder
+	lmt := New(nil).SetDecisionLog(&log, 1)
+
+	lmt.LogDecision(DecisionEvent{Key: "127.0.0.1|/|", KeyClass: KeyClassIP, Max: 1, Burst: 1, Window: 1, Admitted: true, RequestID: "abc"})
+	lmt.LogDecision(DecisionEvent{Key: "127.0.0.1|/|", KeyClass: KeyClassIP, Max: 1, Burst: 1, Window: 1})
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Every decision should be written on its own line. Log: %v", log.String())
+	}
+
+	var event DecisionEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if !event.Admitted || event.KeyClass != KeyClassIP || event.RequestID != "abc" || event.Time.IsZero() {
+		t.Errorf("Decision is not written correctly. Got: %+v", event)
+	}
+
+	log.Reset()
+	lmt.SetDecisionLog(&log, 0)
+	lmt.LogDecision(DecisionEvent{Key: "127.0.0.1|/|"})
+	if log.Len() != 0 {
+		t.Errorf("No decision should be sampled at 0. Log: %v", log.String())
+	}
+}
+
+func TestWaitTurnPriority(t *testing.T) {
+	lmt := New(nil).SetWaitMode(time.Second, 10)
+
+	var mu sync.Mutex
+	var order []int
+	open := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, priority := range []int{1, 5, 3} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			err := lmt.WaitTurn(context.Background(), "key", priority, time.Millisecond, func() bool {
+				select {
+				case <-open:
+				default:
+					return false
+				}
+				mu.Lock()
+				order = append(order, priority)
+				mu.Unlock()
+				return true
+			})
+			if err != nil {
+				t.Errorf("Waiting requests should be released. Got: %v", err)
+			}
+		}(priority)
+	}
+
+	for lmt.WaitQueueLen() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(open)
+	wg.Wait()
+
+	if fmt.Sprint(order) != "[5 3 1]" {
+		t.Errorf("Waiting requests should be released by priority. Order: %v", order)
+	}
+
+	lmt.SetWaitMode(10*time.Millisecond, 0)
+	if err := lmt.WaitTurn(context.Background(), "key", 0, time.Millisecond, func() bool { return true }); err != ErrWaitQueueFull {
+		t.Errorf("Requests should not wait when the queue is full. Got: %v", err)
+	}
+
+	lmt.SetWaitMode(10*time.Millisecond, 1)
+	if err := lmt.WaitTurn(context.Background(), "key", 0, time.Millisecond, func() bool { return false }); err != context.DeadlineExceeded {
+		t.Errorf("Requests should stop waiting after the maximum wait. Got: %v", err)
+	}
+}
+
+func TestKeyAdmissionFunc(t *testing.T) {
+	lmt := New(nil).SetMax(100).SetBurst(100)
+
+	lmt.LimitReached("known")
+
+	checked := 0
+	lmt.SetKeyAdmissionFunc(func(key string) bool {
+		checked++
+		return !strings.HasPrefix(key, "spam")
+	})
+
+	if !lmt.LimitReached("spam-1") {
+		t.Error("Keys refused by the admission function should be rejected.")
+	}
+	if _, found := lmt.InspectKey("spam-1"); found {
+		t.Error("Keys refused by the admission function should not get a bucket.")
+	}
+
+	if lmt.LimitReached("new") || lmt.LimitReached("new") {
+		t.Error("Keys admitted by the admission function should be limited as usual.")
+	}
+	if lmt.LimitReached("known") {
+		t.Error("Keys with a bucket should be limited as usual.")
+	}
+	if checked != 2 {
+		t.Errorf("Only new keys should be checked. Checked: %v", checked)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	lmt := New(nil).SetMax(100).SetBurst(10).SetBurstLoan(10, 0.5).SetLeakyBucket(true)
+
+	if !lmt.GetLeakyBucket() {
+		t.Fatal("LeakyBucket field is incorrect.")
+	}
+
+	if lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("The first request should be admitted.")
+	}
+	if !lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Requests should not burst, nor borrow, with a constant rate.")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Requests should be admitted again after 1/max seconds.")
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	lmt := New(nil).SetMax(100).SetBurst(10).SetBurstLoan(10, 0.5).SetMinInterval(20 * time.Millisecond)
+
+	if lmt.GetMinInterval() != 20*time.Millisecond {
+		t.Fatal("MinInterval field is incorrect.")
+	}
+
+	if lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("The first request should be admitted.")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Requests within the minimum interval should be rejected, regardless of the rate.")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if lmt.LimitReached("127.0.0.1|/|") {
+		t.Error("Requests should be admitted again after the minimum interval.")
+	}
+}
+
+func TestCostFunc(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(10)
+
+	if lmt.CostForRequest(httptest.NewRequest(http.MethodGet, "/", nil)) != 1 {
+		t.Error("Requests should take one token without a cost function.")
+	}
+
+	lmt.SetCostFunc(func(r *http.Request) int {
+		if r.URL.Path == "/export" {
+			return 4
+		}
+		return 0
+	})
+	if lmt.CostForRequest(httptest.NewRequest(http.MethodGet, "/export", nil)) != 4 || lmt.CostForRequest(httptest.NewRequest(http.MethodGet, "/", nil)) != 1 {
+		t.Error("Costs should come from the cost function, and be at least one.")
+	}
+
+	opts := BucketOptions{Max: 1, Burst: 10, Cost: 4}
+	if lmt.LimitReachedWithOptions("127.0.0.1|/export|", opts) || lmt.LimitReachedWithOptions("127.0.0.1|/export|", opts) {
+		t.Error("Costly requests within the burst should be admitted.")
+	}
+	if !lmt.LimitReachedWithOptions("127.0.0.1|/export|", opts) {
+		t.Error("Costly requests should be rejected once fewer tokens than their cost are left.")
+	}
+	if lmt.Tokens("127.0.0.1|/export|") != 2 {
+		t.Errorf("Rejected requests should not take tokens. Tokens: %v", lmt.Tokens("127.0.0.1|/export|"))
+	}
+
+	if lmt.LimitReachedWithOptions("127.0.0.1|/huge|", BucketOptions{Max: 1, Burst: 10, Cost: 50}) {
+		t.Error("Costs above the burst should take the whole burst instead of never being admitted.")
+	}
+}
+
+func TestContentLengthCost(t *testing.T) {
+	cost := ContentLengthCost(1024, 8, 4)
+
+	testCases := map[int64]int{0: 1, 1: 1, 1024: 1, 1025: 2, 5000: 5, 1 << 20: 8, -1: 4}
+	for contentLength, expected := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		req.ContentLength = contentLength
+
+		if got := cost(req); got != expected {
+			t.Errorf("A body of %v bytes should cost %v tokens. Got: %v", contentLength, expected, got)
+		}
+	}
+}
+
+func TestMaxFunc(t *testing.T) {
+	calls := 0
+	plan := 10.0
+	lmt := New(nil).SetMax(1).SetBurst(2).SetMaxFunc(func(key string, r *http.Request) float64 {
+		calls++
+		return plan
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	opts := BucketOptions{Max: 1, Burst: 2}
+
+	premium := lmt.MaxOptionsForKey("premium|/|", req, opts)
+	if premium.Max != 10 || premium.Burst != 20 {
+		t.Errorf("The max should come from the function, and the burst be scaled alike. Got: %+v", premium)
+	}
+	lmt.LimitReachedWithOptions("premium|/|", premium)
+
+	lmt.MaxOptionsForKey("premium|/|", req, opts)
+	if calls != 1 {
+		t.Errorf("The max of a key should be resolved once. Calls: %v", calls)
+	}
+
+	plan = 5
+	lmt.RefreshMax("premium|/|")
+	if refreshed := lmt.MaxOptionsForKey("premium|/|", req, opts); refreshed.Max != 5 || calls != 2 {
+		t.Errorf("The max should be resolved again after RefreshMax. Got: %+v", refreshed)
+	}
+	if bucket := lmt.Bucket("premium|/|"); bucket.Limit() != 5 || bucket.Burst() != 10 {
+		t.Errorf("The refreshed max should apply to the existing bucket. Limit: %v, burst: %v", bucket.Limit(), bucket.Burst())
+	}
+
+	plan = 0
+	if basic := lmt.MaxOptionsForKey("basic|/|", req, opts); basic != opts {
+		t.Errorf("Keys without a max of their own should keep the max of the limiter. Got: %+v", basic)
+	}
+}
+
+func TestBurstFunc(t *testing.T) {
+	calls := 0
+	lmt := New(nil).SetMax(1).SetBurst(1).SetBurstFunc(func(key string, r *http.Request) int {
+		calls++
+		if r.Header.Get("Authorization") != "" {
+			return 5
+		}
+		return 0
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	opts := BucketOptions{Max: 1, Burst: 1}
+
+	if anonymous := lmt.BurstOptionsForKey("anonymous|/|", req, opts); anonymous.Burst != 1 {
+		t.Errorf("Keys without a burst of their own should keep the burst of the limiter. Burst: %v", anonymous.Burst)
+	}
+
+	req.Header.Set("Authorization", "Bearer token")
+	authenticated := lmt.BurstOptionsForKey("user|/|", req, opts)
+	if authenticated.Burst != 5 {
+		t.Fatalf("The burst should come from the function. Burst: %v", authenticated.Burst)
+	}
+
+	lmt.LimitReachedWithOptions("user|/|", authenticated)
+	if lmt.Bucket("user|/|").Burst() != 5 {
+		t.Errorf("The bucket should be created with the burst of the key. Burst: %v", lmt.Bucket("user|/|").Burst())
+	}
+
+	calls = 0
+	if existing := lmt.BurstOptionsForKey("user|/|", httptest.NewRequest(http.MethodGet, "/", nil), opts); existing.Burst != 5 || calls != 0 {
+		t.Errorf("Existing buckets should keep their burst. Burst: %v, calls: %v", existing.Burst, calls)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(3)
+
+	lmt.Refund("127.0.0.1|/|", 1)
+	if lmt.Bucket("127.0.0.1|/|") != nil {
+		t.Error("Refunds should not create buckets.")
+	}
+
+	opts := BucketOptions{Max: 1, Burst: 3, Cost: 3}
+	if lmt.LimitReachedWithOptions("127.0.0.1|/|", opts) {
+		t.Fatal("The first request should be admitted.")
+	}
+
+	lmt.Refund("127.0.0.1|/|", 2)
+	if tokens := lmt.Tokens("127.0.0.1|/|"); tokens != 2 {
+		t.Errorf("Refunded tokens should be given back. Tokens: %v", tokens)
+	}
+
+	lmt.Refund("127.0.0.1|/|", 10)
+	if tokens := lmt.Tokens("127.0.0.1|/|"); tokens != 3 {
+		t.Errorf("Refunds should not exceed the burst. Tokens: %v", tokens)
+	}
+}
+
+func TestCountStatuses(t *testing.T) {
+	lmt := New(nil).SetCountResponse(CountStatuses(http.StatusUnauthorized, http.StatusForbidden))
+
+	countResponse := lmt.GetCountResponse()
+	if countResponse == nil {
+		t.Fatal("CountResponse field is incorrect.")
+	}
+	if !countResponse(http.StatusUnauthorized) || !countResponse(http.StatusForbidden) || countResponse(http.StatusOK) {
+		t.Error("Only the given status codes should count.")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	cl := NewConcurrencyLimiter(3, 2)
+
+	if !cl.Acquire("a") || !cl.Acquire("a") {
+		t.Fatal("Requests within the caps should get a slot.")
+	}
+	if cl.Acquire("a") {
+		t.Error("Requests above the cap of their key should not get a slot.")
+	}
+	if !cl.Acquire("b") {
+		t.Error("Requests of other keys should get a slot.")
+	}
+	if cl.Acquire("c") {
+		t.Error("Requests above the total cap should not get a slot.")
+	}
+
+	cl.Release("a")
+	cl.Release("unknown")
+	if cl.InFlight() != 2 || cl.InFlightForKey("a") != 1 {
+		t.Errorf("Released slots should be free again. In flight: %v, for a: %v", cl.InFlight(), cl.InFlightForKey("a"))
+	}
+	if !cl.Acquire("c") {
+		t.Error("Requests should get a released slot.")
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	lmt := New(nil).SetMax(100).SetBurst(10)
+
+	if err := lmt.SetAdaptive(AdaptiveOptions{Min: 10, Increase: 10, Decrease: 0.5, Interval: time.Second}); err != ErrInvalidAdaptive {
+		t.Errorf("Options without threshold should be rejected. Got: %v", err)
+	}
+	if err := lmt.SetAdaptive(AdaptiveOptions{
+		Min: 10, Increase: 10, Decrease: 0.5, ErrorRateThreshold: 0.5, Interval: time.Nanosecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	lmt.LimitReached("127.0.0.1|/|")
+
+	for _, want := range []float64{50, 25, 12.5, 10} {
+		time.Sleep(time.Millisecond)
+		lmt.ObserveResponse(time.Millisecond, true)
+		if lmt.AdaptiveMax() != want {
+			t.Errorf("Failures should cut the max multiplicatively. Got: %v, want: %v", lmt.AdaptiveMax(), want)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	lmt.ObserveResponse(time.Millisecond, false)
+	if lmt.AdaptiveMax() != 20 {
+		t.Errorf("Healthy responses should raise the max additively. Got: %v", lmt.AdaptiveMax())
+	}
+
+	// Buckets are rescaled in the background.
+	for i := 0; i < 100; i++ {
+		if state, _ := lmt.InspectKey("127.0.0.1|/|"); state.Max == 20 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state, _ := lmt.InspectKey("127.0.0.1|/|"); state.Max != 20 {
+		t.Errorf("Existing buckets should be rescaled to the effective max. Got: %v", state.Max)
+	}
+
+	lmt.LimitReached("127.0.0.2|/|")
+	if state, _ := lmt.InspectKey("127.0.0.2|/|"); state.Max != 20 {
+		t.Errorf("New buckets should use the effective max. Got: %v", state.Max)
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	lmt := New(nil)
+	if lmt.Overloaded() {
+		t.Error("Limiters without load shedding should never be overloaded.")
+	}
+
+	lmt.SetLoadShedding(LoadShedding{MaxGoroutines: 1, SampleInterval: time.Hour})
+	if !lmt.Overloaded() {
+		t.Error("Processes above the goroutine cap should be overloaded.")
+	}
+
+	lmt.SetLoadShedding(LoadShedding{MaxHeapBytes: 1 << 50})
+	if lmt.Overloaded() {
+		t.Error("Processes below the heap cap should not be overloaded.")
+	}
+
+	calls := 0
+	lmt.SetLoadShedding(LoadShedding{MaxCPU: 0.8, CPUUtilization: func() float64 { calls++; return 0.9 }, SampleInterval: time.Hour})
+	lmt.Overloaded()
+	if !lmt.Overloaded() || calls != 1 {
+		t.Errorf("The load should be sampled once per interval. Calls: %v", calls)
+	}
+}
+
+func TestRejectionBody(t *testing.T) {
+	lmt := New(nil)
+
+	body := lmt.RejectionBody("You have reached maximum request limit.")
+	if string(body) != "You have reached maximum request limit." {
+		t.Errorf("Body should hold the message. Got: %s", body)
+	}
+	if &lmt.RejectionBody("You have reached maximum request limit.")[0] != &body[0] {
+		t.Error("Bodies should be reused across rejections.")
+	}
+	if string(lmt.ForRoute("search").RejectionBody("Slow down.")) != "Slow down." {
+		t.Error("Changed messages should get their own body.")
+	}
+}
+
+func TestRejectionHeader(t *testing.T) {
+	lmt := New(nil)
+	info := Info{Limit: 60, Remaining: 3, Window: time.Minute}
+
+	header := lmt.RejectionHeader(info)
+	if header.Get("RateLimit-Policy") != "60;w=60" || header.Get("RateLimit-Reset") != "60" {
+		t.Errorf("Header should describe the limit. Got: %v", header)
+	}
+	if header.Get("RateLimit-Remaining") != "" || header.Get("Retry-After") != "" {
+		t.Errorf("Header should leave out the values of the request. Got: %v", header)
+	}
+	if &lmt.ForRoute("search").RejectionHeader(Info{Limit: 60, Window: time.Minute})["Ratelimit-Policy"][0] != &header["Ratelimit-Policy"][0] {
+		t.Error("Headers should be reused across rejections under the same limit.")
+	}
+	if header := lmt.RejectionHeader(Info{Limit: 10}); header.Get("RateLimit-Policy") != "10;w=1" {
+		t.Errorf("Changed limits should get their own header. Got: %v", header)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	lmt := New(nil).SetClock(func() time.Time { return now })
+
+	if err := lmt.SetQuota(Quota{Allowance: 2, Period: "weekly"}); err != ErrInvalidQuota {
+		t.Errorf("Unknown periods should be rejected. Got: %v", err)
+	}
+	if err := lmt.SetQuota(Quota{Allowance: 2, Period: QuotaMonthly}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{false, false, true} {
+		usage, exceeded, err := lmt.ConsumeQuota(context.Background(), "alice", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceeded != expected {
+			t.Errorf("Request %v should exceed the quota: %v. Usage: %+v", i, expected, usage)
+		}
+		if !usage.ResetAt.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Monthly quotas should reset on the first of the month. Reset: %v", usage.ResetAt)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	if usage, exceeded, _ := lmt.ConsumeQuota(context.Background(), "alice", 1); exceeded || usage.Remaining != 1 {
+		t.Errorf("Quotas should reset with the next period. Usage: %+v", usage)
+	}
+
+	if message, statusCode := lmt.GetQuotaExhaustedResponse(); message != "You have exhausted your quota." || statusCode != 429 {
+		t.Errorf("Quota exhausted response defaults are incorrect. Got: %v %v", message, statusCode)
+	}
+}
+
+func TestQuotaUsageImportExport(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	lmt := New(nil).SetClock(func() time.Time { return now })
+
+	if err := lmt.ExportUsage(&strings.Builder{}); err != ErrQuotaUsageNotSupported {
+		t.Errorf("Exporting usage without a quota should fail. Got: %v", err)
+	}
+	if err := lmt.SetQuota(Quota{Allowance: 10, Period: QuotaMonthly}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lmt.ImportUsage(strings.NewReader(`[{"key": "alice", "period_start": "2024-01-01T00:00:00Z", "used": 9}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lmt.ImportUsage(strings.NewReader("key,period_start,used\nbob,2024-01-01T00:00:00Z,4\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage, exceeded, _ := lmt.ConsumeQuota(context.Background(), "alice", 1); exceeded || usage.Remaining != 0 {
+		t.Errorf("Imported usage should count against the quota. Usage: %+v", usage)
+	}
+
+	var exported strings.Builder
+	if err := lmt.ExportUsage(&exported); err != nil {
+		t.Fatal(err)
+	}
+	expected := "key,period_start,used\nalice,2024-01-01T00:00:00Z,10\nbob,2024-01-01T00:00:00Z,4\n"
+	if exported.String() != expected {
+		t.Errorf("Exported usage is incorrect. Got: %q", exported.String())
+	}
+
+	if err := lmt.ImportUsage(strings.NewReader("alice,yesterday,1\n")); err == nil {
+		t.Error("Malformed rows should be rejected.")
+	}
+
+	var exportedJSON strings.Builder
+	if err := lmt.ExportUsageJSON(&exportedJSON); err != nil {
+		t.Fatal(err)
+	}
+	expectedJSON := `[{"key":"alice","period_start":"2024-01-01T00:00:00Z","used":10},{"key":"bob","period_start":"2024-01-01T00:00:00Z","used":4}]` + "\n"
+	if exportedJSON.String() != expectedJSON {
+		t.Errorf("Exported JSON usage is incorrect. Got: %q", exportedJSON.String())
+	}
+
+	// Exported JSON reads back into a fresh limiter.
+	restored := New(nil).SetClock(func() time.Time { return now })
+	if err := restored.SetQuota(Quota{Allowance: 10, Period: QuotaMonthly}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ImportUsage(strings.NewReader(exportedJSON.String())); err != nil {
+		t.Fatal(err)
+	}
+	var roundTrip strings.Builder
+	if err := restored.ExportUsageJSON(&roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	if roundTrip.String() != expectedJSON {
+		t.Errorf("JSON usage should survive a round trip. Got: %q", roundTrip.String())
+	}
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	store := NewMemoryQuotaStore(2)
+	period := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, key := range []string{"alice", "bob", "alice", "carol"} {
+		if _, err := store.Increment(context.Background(), key, period, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if store.usage.Len() != 2 {
+		t.Errorf("Store should track at most 2 keys. Tracked: %v", store.usage.Len())
+	}
+	if used, _ := store.Increment(context.Background(), "alice", period, 1); used != 3 {
+		t.Errorf("Recently used keys should be kept. Used: %v", used)
+	}
+	if used, _ := store.Increment(context.Background(), "bob", period, 1); used != 1 {
+		t.Errorf("The least recently used key should be forgotten. Used: %v", used)
+	}
+}
@@ -0,0 +1,114 @@
+package limiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// UsageEvent is passed to the usage notifier when a key used up a threshold of its quota, or of its bucket
+// when no quota is set. For a quota, Tokens and Burst are the requests left and the allowance of the period.
+type UsageEvent struct {
+	Key       string    `json:"key"`
+	Threshold float64   `json:"threshold"`
+	Usage     float64   `json:"usage"`
+	Tokens    int       `json:"tokens"`
+	Burst     int       `json:"burst"`
+	Quota     bool      `json:"quota,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// SetUsageNotifier is thread-safe way of setting a function called when a key used up one of thresholds,
+// e.g. 0.8 and 1 to warn users before they are cut off. Usage is measured against the quota when one is set
+// with SetQuota, otherwise against the burst of the bucket of the key. It is called in its own goroutine,
+// at most once per debounce interval for every key and threshold. See WebhookNotifier to call a webhook.
+func (l *Limiter) SetUsageNotifier(fn func(UsageEvent), debounce time.Duration, thresholds ...float64) *Limiter {
+	sorted := append([]float64(nil), thresholds...)
+	sort.Float64s(sorted)
+
+	l.Lock()
+	l.usageNotifier = fn
+	l.usageThresholds = sorted
+	l.usageNotified = cache.NewCache[string, bool]().WithTTL(debounce)
+	l.Unlock()
+
+	return l
+}
+
+// ExecOnUsage is thread-safe way of executing the usage notifier for the highest threshold used up by key,
+// given the tokens left in a bucket of burst tokens. It does nothing when a quota is set, see ExecOnQuotaUsage.
+func (l *Limiter) ExecOnUsage(key string, tokens, burst int, requestID string) {
+	if _, found := l.GetQuota(); found {
+		return
+	}
+
+	l.execOnUsage(UsageEvent{Key: key, Tokens: tokens, Burst: burst, RequestID: requestID})
+}
+
+// ExecOnQuotaUsage is thread-safe way of executing the usage notifier for the highest threshold of its quota
+// used up by key, given the usage returned by ConsumeQuota.
+func (l *Limiter) ExecOnQuotaUsage(key string, usage QuotaUsage, requestID string) {
+	l.execOnUsage(UsageEvent{Key: key, Tokens: int(usage.Remaining), Burst: int(usage.Allowance), Quota: true, RequestID: requestID})
+}
+
+// execOnUsage executes the usage notifier for the highest threshold used up by event.
+func (l *Limiter) execOnUsage(event UsageEvent) {
+	l.RLock()
+	fn, thresholds, notified := l.usageNotifier, l.usageThresholds, l.usageNotified
+	l.RUnlock()
+
+	if fn == nil || event.Burst <= 0 {
+		return
+	}
+
+	event.Usage = float64(event.Burst-event.Tokens) / float64(event.Burst)
+
+	crossed := sort.Search(len(thresholds), func(i int) bool { return thresholds[i] > event.Usage })
+	if crossed == 0 {
+		return
+	}
+	event.Threshold = thresholds[crossed-1]
+
+	noticeKey := fmt.Sprintf("%s|%v", event.Key, event.Threshold)
+
+	l.usageMu.Lock()
+	_, found := notified.Get(noticeKey)
+	if !found {
+		notified.Set(noticeKey, true, 0)
+	}
+	l.usageMu.Unlock()
+
+	if found {
+		return
+	}
+
+	event.Time = time.Now()
+	go fn(event)
+}
+
+// WebhookNotifier returns a usage notifier posting every event as JSON to url.
+// Delivery is best effort: failed requests are not retried.
+func WebhookNotifier(url string, client *http.Client) func(UsageEvent) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return func(event UsageEvent) {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+	}
+}
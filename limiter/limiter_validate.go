@@ -0,0 +1,79 @@
+package limiter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidConfig is returned by Validate when the limiter is misconfigured.
+var ErrInvalidConfig = errors.New("invalid limiter config")
+
+// ipLookupNames are the IP lookup names understood by tollbooth, besides LookupHeader.
+var ipLookupNames = []LookupKind{LookupRemoteAddr, LookupXFF, LookupXRealIP, LookupCFConnectingIP}
+
+// Validate detects misconfigurations which would silently limit nothing, or everything,
+// so that bad configs can fail fast at boot. It returns ErrInvalidConfig listing every problem found.
+func (l *Limiter) Validate() error {
+	l.RLock()
+	defer l.RUnlock()
+
+	var problems []string
+
+	switch {
+	case l.max <= 0 && l.burst > 0:
+		problems = append(problems, fmt.Sprintf("max is %v with a burst of %v, buckets are never refilled", l.max, l.burst))
+	case l.max > 0 && l.burst < 1:
+		problems = append(problems, fmt.Sprintf("burst is %v with a max of %v, every request is rejected", l.burst, l.max))
+	}
+
+	if problem := l.explicitIPLookup.problem(); problem != "" {
+		// Only requests without a mesh identity fall back to the IP lookup.
+		if l.meshIdentityHeader != "" {
+			problem = fmt.Sprintf("requests without the %s header use the IP lookup: %s", l.meshIdentityHeader, problem)
+		}
+		problems = append(problems, problem)
+	}
+
+	if len(l.headers) > 0 && len(l.methods) == 0 {
+		problems = append(problems, "headers are set but methods are empty, requests of every method are limited by header")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Validate returns ErrInvalidConfig when the lookup cannot pick an IP address, e.g. because of a typo in Name.
+func (lookup IPLookup) Validate() error {
+	if problem := lookup.problem(); problem != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, problem)
+	}
+	return nil
+}
+
+// problem returns why the lookup cannot pick an IP address, or empty string.
+func (lookup IPLookup) problem() string {
+	switch {
+	case lookup.Name == "":
+		return "IP lookup is not set, requests are never limited"
+	case lookup.Name == LookupHeader(""):
+		return "IP lookup header is empty, requests are never limited"
+	case strings.HasPrefix(string(lookup.Name), headerLookupPrefix):
+		return ""
+	}
+
+	names := make([]string, 0, len(ipLookupNames))
+	for _, name := range ipLookupNames {
+		if lookup.Name == name {
+			return ""
+		}
+		if strings.EqualFold(string(lookup.Name), string(name)) {
+			return fmt.Sprintf("IP lookup %q is unknown, did you mean %q?", lookup.Name, name)
+		}
+		names = append(names, string(name))
+	}
+
+	return fmt.Sprintf("IP lookup %q is unknown, requests are never limited; use one of %s or LookupHeader", lookup.Name, strings.Join(names, ", "))
+}
@@ -0,0 +1,46 @@
+package limiter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	lmt := New(nil).SetMax(1).SetBurst(1).SetIPLookup(IPLookup{Name: "X-Forwarded-For"})
+	if err := lmt.Validate(); err != nil {
+		t.Errorf("Valid config should pass. Got: %v", err)
+	}
+
+	for name, test := range map[string]struct {
+		lmt      *Limiter
+		expected string
+	}{
+		"zero max":        {New(nil).SetBurst(5).SetIPLookup(IPLookup{Name: "RemoteAddr"}), "never refilled"},
+		"zero burst":      {New(nil).SetMax(5).SetIPLookup(IPLookup{Name: "RemoteAddr"}), "every request is rejected"},
+		"missing lookup":  {New(nil).SetMax(1).SetBurst(1), "IP lookup is not set"},
+		"lookup typo":     {New(nil).SetMax(1).SetBurst(1).SetIPLookup(IPLookup{Name: "X-Forwared-For"}), `"X-Forwared-For" is unknown`},
+		"lookup case":     {New(nil).SetMax(1).SetBurst(1).SetIPLookup(IPLookup{Name: "x-real-ip"}), `did you mean "X-Real-IP"`},
+		"mesh lookup":     {New(nil).SetMax(1).SetBurst(1).SetMeshIdentityHeader("X-Forwarded-Client-Cert"), "without the X-Forwarded-Client-Cert header use the IP lookup"},
+		"headers methods": {New(nil).SetMax(1).SetBurst(1).SetIPLookup(IPLookup{Name: "RemoteAddr"}).SetHeader("X-API-Key", nil), "methods are empty"},
+	} {
+		err := test.lmt.Validate()
+		if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: error should mention %q. Got: %v", name, test.expected, err)
+		}
+	}
+}
+
+func TestIPLookupValidate(t *testing.T) {
+	for _, name := range []LookupKind{LookupRemoteAddr, LookupXFF, LookupXRealIP, LookupCFConnectingIP, LookupHeader("True-Client-IP")} {
+		if err := (IPLookup{Name: name}).Validate(); err != nil {
+			t.Errorf("%q should be valid. Got: %v", name, err)
+		}
+	}
+
+	for _, name := range []LookupKind{"", "X-Forwared-For", LookupHeader("")} {
+		if err := (IPLookup{Name: name}).Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%q should be invalid. Got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package limiter
+
+import (
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// ViolationAlert is passed to the violation alert function when a key was rejected too often.
+type ViolationAlert struct {
+	Key       string        `json:"key"`
+	Count     int           `json:"count"`
+	Window    time.Duration `json:"window"`
+	RequestID string        `json:"request_id,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+// violationWindow counts the rejections of a key since its first rejection.
+type violationWindow struct {
+	count int
+}
+
+// SetViolationAlert is thread-safe way of setting a function called when a key gets more than rejections
+// within window, e.g. to page someone or feed a WAF. It is called in its own goroutine, at most once per window and key.
+func (l *Limiter) SetViolationAlert(fn func(ViolationAlert), rejections int, window time.Duration) *Limiter {
+	l.Lock()
+	l.violationAlert = fn
+	l.violationRejections = rejections
+	l.violationWindow = window
+	l.violations = cache.NewCache[string, *violationWindow]().WithTTL(window)
+	l.Unlock()
+
+	return l
+}
+
+// ExecOnViolation is thread-safe way of counting a rejection of key, executing the violation alert function
+// when the key got more rejections than allowed within the window.
+func (l *Limiter) ExecOnViolation(key string, requestID string) {
+	l.RLock()
+	fn, rejections, window, windows := l.violationAlert, l.violationRejections, l.violationWindow, l.violations
+	l.RUnlock()
+
+	if fn == nil {
+		return
+	}
+
+	now := time.Now()
+
+	l.violationsMu.Lock()
+	violations, found := windows.Get(key)
+	if !found {
+		violations = &violationWindow{}
+		windows.Set(key, violations, 0)
+	}
+
+	violations.count++
+	count := violations.count
+	l.violationsMu.Unlock()
+
+	if count != rejections+1 {
+		return
+	}
+
+	go fn(ViolationAlert{
+		Key:       key,
+		Count:     count,
+		Window:    window,
+		RequestID: requestID,
+		Time:      now,
+	})
+}
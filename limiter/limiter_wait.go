@@ -0,0 +1,209 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrWaitQueueFull is returned by WaitTurn when the wait queue holds as many requests as it may.
+var ErrWaitQueueFull = errors.New("wait queue is full")
+
+// waiter is a request waiting for a token.
+type waiter struct {
+	key      string
+	priority int
+	seq      uint64
+}
+
+// waitQueue holds the requests waiting for a token, released by priority within every key.
+type waitQueue struct {
+	sync.Mutex
+	waiters []*waiter
+	seq     uint64
+
+	// Closed and replaced whenever a waiter leaves, so the others check whether it is their turn.
+	changed chan struct{}
+}
+
+// isNext reports whether w goes before every other waiter of its key. It requires that q is locked.
+func (q *waitQueue) isNext(w *waiter) bool {
+	for _, other := range q.waiters {
+		if other.key != w.key || other == w {
+			continue
+		}
+		if other.priority > w.priority || (other.priority == w.priority && other.seq < w.seq) {
+			return false
+		}
+	}
+	return true
+}
+
+// remove takes w out of the queue and wakes the other waiters. It requires that q is locked.
+func (q *waitQueue) remove(w *waiter) {
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// SetWaitMode is thread-safe way of letting requests wait up to maxWait for a token instead of being rejected,
+// smoothing bursts at the cost of latency. At most queueSize requests wait at once, the others are rejected.
+// Waiting requests of a key are released by priority, see SetWaitPriority. A maxWait of zero disables it.
+func (l *Limiter) SetWaitMode(maxWait time.Duration, queueSize int) *Limiter {
+	l.Lock()
+	l.waitMax = maxWait
+	l.waitQueueSize = queueSize
+	l.waitQueue = &waitQueue{changed: make(chan struct{})}
+	l.Unlock()
+
+	return l
+}
+
+// GetWaitMode is thread-safe way of getting how long requests may wait for a token, and how many may wait at once.
+func (l *Limiter) GetWaitMode() (time.Duration, int) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.waitMax, l.waitQueueSize
+}
+
+// SetWaitPriority is thread-safe way of setting the function giving the priority of a waiting request.
+// Requests with a higher priority are released first, requests of equal priority in arrival order.
+func (l *Limiter) SetWaitPriority(fn func(r *http.Request) int) *Limiter {
+	l.Lock()
+	l.waitPriority = fn
+	l.Unlock()
+
+	return l
+}
+
+// WaitPriority is thread-safe way of getting the priority of a waiting request. It is zero when no function is set.
+func (l *Limiter) WaitPriority(r *http.Request) int {
+	l.RLock()
+	fn := l.waitPriority
+	l.RUnlock()
+
+	if fn == nil {
+		return 0
+	}
+	return fn(r)
+}
+
+// SetWaitBudgetHeader is thread-safe way of setting the request header holding how long the caller is willing
+// to wait, e.g. "X-Client-Wait-Budget", as milliseconds or a duration such as "250ms". Requests never wait longer
+// than their budget, and are rejected right away when they would not get a token within it.
+func (l *Limiter) SetWaitBudgetHeader(header string) *Limiter {
+	l.Lock()
+	l.waitBudgetHeader = header
+	l.Unlock()
+
+	return l
+}
+
+// GetWaitBudgetHeader is thread-safe way of getting the request header holding how long the caller is willing to wait.
+func (l *Limiter) GetWaitBudgetHeader() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.waitBudgetHeader
+}
+
+// EstimatedWait returns how long a request of key would wait for a token, when a token is freed every interval:
+// one interval for the request itself, plus one for every request of key already waiting.
+func (l *Limiter) EstimatedWait(key string, interval time.Duration) time.Duration {
+	return time.Duration(l.WaitQueueLenForKey(key)+1) * interval
+}
+
+// WaitQueueLenForKey returns how many requests of key are waiting for a token.
+func (l *Limiter) WaitQueueLenForKey(key string) int {
+	l.RLock()
+	queue := l.waitQueue
+	l.RUnlock()
+
+	if queue == nil {
+		return 0
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	waiting := 0
+	for _, w := range queue.waiters {
+		if w.key == key {
+			waiting++
+		}
+	}
+	return waiting
+}
+
+// WaitQueueLen returns how many requests are waiting for a token.
+func (l *Limiter) WaitQueueLen() int {
+	l.RLock()
+	queue := l.waitQueue
+	l.RUnlock()
+
+	if queue == nil {
+		return 0
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+	return len(queue.waiters)
+}
+
+// WaitTurn queues a request of key until it is its turn and take succeeds, retrying every interval.
+// It returns ErrWaitQueueFull when the queue is full, context.DeadlineExceeded when the request waited
+// longer than allowed, or ctx.Err().
+func (l *Limiter) WaitTurn(ctx context.Context, key string, priority int, interval time.Duration, take func() bool) error {
+	l.RLock()
+	queue, maxWait, queueSize := l.waitQueue, l.waitMax, l.waitQueueSize
+	l.RUnlock()
+
+	if queue == nil || maxWait <= 0 {
+		return ErrWaitQueueFull
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	queue.Lock()
+	if len(queue.waiters) >= queueSize {
+		queue.Unlock()
+		return ErrWaitQueueFull
+	}
+	queue.seq++
+	w := &waiter{key: key, priority: priority, seq: queue.seq}
+	queue.waiters = append(queue.waiters, w)
+	queue.Unlock()
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		queue.Lock()
+		changed := queue.changed
+		if queue.isNext(w) && take() {
+			queue.remove(w)
+			queue.Unlock()
+			return nil
+		}
+		queue.Unlock()
+
+		select {
+		case <-ctx.Done():
+			queue.Lock()
+			queue.remove(w)
+			queue.Unlock()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+			timer.Reset(interval)
+		}
+	}
+}
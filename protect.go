@@ -0,0 +1,42 @@
+package tollbooth
+
+import (
+	"net/http"
+
+	"github.com/didip/tollbooth/v8/errors"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// Protect is a middleware that enforces both the rate limit of lmt and a cap of maxConcurrent in-flight requests.
+//
+// The in-flight slot is taken first and without blocking, so a request rejected for concurrency never consumes
+// a token. If the rate limit then rejects the request, the slot is given back immediately.
+// A maxConcurrent of zero or less disables the in-flight cap.
+func Protect(lmt *limiter.Limiter, maxConcurrent int, next http.Handler) http.Handler {
+	if maxConcurrent <= 0 {
+		return LimitHandler(lmt, next)
+	}
+
+	slots := make(chan struct{}, maxConcurrent)
+
+	middle := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			writeLimitReached(lmt, w, r, &errors.HTTPError{Message: lmt.GetMessage(), StatusCode: lmt.GetStatusCode()}, "")
+			return
+		}
+		defer func() { <-slots }()
+
+		r = WithDecisionCache(r)
+		httpError, info := LimitByRequestWithInfo(lmt, w, r)
+		if httpError != nil {
+			writeLimitReached(lmt, w, r, httpError, info.Key)
+			return
+		}
+
+		serveObserved(lmt, next, throttleDownload(lmt, w, r, info.Key), r, info.Key)
+	}
+
+	return http.HandlerFunc(middle)
+}
@@ -0,0 +1,105 @@
+package tollbooth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+func TestProtect(t *testing.T) {
+	lmt := NewLimiter(2, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := Protect(lmt, 1, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- request() }()
+	<-started
+
+	// The only slot is taken, so this request is rejected without consuming a token.
+	if rr := request(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	close(release)
+	if rr := <-done; rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// The second token is still available.
+	go func() { <-started }()
+	if rr := request(); rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// Now the rate limit kicks in.
+	if rr := request(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestLimitConcurrencyHandler(t *testing.T) {
+	lmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	cl := limiter.NewConcurrencyLimiter(2, 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	handler := LimitConcurrencyHandler(lmt, cl, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 2)
+	go func() { done <- request("127.0.0.1:12345") }()
+	<-started
+
+	// The slot of this IP address is taken.
+	if rr := request("127.0.0.1:12345"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	go func() { done <- request("127.0.0.2:12345") }()
+	<-started
+
+	// Both slots are taken.
+	if rr := request("127.0.0.3:12345"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if rr := <-done; rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	if cl.InFlight() != 0 {
+		t.Errorf("Slots should be released when the handler returns. In flight: %v", cl.InFlight())
+	}
+}
@@ -0,0 +1,25 @@
+package tollbooth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/didip/tollbooth/v8/libstring"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// queuedTooLong reports whether the request waited longer than allowed in the fronting proxy, see limiter.SetMaxQueueTime.
+// Requests without a valid X-Request-Start header are never considered too old.
+func queuedTooLong(lmt *limiter.Limiter, r *http.Request) bool {
+	maxQueueTime := lmt.GetMaxQueueTime()
+	if maxQueueTime <= 0 {
+		return false
+	}
+
+	start, ok := libstring.RequestStartFromHeader(r.Header.Get("X-Request-Start"))
+	if !ok {
+		return false
+	}
+
+	return time.Since(start) > maxQueueTime
+}
@@ -0,0 +1,30 @@
+package tollbooth
+
+import (
+	"net/http"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// RefundClientErrors is a middleware giving back the tokens lmt took for a request when next answers it
+// with a 4xx status code, so requests rejected cheaply, e.g. for failed validation, do not count against the client.
+// Mount it around or inside the middleware of lmt. Requests rejected by lmt itself are never refunded,
+// and requests already refunded because of limiter.SetCountResponse are not refunded twice.
+func RefundClientErrors(lmt *limiter.Limiter, next http.Handler) http.Handler {
+	middle := func(w http.ResponseWriter, r *http.Request) {
+		r = WithDecisionCache(r)
+		rw := NewResponseWriter(w)
+
+		next.ServeHTTP(rw, r)
+
+		if rw.StatusCode < 400 || rw.StatusCode >= 500 {
+			return
+		}
+
+		if decision, found := cachedDecisionFor(lmt, r); found && decision.httpError == nil && decision.info.Key != "" {
+			refundOnce(lmt, r, decision.info.Key)
+		}
+	}
+
+	return http.HandlerFunc(middle)
+}
@@ -0,0 +1,89 @@
+package tollbooth
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter wraps a http.ResponseWriter to record the status code and the number of bytes written,
+// e.g. for post-response accounting. Flush, Hijack and ReadFrom are passed through to the wrapped writer,
+// so server-sent events, websockets and sendfile keep working behind it.
+type ResponseWriter struct {
+	http.ResponseWriter
+
+	// Status code written, zero until the header is written.
+	StatusCode int
+
+	// Number of body bytes written.
+	BytesWritten int64
+}
+
+// NewResponseWriter wraps w.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader records statusCode and writes it to the wrapped writer.
+func (rw *ResponseWriter) WriteHeader(statusCode int) {
+	if rw.StatusCode == 0 {
+		rw.StatusCode = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write counts the bytes of p written to the wrapped writer.
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	if rw.StatusCode == 0 {
+		rw.StatusCode = http.StatusOK
+	}
+
+	n, err := rw.ResponseWriter.Write(p)
+	rw.BytesWritten += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client, when the wrapped writer is a http.Flusher.
+func (rw *ResponseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, when the wrapped writer is a http.Hijacker.
+// It returns http.ErrNotSupported otherwise.
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// ReadFrom copies r to the wrapped writer, with sendfile when the wrapped writer supports it.
+func (rw *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.StatusCode == 0 {
+		rw.StatusCode = http.StatusOK
+	}
+
+	var n int64
+	var err error
+	if readerFrom, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{rw.ResponseWriter}, r)
+	}
+
+	rw.BytesWritten += n
+	return n, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// writerOnly hides the io.ReaderFrom of a writer, so io.Copy does not call it back.
+type writerOnly struct {
+	io.Writer
+}
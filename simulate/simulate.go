@@ -0,0 +1,91 @@
+// Package simulate replays recorded requests against a candidate limit, to pick limits from data before rolling them out.
+package simulate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/didip/tollbooth/v8/internal/time/rate"
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// Request is a recorded request.
+type Request struct {
+	Time time.Time `json:"time"`
+	Key  string    `json:"key"`
+}
+
+// Report is the outcome of a replay.
+type Report struct {
+	// Number of requests replayed.
+	Requests int
+
+	// Number of requests the candidate limit would have rejected.
+	Limited int
+
+	// Number of rejected requests per key.
+	LimitedKeys map[string]int
+}
+
+// LimitedRatio returns the share of the requests the candidate limit would have rejected.
+func (report Report) LimitedRatio() float64 {
+	if report.Requests == 0 {
+		return 0
+	}
+	return float64(report.Limited) / float64(report.Requests)
+}
+
+// Run replays requests in time order against policy, every key getting its own bucket as in tollbooth.
+// It returns limiter.ErrInvalidRate when policy is invalid, see limiter.Rate.Validate.
+func Run(requests []Request, policy limiter.Rate) (Report, error) {
+	if err := policy.Validate(); err != nil {
+		return Report{}, err
+	}
+
+	sorted := append([]Request(nil), requests...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	report := Report{Requests: len(sorted), LimitedKeys: make(map[string]int)}
+	buckets := make(map[string]*rate.Limiter)
+
+	for _, request := range sorted {
+		bucket, found := buckets[request.Key]
+		if !found {
+			bucket = rate.NewLimiter(rate.Limit(policy.Max/policy.Per.Seconds()), policy.Burst)
+			buckets[request.Key] = bucket
+		}
+
+		if !bucket.AllowN(request.Time, 1) {
+			report.Limited++
+			report.LimitedKeys[request.Key]++
+		}
+	}
+
+	return report, nil
+}
+
+// ReadLog reads requests from JSON lines holding at least "time" and "key", e.g. a decision log
+// written by limiter.SetDecisionLog. Only the sampled requests are in a decision log,
+// so sample all of them when recording for a replay.
+func ReadLog(r io.Reader) ([]Request, error) {
+	var requests []Request
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var request Request
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, scanner.Err()
+}
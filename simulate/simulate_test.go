@@ -0,0 +1,61 @@
+package simulate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+func TestRun(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	var requests []Request
+	for i := 0; i < 10; i++ {
+		// One client sends 10 requests within a second, the other one every second.
+		requests = append(requests,
+			Request{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Key: "10.1.2.3|/|"},
+			Request{Time: start.Add(time.Duration(i) * time.Second), Key: "10.1.2.4|/|"},
+		)
+	}
+
+	report, err := Run(requests, limiter.Rate{Max: 2, Per: time.Second, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Requests != 20 {
+		t.Errorf("Every request should be replayed. Requests: %v", report.Requests)
+	}
+	if report.LimitedKeys["10.1.2.3|/|"] < 5 || report.LimitedKeys["10.1.2.4|/|"] != 0 {
+		t.Errorf("Only the bursty client should be limited. Limited: %v", report.LimitedKeys)
+	}
+	if report.LimitedRatio() != float64(report.Limited)/20 {
+		t.Errorf("Limited ratio is not computed correctly. Value: %v", report.LimitedRatio())
+	}
+
+	if _, err := Run(requests, limiter.Rate{Max: 2}); !errors.Is(err, limiter.ErrInvalidRate) {
+		t.Errorf("Invalid policies should be rejected. Got: %v", err)
+	}
+}
+
+func TestReadLog(t *testing.T) {
+	log := `{"time":"2024-03-01T10:00:00Z","key":"10.1.2.3|/|","admitted":true}
+
+{"time":"2024-03-01T10:00:01Z","key":"10.1.2.4|/|","admitted":false}
+`
+
+	requests, err := ReadLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[1].Key != "10.1.2.4|/|" || requests[1].Time.Second() != 1 {
+		t.Errorf("Requests are not read correctly. Got: %+v", requests)
+	}
+
+	if _, err := ReadLog(strings.NewReader("not json")); err == nil {
+		t.Error("Invalid lines should be rejected.")
+	}
+}
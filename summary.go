@@ -0,0 +1,49 @@
+package tollbooth
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// summaryTemplate renders summaries as a compact HTML page.
+var summaryTemplate = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>tollbooth</title></head>
+<body>
+{{range .}}
+<h2>{{if .Route}}{{.Route}}{{else}}default{{end}}</h2>
+<p>{{printf "%.2f" .Max}} requests per second, burst of {{.Burst}}{{if .GlobalMax}}, {{printf "%.2f" .GlobalMax}} requests per second globally{{end}}{{if .Methods}}, methods {{range $i, $m := .Methods}}{{if $i}}, {{end}}{{$m}}{{end}}{{end}}</p>
+<p>{{.Allowed}} allowed, {{.Limited}} limited</p>
+<table>
+<tr><th>Key</th><th>Limited</th></tr>
+{{range .TopKeys}}<tr><td>{{.Key}}</td><td>{{.Limited}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// SummaryHandler renders the summary of every limiter, with its topKeys most limited keys, for internal admin pages.
+// It renders JSON, or HTML when requested with ?format=html or an Accept header preferring text/html.
+// Mount it behind your own authentication: keys hold IP addresses and other client identities.
+func SummaryHandler(topKeys int, lmts ...*limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summaries := make([]limiter.Summary, 0, len(lmts))
+		for _, lmt := range lmts {
+			summaries = append(summaries, lmt.Summary(topKeys))
+		}
+
+		if r.URL.Query().Get("format") == "html" || strings.HasPrefix(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			summaryTemplate.Execute(w, summaries)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries)
+	})
+}
@@ -0,0 +1,75 @@
+package tollbooth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// swapPollInterval is how often Swap checks whether the requests of the old limiter are done.
+const swapPollInterval = 10 * time.Millisecond
+
+// generation is a limiter together with the number of requests it is serving.
+type generation struct {
+	lmt      *limiter.Limiter
+	inflight atomic.Int64
+}
+
+// SwappableHandler is a middleware whose limiter can be replaced at runtime by a whole new policy,
+// without dropping requests: requests admitted by the old limiter finish with it.
+type SwappableHandler struct {
+	next    http.Handler
+	current atomic.Pointer[generation]
+}
+
+// NewSwappableHandler returns a SwappableHandler limiting next with lmt.
+func NewSwappableHandler(lmt *limiter.Limiter, next http.Handler) *SwappableHandler {
+	h := &SwappableHandler{next: next}
+	h.current.Store(&generation{lmt: lmt})
+	return h
+}
+
+// Limiter returns the limiter of new requests.
+func (h *SwappableHandler) Limiter() *limiter.Limiter {
+	return h.current.Load().lmt
+}
+
+// ServeHTTP limits r with the current limiter.
+func (h *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		current := h.current.Load()
+		current.inflight.Add(1)
+
+		// A swap in between may already have waited for the old limiter, use the new one.
+		if h.current.Load() != current {
+			current.inflight.Add(-1)
+			continue
+		}
+
+		defer current.inflight.Add(-1)
+		serveLimited(current.lmt, h.next, w, r)
+		return
+	}
+}
+
+// Swap limits new requests with lmt, waits for the requests of the old limiter to finish, then drains it,
+// see limiter.Drain. It returns the old limiter, and ctx.Err() when ctx is done first.
+func (h *SwappableHandler) Swap(ctx context.Context, lmt *limiter.Limiter) (*limiter.Limiter, error) {
+	old := h.current.Swap(&generation{lmt: lmt})
+
+	ticker := time.NewTicker(swapPollInterval)
+	defer ticker.Stop()
+
+	for old.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return old.lmt, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return old.lmt, old.lmt.Drain(ctx)
+}
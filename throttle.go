@@ -0,0 +1,117 @@
+package tollbooth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/didip/tollbooth/v8/limiter"
+)
+
+// throttledReader paces reads with the upload rate of a key.
+type throttledReader struct {
+	io.ReadCloser
+	ctx context.Context
+	lmt *limiter.Limiter
+	key string
+}
+
+// UploadReader wraps body so that reading it is paced with the upload rate of key, see limiter.SetUploadRate.
+// LimitByRequest already wraps the body of admitted requests, use it for bodies read outside of the middlewares.
+func UploadReader(ctx context.Context, lmt *limiter.Limiter, key string, body io.ReadCloser) io.ReadCloser {
+	return &throttledReader{ReadCloser: body, ctx: ctx, lmt: lmt, key: key}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read at most one second of bytes at a time, so that pacing stays smooth.
+	if uploadRate := t.lmt.GetUploadRate(); uploadRate > 0 && len(p) > uploadRate {
+		p = p[:uploadRate]
+	}
+
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := t.lmt.WaitUpload(t.ctx, t.key, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// throttledWriter paces writes with the download rate of a key.
+// Flush and Hijack are passed through, ReadFrom is paced like Write.
+type throttledWriter struct {
+	*ResponseWriter
+	ctx context.Context
+	lmt *limiter.Limiter
+	key string
+
+	// Time writes spent waiting for the download rate.
+	paced time.Duration
+}
+
+// DownloadWriter wraps w so that writing the response is paced with the download rate of key, see limiter.SetDownloadRate.
+// The middlewares of this package already wrap the writer of admitted requests.
+func DownloadWriter(ctx context.Context, lmt *limiter.Limiter, key string, w http.ResponseWriter) http.ResponseWriter {
+	return &throttledWriter{ResponseWriter: NewResponseWriter(w), ctx: ctx, lmt: lmt, key: key}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// Write at most one second of bytes at a time, so that pacing stays smooth.
+		chunk := p
+		if downloadRate := t.lmt.GetDownloadRate(); downloadRate > 0 && len(chunk) > downloadRate {
+			chunk = chunk[:downloadRate]
+		}
+
+		start := time.Now()
+		err := t.lmt.WaitDownload(t.ctx, t.key, len(chunk))
+		t.paced += time.Since(start)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// ReadFrom copies r with Write, so that sendfile does not bypass the pacing.
+func (t *throttledWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{t}, r)
+}
+
+// throttleDownload wraps the writer of an admitted request when a download rate is set.
+// Requests which skipped the limiter have no key, and are not paced rather than sharing one bucket.
+func throttleDownload(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request, key string) http.ResponseWriter {
+	if key == "" || lmt.GetDownloadRate() <= 0 {
+		return w
+	}
+	return DownloadWriter(r.Context(), lmt, key, w)
+}
+
+// pacedTime returns how long writes to w and the writers it wraps waited for download rates,
+// so that the pacing is not mistaken for the latency of the handler.
+func pacedTime(w http.ResponseWriter) time.Duration {
+	var paced time.Duration
+	for {
+		if t, ok := w.(*throttledWriter); ok {
+			paced += t.paced
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return paced
+		}
+		w = unwrapper.Unwrap()
+	}
+}
@@ -2,20 +2,34 @@
 package tollbooth
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/didip/tollbooth/v8/errors"
 	"github.com/didip/tollbooth/v8/libstring"
 	"github.com/didip/tollbooth/v8/limiter"
 )
 
+// windowOf returns the limit of opts over its time window, and the window length in seconds.
+func windowOf(opts limiter.BucketOptions) (float64, int) {
+	if opts.Window <= time.Second {
+		return opts.Max, 1
+	}
+	return opts.Max * opts.Window.Seconds(), int(math.Round(opts.Window.Seconds()))
+}
+
 // setResponseHeaders configures X-Rate-Limit-Limit and X-Rate-Limit-Duration
-func setResponseHeaders(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("X-Rate-Limit-Limit", fmt.Sprintf("%.2f", lmt.GetMax()))
-	w.Header().Add("X-Rate-Limit-Duration", "1")
+func setResponseHeaders(lmt *limiter.Limiter, opts limiter.BucketOptions, w http.ResponseWriter, r *http.Request) {
+	windowMax, windowSeconds := windowOf(opts)
+	w.Header().Add("X-Rate-Limit-Limit", fmt.Sprintf("%.2f", windowMax))
+	w.Header().Add("X-Rate-Limit-Duration", fmt.Sprintf("%d", windowSeconds))
 
 	xForwardedFor := r.Header.Get("X-Forwarded-For")
 	if strings.TrimSpace(xForwardedFor) != "" {
@@ -23,14 +37,57 @@ func setResponseHeaders(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Req
 	}
 
 	w.Header().Add("X-Rate-Limit-Request-Remote-Addr", r.RemoteAddr)
+
+	if requestID := lmt.RequestID(r); requestID != "" {
+		w.Header().Add("X-Rate-Limit-Request-Id", requestID)
+	}
+
+	if header := lmt.GetClientRateHeader(); header != "" && opts.Max > 0 {
+		w.Header().Set(header, fmt.Sprintf("%.2f", opts.Max))
+	}
 }
 
-// setRateLimitResponseHeaders configures RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// SetRateLimitHeaders configures RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy
 // as seen at https://datatracker.ietf.org/doc/html/draft-ietf-httpapi-ratelimit-headers
-func setRateLimitResponseHeaders(lmt *limiter.Limiter, w http.ResponseWriter, tokensLeft int) {
-	w.Header().Add("RateLimit-Limit", fmt.Sprintf("%d", int(math.Round(lmt.GetMax()))))
-	w.Header().Add("RateLimit-Reset", "1")
-	w.Header().Add("RateLimit-Remaining", fmt.Sprintf("%d", tokensLeft))
+// Adapters for other frameworks can call it with the info returned by LimitByRequestWithInfo,
+// to send the same headers as the middlewares of this package.
+func SetRateLimitHeaders(w http.ResponseWriter, info limiter.Info) {
+	info.SetHeader(w.Header())
+}
+
+// setRetryAfterHeader configures Retry-After with the time until a bucket refilling max tokens per second
+// holds a token again, plus the random jitter configured on the limiter.
+func setRetryAfterHeader(lmt *limiter.Limiter, max float64, w http.ResponseWriter) {
+	if retryAfter := retryAfterSeconds(lmt, max); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+// retryAfterSeconds returns the time until a bucket refilling max tokens per second holds a token again,
+// plus the random jitter configured on the limiter, in seconds. It returns zero when max is not positive.
+func retryAfterSeconds(lmt *limiter.Limiter, max float64) int {
+	if max <= 0 {
+		return 0
+	}
+
+	retryAfter := time.Duration(float64(time.Second) / max)
+	if jitter := lmt.GetRetryAfterJitter(); jitter > 0 {
+		retryAfter += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+
+	return int(math.Ceil(retryAfter.Seconds()))
+}
+
+// setRejectionHeaders configures the RateLimit headers of info and Retry-After on a rejected request.
+// The headers which only depend on the limit are copied from the ones lmt rendered for earlier rejections.
+func setRejectionHeaders(lmt *limiter.Limiter, w http.ResponseWriter, info limiter.Info, max float64) {
+	header := w.Header()
+	for name, values := range lmt.RejectionHeader(info) {
+		// The cached values are shared by every rejection, so they must not end up in a mutable header.
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("RateLimit-Remaining", strconv.Itoa(info.Remaining))
+	setRetryAfterHeader(lmt, max, w)
 }
 
 // NewLimiter is a convenience function to limiter.New.
@@ -40,6 +97,30 @@ func NewLimiter(max float64, tbOptions *limiter.ExpirableOptions) *limiter.Limit
 		SetBurst(int(math.Max(1, max)))
 }
 
+// NewLimiterPerMinute creates a limiter allowing max requests per minute.
+func NewLimiterPerMinute(max int) *limiter.Limiter {
+	return newLimiterPerPeriod(max, time.Minute)
+}
+
+// NewLimiterPerHour creates a limiter allowing max requests per hour.
+func NewLimiterPerHour(max int) *limiter.Limiter {
+	return newLimiterPerPeriod(max, time.Hour)
+}
+
+// NewLimiterPerDay creates a limiter allowing max requests per day.
+func NewLimiterPerDay(max int) *limiter.Limiter {
+	return newLimiterPerPeriod(max, 24*time.Hour)
+}
+
+// newLimiterPerPeriod allows max requests per period.
+// A bucket is full again after being idle for one period, so with sliding expiration
+// it can expire then without granting extra requests.
+func newLimiterPerPeriod(max int, period time.Duration) *limiter.Limiter {
+	return limiter.New(&limiter.ExpirableOptions{DefaultExpirationTTL: period}).
+		SetRate(max, period).
+		SetTokenBucketSlidingExpiration(true)
+}
+
 // LimitByKeys keeps track number of request made by keys separated by pipe.
 // It returns HTTPError when limit is exceeded.
 func LimitByKeys(lmt *limiter.Limiter, keys []string) *errors.HTTPError {
@@ -57,30 +138,174 @@ func LimitByKeysAndReturn(lmt *limiter.Limiter, keys []string) (*errors.HTTPErro
 	return nil, lmt.Tokens(strings.Join(keys, "|"))
 }
 
+// limitByKeysWithOptions is like LimitByKeysAndReturn, but creates missing buckets using opts.
+func limitByKeysWithOptions(lmt *limiter.Limiter, keys []string, opts limiter.BucketOptions) (*errors.HTTPError, int) {
+	if lmt.LimitReachedWithOptions(strings.Join(keys, "|"), opts) {
+		return &errors.HTTPError{Message: lmt.GetMessage(), StatusCode: lmt.GetStatusCode()}, 0
+	}
+
+	return nil, lmt.Tokens(strings.Join(keys, "|"))
+}
+
+// scheduledLimit is the outcome of limiter.ScheduledLimit. It is resolved once per request,
+// so the keys and the bucket options of a request agree at a schedule boundary.
+type scheduledLimit struct {
+	name  string
+	rate  limiter.Rate
+	found bool
+}
+
+func resolveScheduledLimit(lmt *limiter.Limiter) scheduledLimit {
+	name, rate, found := lmt.ScheduledLimit()
+	return scheduledLimit{name: name, rate: rate, found: found}
+}
+
+// BucketOptionsForRequest resolves the token bucket settings which apply to the request.
+func BucketOptionsForRequest(lmt *limiter.Limiter, r *http.Request) limiter.BucketOptions {
+	return bucketOptionsForRequest(lmt, r, resolveScheduledLimit(lmt))
+}
+
+// bucketOptionsForRequest is like BucketOptionsForRequest, with the scheduled limit already resolved.
+func bucketOptionsForRequest(lmt *limiter.Limiter, r *http.Request, schedule scheduledLimit) limiter.BucketOptions {
+	opts := limiter.BucketOptions{Max: lmt.GetMax(), Burst: lmt.GetBurst(), Window: lmt.GetWindow(), TTL: lmt.TokenBucketTTLForRequest(r), Cost: lmt.CostForRequest(r)}
+	return overrideOptions(lmt, r, schedule, opts)
+}
+
+// overrideOptions applies the region, IP family, schedule, method, path and pool overrides which match r
+// to opts holding the limiter-wide rate.
+func overrideOptions(lmt *limiter.Limiter, r *http.Request, schedule scheduledLimit, opts limiter.BucketOptions) limiter.BucketOptions {
+	if rate, found := lmt.RegionLimit(); found {
+		opts = opts.WithRate(rate)
+	}
+
+	if rate, found := lmt.IPFamilyLimitForIP(remoteIPFromRequest(lmt, r)); found {
+		opts = opts.WithRate(rate)
+	}
+
+	if schedule.found {
+		opts = opts.WithRate(schedule.rate)
+	}
+
+	if _, rate, found := lmt.ReadWriteLimitForMethod(r.Method); found {
+		opts = opts.WithRate(rate)
+	}
+
+	if methodMax, found := lmt.GetMethodLimit(r.Method); found {
+		opts.Max = methodMax
+		opts.Burst = int(math.Max(1, methodMax))
+		opts.Window = time.Second
+	}
+
+	if _, pathMax, found := lmt.GetPathLimit(r.URL.Path); found {
+		opts.Max = pathMax
+		opts.Burst = int(math.Max(1, pathMax))
+		opts.Window = time.Second
+	}
+
+	if _, share, found := lmt.PriorityPoolForRequest(r); found {
+		opts.Max *= share
+		opts.Burst = int(math.Max(1, math.Round(float64(opts.Burst)*share)))
+	}
+
+	return lmt.PacedOptions(opts)
+}
+
+// canaryOptions returns the bucket options of r with the canary rate in place of the limiter-wide rate
+// when key is part of the canary, otherwise opts. The overrides matching r still apply on top of it.
+func canaryOptions(lmt *limiter.Limiter, r *http.Request, schedule scheduledLimit, key string, opts limiter.BucketOptions) limiter.BucketOptions {
+	rate, found := lmt.CanaryLimitForKey(key)
+	if !found {
+		return opts
+	}
+	return overrideOptions(lmt, r, schedule, limiter.BucketOptions{TTL: opts.TTL, Cost: opts.Cost}.WithRate(rate))
+}
+
+// strictestOptions replaces the rate of opts with the sustained rate of key closest to rejecting it,
+// so the RateLimit headers describe the window which limits the client.
+func strictestOptions(lmt *limiter.Limiter, key string, opts limiter.BucketOptions) limiter.BucketOptions {
+	if rate, found := lmt.StrictestSustainedLimit(key); found {
+		opts = opts.WithRate(rate)
+	}
+	return opts
+}
+
+// remoteKeyFromRequest returns the peer identity when a mesh identity header is trusted and set,
+// otherwise the canonical remote IP.
+func remoteKeyFromRequest(lmt *limiter.Limiter, r *http.Request) string {
+	if header := lmt.GetMeshIdentityHeader(); header != "" {
+		identity := r.Header.Get(header)
+		if http.CanonicalHeaderKey(header) == "X-Forwarded-Client-Cert" && identity != "" {
+			identity = libstring.PeerIdentityFromXFCC(identity)
+		}
+		// Requests which bypassed the mesh proxy are limited by IP rather than not at all.
+		if identity != "" {
+			return identity
+		}
+	}
+
+	return libstring.CanonicalizeIPWithPrefix(remoteIPFromRequest(lmt, r), lmt.GetIPv6Canonicalization().PrefixLength())
+}
+
+// remoteIPFromRequest returns the IP address set by SetRemoteIP, otherwise the one picked by the IP lookup.
+func remoteIPFromRequest(lmt *limiter.Limiter, r *http.Request) string {
+	remoteIP, found := r.Context().Value(remoteIPContextKey{}).(string)
+	if !found {
+		remoteIP = libstring.RemoteIPFromIPLookup(lmt.GetIPLookup(), r)
+	}
+	return remoteIP
+}
+
+// bearerToken returns the OAuth2 Bearer token of the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
 // ShouldSkipLimiter is a series of filter that decides if request should be limited or not.
 func ShouldSkipLimiter(lmt *limiter.Limiter, r *http.Request) bool {
 	// ---------------------------------
 	// Filter by remote ip
 	// If we are unable to find remoteIP, skip limiter
-	remoteIP := libstring.RemoteIPFromIPLookup(lmt.GetIPLookup(), r)
-	remoteIP = libstring.CanonicalizeIP(remoteIP)
+	remoteIP := remoteKeyFromRequest(lmt, r)
 	if remoteIP == "" {
 		return true
 	}
 
 	// ---------------------------------
-	// Filter by request method
-	lmtMethods := lmt.GetMethods()
-	lmtMethodsIsSet := len(lmtMethods) > 0
+	// Filter by signed bypass token, e.g. for load tests and trusted batch jobs
+	if lmt.IsValidBypassToken(r.Header.Get(limiter.BypassHeader)) {
+		return true
+	}
 
-	if lmtMethodsIsSet {
-		// If request does not contain all of the methods in limiter,
-		// skip limiter
-		requestMethodDefinedInLimiter := libstring.StringInSlice(lmtMethods, r.Method)
+	// ---------------------------------
+	// Filter by excluded paths, e.g. health checks and metrics
+	if lmt.IsExcludedPath(r.URL.Path) {
+		return true
+	}
 
-		if !requestMethodDefinedInLimiter {
-			return true
-		}
+	// ---------------------------------
+	// Filter by custom exemption logic, e.g. feature flags or internal callers
+	if lmt.ExecSkipFunc(r) {
+		return true
+	}
+
+	// ---------------------------------
+	// Filter by CORS preflight
+	// Browsers send them on their own, so they should not eat into the budget.
+	if lmt.GetSkipPreflight() && r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		return true
+	}
+
+	// ---------------------------------
+	// Filter by request method
+	// If request does not match any of the methods or method groups in limiter,
+	// skip limiter
+	if !lmt.MatchesMethod(r.Method) {
+		return true
 	}
 
 	// ---------------------------------
@@ -111,12 +336,20 @@ func ShouldSkipLimiter(lmt *limiter.Limiter, r *http.Request) bool {
 		requestHeadersDefinedInLimiter = false
 
 		for headerKey, headerValues := range lmtHeaders {
+			if matcher := lmt.GetHeaderMatcher(headerKey); matcher != nil {
+				if reqHeaderValue := r.Header.Get(headerKey); reqHeaderValue != "" {
+					if _, matched := matcher(reqHeaderValue); matched {
+						requestHeadersDefinedInLimiter = true
+					}
+				}
+				continue
+			}
 			if len(headerValues) == 0 {
 				requestHeadersDefinedInLimiter = true
 				continue
 			}
 			for _, headerValue := range headerValues {
-				if r.Header.Get(headerKey) == headerValue {
+				if libstring.MatchWildcard(headerValue, r.Header.Get(headerKey)) {
 					requestHeadersDefinedInLimiter = true
 					break
 				}
@@ -192,10 +425,32 @@ func ShouldSkipLimiter(lmt *limiter.Limiter, r *http.Request) bool {
 	return false
 }
 
+// sortByKey sorts key/value pairs by key.
+func sortByKey(pairs [][]string) {
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+}
+
 // BuildKeys generates a slice of keys to rate-limit by given limiter and request structs.
 func BuildKeys(lmt *limiter.Limiter, r *http.Request) [][]string {
-	remoteIP := libstring.RemoteIPFromIPLookup(lmt.GetIPLookup(), r)
-	remoteIP = libstring.CanonicalizeIP(remoteIP)
+	sliceKeys, _, _ := buildKeysAndClass(lmt, r, resolveScheduledLimit(lmt))
+	return sliceKeys
+}
+
+// buildKeysAndClass is like BuildKeys, but also returns the class of the most specific client identity in the keys,
+// and the key of the quota, which identifies the client only: the path, method and limit components are left out,
+// so the quota of a client spans every route.
+func buildKeysAndClass(lmt *limiter.Limiter, r *http.Request, schedule scheduledLimit) ([][]string, limiter.KeyClass, string) {
+	keyClass := limiter.KeyClassIP
+
+	remoteIP := remoteKeyFromRequest(lmt, r)
+	if clientID := lmt.ResolveClientID(r.Context(), bearerToken(r)); clientID != "" {
+		remoteIP = clientID
+		keyClass = limiter.KeyClassClientID
+	}
+	if identity, found := identityFromRequest(lmt, r); found {
+		remoteIP = identity
+		keyClass = limiter.KeyClassIdentity
+	}
 	path := r.URL.Path
 	sliceKeys := make([][]string, 0)
 
@@ -225,14 +480,21 @@ func BuildKeys(lmt *limiter.Limiter, r *http.Request) [][]string {
 				continue
 			}
 
-			if len(headerValues) == 0 {
+			if matcher := lmt.GetHeaderMatcher(headerKey); matcher != nil {
+				// If header has a matcher, rate-limit all request in the same family together.
+				if family, matched := matcher(reqHeaderValue); matched {
+					headerValuesToLimit = append(headerValuesToLimit, []string{headerKey, family})
+				}
+
+			} else if len(headerValues) == 0 {
 				// If header values are empty, rate-limit all request containing headerKey.
 				headerValuesToLimit = append(headerValuesToLimit, []string{headerKey, reqHeaderValue})
 
 			} else {
 				// If header values are not empty, rate-limit all request with headerKey and headerValues.
+				// Wildcard header values put all matching request in the same bucket.
 				for _, headerValue := range headerValues {
-					if r.Header.Get(headerKey) == headerValue {
+					if libstring.MatchWildcard(headerValue, reqHeaderValue) {
 						headerValuesToLimit = append(headerValuesToLimit, []string{headerKey, headerValue})
 						break
 					}
@@ -242,6 +504,7 @@ func BuildKeys(lmt *limiter.Limiter, r *http.Request) [][]string {
 	}
 
 	contextValuesToLimit := [][]string{}
+	contextKeysToLimit := [][]string{}
 	if lmtContextValuesIsSet {
 		for contextKey, contextValues := range lmtContextValues {
 			reqContextValue := fmt.Sprintf("%v", r.Context().Value(contextKey))
@@ -265,13 +528,52 @@ func BuildKeys(lmt *limiter.Limiter, r *http.Request) [][]string {
 		}
 	}
 
+	for _, contextKey := range lmt.GetContextKeys() {
+		if contextValue := r.Context().Value(contextKey); contextValue != nil {
+			contextKeysToLimit = append(contextKeysToLimit, []string{fmt.Sprintf("%v", contextKey), fmt.Sprintf("%v", contextValue)})
+		}
+	}
+
+	// Map iteration order is random, sort to always build the same keys for the same request.
+	sortByKey(headerValuesToLimit)
+	sortByKey(contextValuesToLimit)
+
+	bodyValuesToLimit := bodyValuesFromRequest(lmt, r)
+
 	sliceKey := []string{remoteIP}
-	if !lmtIgnoreURL {
+	if route := lmt.GetRoute(); route != "" {
+		// Mounted with ForRoute, the route name replaces the path so that routes can pool their budget.
+		sliceKey = append(sliceKey, route)
+	} else if !lmtIgnoreURL {
 		sliceKey = append(sliceKey, path)
+	} else if pathPrefix, _, found := lmt.GetPathLimit(path); found {
+		// Path groups with their own limit must not share a bucket, even when URL is ignored.
+		sliceKey = append(sliceKey, pathPrefix)
 	}
 
 	sliceKey = append(sliceKey, lmtMethods...)
 
+	if region := lmt.GetRegion(); region != "" {
+		sliceKey = append(sliceKey, region)
+	}
+
+	if schedule.found {
+		sliceKey = append(sliceKey, schedule.name)
+	}
+
+	if readWrite, _, found := lmt.ReadWriteLimitForMethod(r.Method); found {
+		sliceKey = append(sliceKey, readWrite)
+	}
+
+	if _, found := lmt.GetMethodLimit(r.Method); found {
+		// Methods with their own limit must not share a bucket.
+		sliceKey = append(sliceKey, r.Method)
+	}
+
+	if pool, _, found := lmt.PriorityPoolForRequest(r); found {
+		sliceKey = append(sliceKey, pool)
+	}
+
 	for _, header := range headerValuesToLimit {
 		sliceKey = append(sliceKey, header[0], header[1])
 	}
@@ -280,66 +582,353 @@ func BuildKeys(lmt *limiter.Limiter, r *http.Request) [][]string {
 		sliceKey = append(sliceKey, contextValue[0], contextValue[1])
 	}
 
+	for _, contextValue := range contextKeysToLimit {
+		sliceKey = append(sliceKey, contextValue[0], contextValue[1])
+	}
+
+	for _, bodyValue := range bodyValuesToLimit {
+		sliceKey = append(sliceKey, bodyValue[0], bodyValue[1])
+	}
+
 	sliceKey = append(sliceKey, usernameToLimit)
 
 	sliceKeys = append(sliceKeys, sliceKey)
 
-	return sliceKeys
+	quotaKey := []string{remoteIP}
+	for _, values := range [][][]string{headerValuesToLimit, contextValuesToLimit, contextKeysToLimit} {
+		for _, value := range values {
+			quotaKey = append(quotaKey, value[0], value[1])
+		}
+	}
+	quotaKey = append(quotaKey, usernameToLimit)
+
+	if usernameToLimit != "" {
+		keyClass = limiter.KeyClassBasicAuthUser
+	} else if len(headerValuesToLimit) > 0 && keyClass == limiter.KeyClassIP {
+		keyClass = limiter.KeyClassHeader
+	}
+
+	return sliceKeys, keyClass, strings.Join(quotaKey, "|")
 }
 
 // LimitByRequest builds keys based on http.Request struct,
 // loops through all the keys, and check if any one of them returns HTTPError.
 func LimitByRequest(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request) *errors.HTTPError {
-	setResponseHeaders(lmt, w, r)
+	httpError, _ := LimitByRequestWithInfo(lmt, w, r)
+	return httpError
+}
+
+// LimitByRequestWithInfo is like LimitByRequest, but also returns the key, remaining tokens and reset time
+// of the request, so that custom middlewares can set their own headers.
+// When r has a decision cache, see WithDecisionCache, lmt decides only once for it.
+func LimitByRequestWithInfo(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request) (*errors.HTTPError, limiter.Info) {
+	if decision, found := cachedDecisionFor(lmt, r); found {
+		return decision.httpError, decision.info
+	}
+
+	httpError, info := limitByRequest(lmt, w, r)
+	cacheDecision(lmt, r, cachedDecision{httpError: httpError, info: info})
+	return httpError, info
+}
+
+// limitByRequest decides whether lmt admits r.
+func limitByRequest(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request) (*errors.HTTPError, limiter.Info) {
+	schedule := resolveScheduledLimit(lmt)
+	opts := bucketOptionsForRequest(lmt, r, schedule)
+
+	setResponseHeaders(lmt, opts, w, r)
+	capConnection(lmt, w, r)
 
 	shouldSkip := ShouldSkipLimiter(lmt, r)
 	if shouldSkip {
-		return nil
+		return nil, limiter.Info{}
+	}
+
+	if lmt.MaintenanceLimitReached() {
+		maintenanceMax, message := lmt.GetMaintenance()
+		setRetryAfterHeader(lmt, maintenanceMax, w)
+		return &errors.HTTPError{Message: message, StatusCode: http.StatusServiceUnavailable}, limiter.Info{}
+	}
+
+	if lmt.Overloaded() {
+		setRetryAfterHeader(lmt, 1, w)
+		return &errors.HTTPError{Message: lmt.LoadSheddingMessage(), StatusCode: http.StatusServiceUnavailable}, limiter.Info{}
 	}
 
-	sliceKeys := BuildKeys(lmt, r)
+	if queuedTooLong(lmt, r) {
+		return &errors.HTTPError{Message: "Request has been queued for too long.", StatusCode: http.StatusServiceUnavailable}, limiter.Info{}
+	}
+
+	sliceKeys, keyClass, quotaKey := buildKeysAndClass(lmt, r, schedule)
 
 	// Get the lowest value over all keys to return in headers.
 	// Start with high arbitrary number so that any limit returned would be lower and would
 	// overwrite the value we start with.
 	var tokensLeft = math.MaxInt32
+	firstKeyOpts := opts
+	// Tokens taken from the keys, given back when the service-level limit rejects the request.
+	admitted := make(map[string]int, len(sliceKeys))
 
 	// Loop sliceKeys and check if one of them has error.
-	for _, keys := range sliceKeys {
-		httpError, keysLimit := LimitByKeysAndReturn(lmt, keys)
+	for i, keys := range sliceKeys {
+		keyOpts := lmt.MaxOptionsForKey(strings.Join(keys, "|"), r, canaryOptions(lmt, r, schedule, strings.Join(keys, "|"), opts))
+		keyOpts = lmt.BurstOptionsForKey(strings.Join(keys, "|"), r, keyOpts)
+		if i == 0 {
+			// The headers of admitted requests describe the first key.
+			firstKeyOpts = keyOpts
+		}
+		httpError, keysLimit := limitByKeysWithOptions(lmt, keys, keyOpts)
+		if httpError != nil {
+			var queueFull bool
+			httpError, keysLimit, queueFull = waitForKeys(lmt, r, keys, keyOpts, httpError, keysLimit)
+			if queueFull {
+				lmt.ExecOnViolation(strings.Join(keys, "|"), lmt.RequestID(r))
+				info := infoOf(strings.Join(keys, "|"), keyOpts, 0)
+				// Every request of the key ahead in the queue needs a token first.
+				setRejectionHeaders(lmt, w, info, keyOpts.Max/float64(lmt.WaitQueueLenForKey(strings.Join(keys, "|"))+1))
+				logDecision(lmt, r, info, keyClass, keyOpts, false)
+				return httpError, info
+			}
+		}
 		if tokensLeft > keysLimit {
 			tokensLeft = keysLimit
 		}
+		lmt.ExecOnUsage(strings.Join(keys, "|"), keysLimit, keyOpts.Burst, lmt.RequestID(r))
 		if httpError != nil {
-			setRateLimitResponseHeaders(lmt, w, tokensLeft)
-			return httpError
+			lmt.ExecOnViolation(strings.Join(keys, "|"), lmt.RequestID(r))
+			httpError.Message, httpError.StatusCode = lmt.GetKeyClassResponse(keyClass)
+			strictestOpts := strictestOptions(lmt, strings.Join(keys, "|"), keyOpts)
+			info := infoOf(strings.Join(keys, "|"), strictestOpts, tokensLeft)
+			// Costly requests wait for all of their tokens.
+			setRejectionHeaders(lmt, w, info, strictestOpts.Max/float64(keyOpts.Cost))
+			logDecision(lmt, r, info, keyClass, keyOpts, false)
+			return httpError, info
 		}
+		admitted[strings.Join(keys, "|")] = keyOpts.Cost
+	}
+
+	// The service-level limit is checked last, so requests rejected by their own keys
+	// do not eat into the budget shared by everyone else. Requests it rejects do not
+	// eat into the budget of their keys either.
+	if lmt.GlobalLimitReached() {
+		refundKeys(lmt, admitted)
+		info := infoOf("", opts, 0)
+		setRejectionHeaders(lmt, w, info, lmt.GetGlobalMax())
+		message, statusCode := lmt.GetKeyClassResponse(limiter.KeyClassGlobal)
+		logDecision(lmt, r, info, limiter.KeyClassGlobal, opts, false)
+		return &errors.HTTPError{Message: message, StatusCode: statusCode}, info
+	}
+
+	var key string
+	if len(sliceKeys) > 0 {
+		key = strings.Join(sliceKeys[0], "|")
+	}
+
+	// The quota is checked after every limit, so rejected requests are not counted against it.
+	// Requests it rejects give back the tokens they took from their keys and the service-level limit.
+	if httpError := consumeQuota(lmt, w, r, quotaKey); httpError != nil {
+		tokensLeft = refundKeys(lmt, admitted)
+		lmt.RefundGlobal()
+		lmt.ExecOnViolation(key, lmt.RequestID(r))
+		info := infoOf(key, strictestOptions(lmt, key, firstKeyOpts), tokensLeft)
+		SetRateLimitHeaders(w, info)
+		logDecision(lmt, r, info, keyClass, firstKeyOpts, false)
+		return httpError, info
+	}
+
+	if lmt.GetUploadRate() > 0 && r.Body != nil && r.Body != http.NoBody {
+		r.Body = UploadReader(r.Context(), lmt, key, r.Body)
 	}
 
-	setRateLimitResponseHeaders(lmt, w, tokensLeft)
-	return nil
+	info := infoOf(key, strictestOptions(lmt, key, firstKeyOpts), tokensLeft)
+	SetRateLimitHeaders(w, info)
+	logDecision(lmt, r, info, keyClass, firstKeyOpts, true)
+	return nil, info
+}
+
+// refundKeys gives back the tokens taken from admitted, the cost of the request per key,
+// and returns the lowest number of tokens left over those keys.
+func refundKeys(lmt *limiter.Limiter, admitted map[string]int) int {
+	tokensLeft := math.MaxInt32
+	for key, cost := range admitted {
+		lmt.Refund(key, cost)
+		if tokens := lmt.Tokens(key); tokens < tokensLeft {
+			tokensLeft = tokens
+		}
+	}
+	return tokensLeft
+}
+
+// consumeQuota takes a request from the quota of key, notifies its usage, and sets X-Quota-Limit, X-Quota-Remaining
+// and X-Quota-Reset. It returns the quota exhausted response when key is over its quota,
+// and fails open when the quota store fails.
+func consumeQuota(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request, key string) *errors.HTTPError {
+	usage, exceeded, err := lmt.ConsumeQuota(r.Context(), key, 1)
+	if err != nil || usage.Allowance == 0 {
+		return nil
+	}
+
+	lmt.ExecOnQuotaUsage(key, usage, lmt.RequestID(r))
+
+	w.Header().Set("X-Quota-Limit", fmt.Sprintf("%d", usage.Allowance))
+	w.Header().Set("X-Quota-Remaining", fmt.Sprintf("%d", usage.Remaining))
+	w.Header().Set("X-Quota-Reset", fmt.Sprintf("%d", usage.ResetAt.Unix()))
+
+	if !exceeded {
+		return nil
+	}
+
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(time.Until(usage.ResetAt).Seconds()))))
+	message, statusCode := lmt.GetQuotaExhaustedResponse()
+	return &errors.HTTPError{Message: message, StatusCode: statusCode}
+}
+
+// waitForKeys lets a request rejected by keys wait for a token, when wait mode is configured on lmt.
+// It returns the outcome of the last attempt, and whether the request was rejected because the wait queue is full.
+func waitForKeys(lmt *limiter.Limiter, r *http.Request, keys []string, opts limiter.BucketOptions, httpError *errors.HTTPError, keysLimit int) (*errors.HTTPError, int, bool) {
+	if maxWait, _ := lmt.GetWaitMode(); maxWait <= 0 || opts.Max <= 0 {
+		return httpError, keysLimit, false
+	}
+
+	interval := time.Duration(float64(time.Second) / opts.Max)
+	key := strings.Join(keys, "|")
+
+	// Waiting is pointless when no token would come within the caller's budget.
+	ctx := r.Context()
+	if budget, found := waitBudget(lmt, r); found {
+		if lmt.EstimatedWait(key, interval) > budget {
+			return httpError, keysLimit, false
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
+	err := lmt.WaitTurn(ctx, key, lmt.WaitPriority(r), interval, func() bool {
+		httpError, keysLimit = limitByKeysWithOptions(lmt, keys, opts)
+		return httpError == nil
+	})
+
+	if err == limiter.ErrWaitQueueFull {
+		return &errors.HTTPError{Message: lmt.GetMessage(), StatusCode: lmt.GetStatusCode()}, 0, true
+	}
+	return httpError, keysLimit, false
+}
+
+// waitBudget returns how long the caller of r is willing to wait: the budget in the header set with
+// SetWaitBudgetHeader, or the time left before the deadline of its context, whichever is shorter.
+// It returns false when the caller set no limit.
+func waitBudget(lmt *limiter.Limiter, r *http.Request) (time.Duration, bool) {
+	budget, found := time.Duration(0), false
+	if header := lmt.GetWaitBudgetHeader(); header != "" && r.Header.Get(header) != "" {
+		budget, found = libstring.WaitBudgetFromHeader(r.Header.Get(header))
+	}
+
+	if deadline, ok := r.Context().Deadline(); ok && (!found || time.Until(deadline) < budget) {
+		budget, found = time.Until(deadline), true
+	}
+
+	return budget, found
+}
+
+// logDecision counts the outcome of r for the summary of lmt, and writes it to its decision log.
+func logDecision(lmt *limiter.Limiter, r *http.Request, info limiter.Info, keyClass limiter.KeyClass, opts limiter.BucketOptions, admitted bool) {
+	lmt.CountDecision(info.Key, admitted)
+
+	window := opts.Window
+	if window <= 0 {
+		window = time.Second
+	}
+
+	lmt.LogDecision(limiter.DecisionEvent{
+		Key:       info.Key,
+		KeyClass:  keyClass,
+		Max:       opts.Max,
+		Burst:     opts.Burst,
+		Window:    window.Seconds(),
+		Remaining: info.Remaining,
+		Admitted:  admitted,
+		RequestID: lmt.RequestID(r),
+	})
+}
+
+// infoOf describes a bucket of opts with tokensLeft, assuming it refills at opts.Max tokens per second.
+func infoOf(key string, opts limiter.BucketOptions, tokensLeft int) limiter.Info {
+	windowMax, _ := windowOf(opts)
+
+	// Keys paying back a burst loan have less than zero tokens.
+	remaining := int(math.Max(0, float64(tokensLeft)))
+
+	info := limiter.Info{Key: key, Limit: int(math.Round(windowMax)), Remaining: remaining, Window: opts.Window, ResetAt: time.Now()}
+	if missing := opts.Burst - tokensLeft; missing > 0 && opts.Max > 0 {
+		info.ResetAt = info.ResetAt.Add(time.Duration(float64(missing) / opts.Max * float64(time.Second)))
+	}
+
+	return info
+}
+
+// writeLimitReached executes the OnLimitReached callbacks and writes the rejection, unless the limiter
+// is configured to let the callbacks write the response.
+func writeLimitReached(lmt *limiter.Limiter, w http.ResponseWriter, r *http.Request, httpError *errors.HTTPError, key string) {
+	lmt.ExecOnLimitReached(w, r)
+	lmt.ExecOnLimitReachedKey(w, r, key)
+	if lmt.GetOverrideDefaultResponseWriter() {
+		return
+	}
+	w.Header().Add("Content-Type", lmt.GetMessageContentType())
+	w.WriteHeader(httpError.StatusCode)
+	w.Write(lmt.RejectionBody(httpError.Message))
 }
 
 // LimitHandler is a middleware that performs rate-limiting given http.Handler struct.
 func LimitHandler(lmt *limiter.Limiter, next http.Handler) http.Handler {
 	middle := func(w http.ResponseWriter, r *http.Request) {
-		httpError := LimitByRequest(lmt, w, r)
-		if httpError != nil {
-			lmt.ExecOnLimitReached(w, r)
-			if lmt.GetOverrideDefaultResponseWriter() {
-				return
-			}
-			w.Header().Add("Content-Type", lmt.GetMessageContentType())
-			w.WriteHeader(httpError.StatusCode)
-			w.Write([]byte(httpError.Message))
-			return
-		}
+		serveLimited(lmt, next, w, r)
+	}
+
+	return http.HandlerFunc(middle)
+}
+
+// serveLimited serves r with next, unless lmt rejects it.
+func serveLimited(lmt *limiter.Limiter, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	r = WithDecisionCache(r)
+	httpError, info := LimitByRequestWithInfo(lmt, w, r)
+	if httpError != nil {
+		writeLimitReached(lmt, w, r, httpError, info.Key)
+		return
+	}
+
+	// There's no rate-limit error, serve the next handler.
+	serveObserved(lmt, next, throttleDownload(lmt, w, r, info.Key), r, info.Key)
+}
 
-		// There's no rate-limit error, serve the next handler.
+// serveObserved serves r with next, reporting the latency and outcome to lmt when it adapts its max to them,
+// and giving the tokens of key back when lmt counts only some responses and this one is not among them.
+func serveObserved(lmt *limiter.Limiter, next http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	_, adaptive := lmt.GetAdaptive()
+	countResponse := lmt.GetCountResponse()
+	if !adaptive && countResponse == nil {
 		next.ServeHTTP(w, r)
+		return
 	}
 
-	return http.HandlerFunc(middle)
+	rw := NewResponseWriter(w)
+	start := time.Now()
+	next.ServeHTTP(rw, r)
+
+	statusCode := rw.StatusCode
+	if statusCode == 0 {
+		// Handlers writing nothing answer with 200.
+		statusCode = http.StatusOK
+	}
+
+	if adaptive {
+		lmt.ObserveResponse(time.Since(start)-pacedTime(w), statusCode >= http.StatusInternalServerError)
+	}
+	if countResponse != nil && key != "" && !countResponse(statusCode) {
+		refundOnce(lmt, r, key)
+	}
 }
 
 // LimitFuncHandler is a middleware that performs rate-limiting given request handler function.
@@ -351,7 +940,7 @@ func LimitFuncHandler(lmt *limiter.Limiter, nextFunc func(http.ResponseWriter, *
 func HTTPMiddleware(lmt *limiter.Limiter) func(http.Handler) http.Handler {
 	// // set IP lookup only if not set
 	if lmt.GetIPLookup().Name == "" {
-		lmt.SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+		lmt.SetIPLookup(limiter.IPLookup{Name: limiter.LookupRemoteAddr})
 	}
 
 	return func(next http.Handler) http.Handler {
@@ -361,14 +950,17 @@ func HTTPMiddleware(lmt *limiter.Limiter) func(http.Handler) http.Handler {
 				http.Error(w, "Context was canceled", http.StatusServiceUnavailable)
 				return
 			default:
-				if httpError := LimitByRequest(lmt, w, r); httpError != nil {
+				r = WithDecisionCache(r)
+				httpError, info := LimitByRequestWithInfo(lmt, w, r)
+				if httpError != nil {
 					lmt.ExecOnLimitReached(w, r)
+					lmt.ExecOnLimitReachedKey(w, r, info.Key)
 					w.Header().Add("Content-Type", lmt.GetMessageContentType())
 					w.WriteHeader(httpError.StatusCode)
-					w.Write([]byte(httpError.Message)) //nolint:gosec // not much we can do here with failed write
+					w.Write(lmt.RejectionBody(httpError.Message)) //nolint:gosec // not much we can do here with failed write
 					return
 				}
-				next.ServeHTTP(w, r)
+				serveObserved(lmt, next, throttleDownload(lmt, w, r, info.Key), r, info.Key)
 			}
 		})
 	}
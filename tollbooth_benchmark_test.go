@@ -50,3 +50,28 @@ func BenchmarkBuildKeys(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkLimitHandlerRejected(b *testing.B) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "127.0.0.1:12345"
+	handler.ServeHTTP(discardResponseWriter{header: http.Header{}}, request)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(discardResponseWriter{header: http.Header{}}, request)
+	}
+}
+
+// discardResponseWriter discards the response, so only the allocations of the middleware are measured.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header { return w.header }
+
+func (w discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w discardResponseWriter) WriteHeader(int) {}
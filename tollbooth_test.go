@@ -2,8 +2,14 @@ package tollbooth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -787,3 +793,2071 @@ func TestHTTPMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestBodyKeyFieldsBuildKeys(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{
+			Name:           "X-Real-IP",
+			IndexFromRight: 0,
+		}).
+		SetBodyKeyFields([]string{"account_id"})
+
+	body := `{"name": "widget", "account_id": 42, "tags": ["a", "b"]}`
+
+	request, err := http.NewRequest("POST", "/", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("Unable to create new HTTP request. Error: %v", err)
+	}
+
+	request.Header.Set("X-Real-IP", "172.217.0.46")
+	request.Header.Set("Content-Type", "application/json")
+
+	for _, keys := range BuildKeys(lmt, request) {
+		expectedKeys := [][]string{
+			{request.Header.Get("X-Real-IP")},
+			{request.URL.Path},
+			{"account_id"},
+			{"42"},
+		}
+
+		checkKeys(t, keys, expectedKeys)
+	}
+
+	// The next handler should still be able to read the full body.
+	replayed, err := io.ReadAll(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(replayed) != body {
+		t.Errorf("Body was not preserved. Body: %v", string(replayed))
+	}
+}
+
+func TestBodyKeyFieldsFormBuildKeys(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{
+			Name:           "X-Real-IP",
+			IndexFromRight: 0,
+		}).
+		SetBodyKeyFields([]string{"account_id"}).
+		SetBodyReadLimit(20)
+
+	body := "account_id=abc&comment=" + strings.Repeat("x", 100)
+
+	request, err := http.NewRequest("POST", "/", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("Unable to create new HTTP request. Error: %v", err)
+	}
+
+	request.Header.Set("X-Real-IP", "172.217.0.46")
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for _, keys := range BuildKeys(lmt, request) {
+		expectedKeys := [][]string{
+			{request.Header.Get("X-Real-IP")},
+			{request.URL.Path},
+			{"account_id"},
+			{"abc"},
+		}
+
+		checkKeys(t, keys, expectedKeys)
+	}
+
+	if err := request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.PostForm.Get("comment")) != 100 {
+		t.Errorf("Body was not preserved. Comment: %v", request.PostForm.Get("comment"))
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIgnoreURL(true).
+		SetPathLimits(map[string]float64{"/static/": 3})
+
+	handler := HTTPMiddleware(lmt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i, path := range []string{"/static/a.css", "/static/b.js", "/static/c.png"} {
+		if rr := request(path); rr.Code != http.StatusOK {
+			t.Errorf("request %d to %s: expected status %d, got %d", i, path, http.StatusOK, rr.Code)
+		}
+	}
+
+	if rr := request("/static/d.png"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// Other paths use their own bucket with the limiter-wide max.
+	rr := request("/search")
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if value := rr.Header().Get("RateLimit-Limit"); value != "1" {
+		t.Errorf("RateLimit-Limit has wrong value: got %s want %v", value, "1")
+	}
+	if rr := request("/search"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestMethodLimits(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetMethodLimits(map[string]float64{"get": 3, http.MethodPost: 1})
+
+	handler := HTTPMiddleware(lmt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(method string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/items", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := request(http.MethodGet); rr.Code != http.StatusOK {
+			t.Errorf("GET request %d: expected status %d, got %d", i, http.StatusOK, rr.Code)
+		}
+	}
+	if rr := request(http.MethodGet); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// POST has its own bucket, untouched by the GET requests.
+	rr := request(http.MethodPost)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if value := rr.Header().Get("RateLimit-Limit"); value != "1" {
+		t.Errorf("RateLimit-Limit has wrong value: got %s want %v", value, "1")
+	}
+	if rr := request(http.MethodPost); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestRefundClientErrors(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetBurst(2).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	handler := RefundClientErrors(lmt, LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	request := func(target string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := request("/items"); code != http.StatusBadRequest {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusBadRequest, code)
+		}
+	}
+
+	// The failed requests were refunded, the whole burst is left.
+	for i := 0; i < 2; i++ {
+		if code := request("/items?name=a"); code != http.StatusOK {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusOK, code)
+		}
+	}
+	if code := request("/items?name=a"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestCountResponse(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetBurst(2).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetCountResponse(limiter.CountStatuses(http.StatusUnauthorized))
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(target string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Successful logins do not count.
+	for i := 0; i < 5; i++ {
+		if code := request("/login?password=secret"); code != http.StatusOK {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusOK, code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := request("/login?password=guess"); code != http.StatusUnauthorized {
+			t.Errorf("request %d: expected status %d, got %d", i, http.StatusUnauthorized, code)
+		}
+	}
+	if code := request("/login?password=secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Failed logins should spend the budget. Expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestCountResponseRefundsOnce(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Nested middlewares of the same limiter, and RefundClientErrors, must give the tokens back only once.
+	for name, middleware := range map[string]func(*limiter.Limiter) http.Handler{
+		"nested":        func(lmt *limiter.Limiter) http.Handler { return LimitHandler(lmt, LimitHandler(lmt, next)) },
+		"refund errors": func(lmt *limiter.Limiter) http.Handler { return RefundClientErrors(lmt, LimitHandler(lmt, next)) },
+		"chain":         func(lmt *limiter.Limiter) http.Handler { return Chain(lmt, lmt)(next) },
+	} {
+		handler := middleware(NewLimiter(1, nil).
+			SetBurst(3).
+			SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+			SetCountResponse(limiter.CountStatuses(http.StatusOK)))
+
+		request := func(path string) int {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			handler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		for i := 0; i < 2; i++ {
+			request("/items")
+		}
+		if code := request("/items?id=1"); code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusNotFound, code)
+		}
+		if code := request("/items"); code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusOK, code)
+		}
+		if code := request("/items"); code != http.StatusTooManyRequests {
+			t.Errorf("%s: uncounted response should be refunded once. Expected status %d, got %d", name, http.StatusTooManyRequests, code)
+		}
+	}
+}
+
+func TestRejectionHeadersNotShared(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	lmt.SetOnLimitReached(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header()["Ratelimit-Limit"][0] = "tampered"
+	})
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		handler.ServeHTTP(rr, req)
+
+		if i > 0 && rr.Header().Get("RateLimit-Limit") != "tampered" {
+			t.Fatalf("expected the callback to change the header, got %q", rr.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	if header := lmt.RejectionHeader(limiter.Info{Limit: 1, Window: lmt.GetWindow()}); header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("expected the cached header to be left alone, got %q", header.Get("RateLimit-Limit"))
+	}
+}
+
+func TestGlobalMax(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetGlobalMax(2)
+
+	handler := HTTPMiddleware(lmt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := request("10.0.0.1:1234"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Rejected by its own key, must not consume the global budget.
+	if code := request("10.0.0.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+
+	if code := request("10.0.0.2:1234"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Fresh key, but the service-level limit is exhausted.
+	if code := request("10.0.0.3:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Rejected by the service-level limit, must not consume the budget of its key.
+	if tokens := lmt.Tokens("10.0.0.3|/|"); tokens != 1 {
+		t.Errorf("expected the key to keep 1 token, got %d", tokens)
+	}
+}
+
+func TestForRoute(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	search := LimitHandler(lmt.ForRoute("search"), next)
+	searchV2 := LimitHandler(lmt.ForRoute("search"), next)
+	export := LimitHandler(lmt.ForRoute("export"), next)
+
+	request := func(handler http.Handler, path string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := request(search, "/search"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Same route name, so the budget is pooled even though the path differs.
+	if code := request(searchV2, "/v2/search"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Different route name, so the budget is split.
+	if code := request(export, "/export"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestSkipPreflight(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetSkipPreflight(true)
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/", nil)
+	preflight.RemoteAddr = "127.0.0.1:12345"
+	preflight.Header.Set("Origin", "https://example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+
+	if !ShouldSkipLimiter(lmt, preflight) {
+		t.Error("CORS preflight should skip the limiter.")
+	}
+
+	// A plain OPTIONS request is still limited.
+	preflight.Header.Del("Access-Control-Request-Method")
+	if ShouldSkipLimiter(lmt, preflight) {
+		t.Error("OPTIONS without preflight headers should not skip the limiter.")
+	}
+
+	lmt.SetSkipPreflight(false)
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	if ShouldSkipLimiter(lmt, preflight) {
+		t.Error("CORS preflight should be limited when SkipPreflight is disabled.")
+	}
+}
+
+func TestExcludedPaths(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetExcludedPaths([]string{"/healthz", "/metrics"})
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("request %d: expected status %d, got %d", i+1, http.StatusOK, rr.Code)
+		}
+	}
+}
+
+func TestBypassTokenSkipsLimiter(t *testing.T) {
+	secret := []byte("top-secret")
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetBypassSecret(secret)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	if ShouldSkipLimiter(lmt, req) {
+		t.Error("Request without bypass token should not skip the limiter.")
+	}
+
+	req.Header.Set(limiter.BypassHeader, limiter.NewBypassToken(secret, time.Now().Add(time.Minute)))
+	if !ShouldSkipLimiter(lmt, req) {
+		t.Error("Request with valid bypass token should skip the limiter.")
+	}
+}
+
+func TestMeshIdentityBuildKeys(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMeshIdentityHeader("X-Forwarded-Client-Cert")
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	if ShouldSkipLimiter(lmt, request) {
+		t.Error("Request without a peer identity should not skip the limiter.")
+	}
+
+	for _, keys := range BuildKeys(lmt, request) {
+		expectedKeys := [][]string{
+			{"10.1.2.3"},
+			{request.URL.Path},
+		}
+
+		checkKeys(t, keys, expectedKeys)
+	}
+
+	request.Header.Set("X-Forwarded-Client-Cert", "Hash=abc;URI=spiffe://cluster.local/ns/default/sa/web")
+	if ShouldSkipLimiter(lmt, request) {
+		t.Error("Request with a peer identity should not skip the limiter.")
+	}
+
+	for _, keys := range BuildKeys(lmt, request) {
+		expectedKeys := [][]string{
+			{"spiffe://cluster.local/ns/default/sa/web"},
+			{request.URL.Path},
+		}
+
+		checkKeys(t, keys, expectedKeys)
+	}
+}
+
+func TestClientIDResolverBuildKeys(t *testing.T) {
+	resolved := 0
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetClientIDResolver(func(_ context.Context, bearerToken string) (string, error) {
+			resolved++
+			if bearerToken == "valid-token" {
+				return "billing-app", nil
+			}
+			return "", errors.New("inactive token")
+		})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	for _, token := range []string{"", "Bearer expired-token"} {
+		request.Header.Set("Authorization", token)
+		for _, keys := range BuildKeys(lmt, request) {
+			checkKeys(t, keys, [][]string{{"10.1.2.3"}, {request.URL.Path}})
+		}
+	}
+
+	request.Header.Set("Authorization", "Bearer valid-token")
+	for i := 0; i < 2; i++ {
+		for _, keys := range BuildKeys(lmt, request) {
+			checkKeys(t, keys, [][]string{{"billing-app"}, {request.URL.Path}})
+		}
+	}
+
+	if resolved != 2 {
+		t.Errorf("Every token should be resolved once, then cached. Resolved: %v", resolved)
+	}
+}
+
+func TestNewLimiterPerPeriod(t *testing.T) {
+	lmt := NewLimiterPerHour(3600)
+	if lmt.GetMax() != 1 || lmt.GetBurst() != 3600 {
+		t.Errorf("Per hour limiter is incorrect. Max: %v, Burst: %v", lmt.GetMax(), lmt.GetBurst())
+	}
+
+	lmt = NewLimiterPerMinute(2)
+	for i := 0; i < 2; i++ {
+		if httpError := LimitByKeys(lmt, []string{"127.0.0.1"}); httpError != nil {
+			t.Errorf("Request %d should not be limited.", i+1)
+		}
+	}
+	if httpError := LimitByKeys(lmt, []string{"127.0.0.1"}); httpError == nil {
+		t.Error("Third request within a minute should be limited.")
+	}
+
+	lmt = NewLimiterPerDay(0)
+	if lmt.GetMax() != 0 || lmt.GetBurst() != 1 {
+		t.Errorf("Per day limiter is incorrect. Max: %v, Burst: %v", lmt.GetMax(), lmt.GetBurst())
+	}
+}
+
+func TestSetRateHeaders(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetRate(100, 15*time.Minute)
+
+	handler := HTTPMiddleware(lmt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handler.ServeHTTP(rr, req)
+
+	for header, expected := range map[string]string{
+		"X-Rate-Limit-Limit":    "100.00",
+		"X-Rate-Limit-Duration": "900",
+		"RateLimit-Limit":       "100",
+		"RateLimit-Reset":       "900",
+		"RateLimit-Remaining":   "99",
+	} {
+		if value := rr.Header().Get(header); value != expected {
+			t.Errorf("%s has wrong value: got %s want %v", header, value, expected)
+		}
+	}
+}
+
+func TestWildcardHeadersBuildKeys(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetHeader("X-Client", []string{"mobile-*"}).
+		SetHeaderMatcher("X-Version", func(value string) (string, bool) {
+			major, _, _ := strings.Cut(value, ".")
+			return major, major != ""
+		})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+	request.Header.Set("X-Client", "mobile-android")
+	request.Header.Set("X-Version", "2.7.1")
+
+	if ShouldSkipLimiter(lmt, request) {
+		t.Error("Request matching wildcard header value should not skip the limiter.")
+	}
+
+	for _, keys := range BuildKeys(lmt, request) {
+		checkKeys(t, keys, [][]string{{"10.1.2.3"}, {request.URL.Path}, {"mobile-*"}, {"2"}})
+	}
+
+	request.Header.Set("X-Client", "desktop")
+	request.Header.Del("X-Version")
+	if !ShouldSkipLimiter(lmt, request) {
+		t.Error("Request not matching any header value should skip the limiter.")
+	}
+}
+
+type testContextKey string
+
+func TestContextKeysBuildKeys(t *testing.T) {
+	tenantKey := testContextKey("tenant")
+	roleKey := testContextKey("role")
+
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetContextKeys(tenantKey, roleKey)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	ctx := context.WithValue(request.Context(), roleKey, "admin")
+	ctx = context.WithValue(ctx, tenantKey, "acme")
+	request = request.WithContext(ctx)
+
+	sliceKeys := BuildKeys(lmt, request)
+	expected := []string{"10.1.2.3", "/", "tenant", "acme", "role", "admin", ""}
+
+	if strings.Join(sliceKeys[0], "|") != strings.Join(expected, "|") {
+		t.Errorf("Keys should follow the configured context key order. Keys: %v", sliceKeys[0])
+	}
+}
+
+func TestPriorityPools(t *testing.T) {
+	lmt := NewLimiter(10, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetPriorityPools(limiter.PriorityPools{
+			Shares:  map[string]float64{"interactive": 0.8, "batch": 0.2},
+			Default: "interactive",
+			Select:  limiter.PoolFromHeader("X-Priority"),
+		})
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	countAllowed := func(priority string) int {
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			req.Header.Set("X-Priority", priority)
+			handler.ServeHTTP(rr, req)
+			if rr.Code == http.StatusOK {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	if allowed := countAllowed("batch"); allowed != 2 {
+		t.Errorf("Batch pool should allow 2 requests, allowed %d.", allowed)
+	}
+
+	// Unknown priorities use the default pool, and batch traffic did not eat into it.
+	if allowed := countAllowed("unknown"); allowed != 8 {
+		t.Errorf("Interactive pool should allow 8 requests, allowed %d.", allowed)
+	}
+
+	// A default pool missing from the shares leaves unknown priorities unpooled, rather than rejecting them all.
+	lmt.SetPriorityPools(limiter.PriorityPools{
+		Shares:  map[string]float64{"batch": 0.2},
+		Default: "interactive",
+		Select:  limiter.PoolFromHeader("X-Priority"),
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Priority", "unknown")
+	if _, _, found := lmt.PriorityPoolForRequest(req); found {
+		t.Error("Unknown default pool should leave requests unpooled.")
+	}
+}
+
+func TestIPv6CanonicalizationBuildKeys(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "X-Real-IP"}).
+		SetIPv6Canonicalization(limiter.IPv6CanonicalizationOff)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	for _, keys := range BuildKeys(lmt, request) {
+		checkKeys(t, keys, [][]string{{"2601:7:1c82:4097:59a0:a80b:2841:b8c8"}, {request.URL.Path}})
+	}
+
+	lmt.SetIPv6Canonicalization(limiter.IPv6Prefix(48))
+	for _, keys := range BuildKeys(lmt, request) {
+		checkKeys(t, keys, [][]string{{"2601:7:1c82::"}, {request.URL.Path}})
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	lmt := NewLimiter(0.5, nil)
+
+	handler := HTTPMiddleware(lmt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "127.0.0.1:12345"
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if value := rr.Header().Get("Retry-After"); value != "" {
+		t.Errorf("Retry-After should only be set on rejections: got %s", value)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	if value := rr.Header().Get("Retry-After"); value != "2" {
+		t.Errorf("Retry-After has wrong value: got %s want %v", value, "2")
+	}
+
+	lmt.SetRetryAfterJitter(3 * time.Second)
+
+	for i := 0; i < 20; i++ {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+		if err != nil || retryAfter < 2 || retryAfter > 5 {
+			t.Errorf("Retry-After with jitter is out of bounds: got %v", rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestOnLimitReachedKey(t *testing.T) {
+	var onLimitReachedCalled bool
+	var rejectedKey string
+
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMethods([]string{"GET"}).
+		SetOnLimitReached(func(http.ResponseWriter, *http.Request) { onLimitReachedCalled = true }).
+		SetOnLimitReachedKey(func(_ http.ResponseWriter, _ *http.Request, key string) { rejectedKey = key })
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/accounts", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if rejectedKey != "" {
+		t.Errorf("Key callback should not run for admitted requests. Key: %v", rejectedKey)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if !onLimitReachedCalled || rejectedKey != "10.1.2.3|/accounts|GET|" {
+		t.Errorf("Key callback should receive the rejected key. Key: %v", rejectedKey)
+	}
+}
+
+func TestKeyClassResponse(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetHeader("X-API-Key", nil).
+		SetKeyClassResponse(limiter.KeyClassHeader, "API key quota exceeded, see https://example.com/docs/limits.", http.StatusForbidden)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+	request.Header.Set("X-API-Key", "integrator")
+
+	LimitByRequest(lmt, httptest.NewRecorder(), request)
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), request); httpError == nil ||
+		httpError.StatusCode != http.StatusForbidden || httpError.Message != "API key quota exceeded, see https://example.com/docs/limits." {
+		t.Errorf("Header keys should get their own response. Error: %v", httpError)
+	}
+
+	lmt = NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetGlobalMax(1).
+		SetKeyClassResponse(limiter.KeyClassGlobal, "The service is busy.", http.StatusServiceUnavailable)
+
+	LimitByRequest(lmt, httptest.NewRecorder(), request)
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), request); httpError == nil ||
+		httpError.StatusCode != http.StatusServiceUnavailable || httpError.Message != "The service is busy." {
+		t.Errorf("Service-level limit should get its own response. Error: %v", httpError)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetRequestIDHeader("X-Request-Id")
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+	request.Header.Set("X-Request-Id", "req-42")
+
+	if requestID := lmt.RequestID(request); requestID != "req-42" {
+		t.Errorf("RequestID is incorrect. Value: %v", requestID)
+	}
+
+	rr := httptest.NewRecorder()
+	LimitByRequest(lmt, rr, request)
+
+	if value := rr.Header().Get("X-Rate-Limit-Request-Id"); value != "req-42" {
+		t.Errorf("X-Rate-Limit-Request-Id has wrong value: got %s want %v", value, "req-42")
+	}
+}
+
+func TestUsageNotifier(t *testing.T) {
+	events := make(chan limiter.UsageEvent, 10)
+
+	lmt := NewLimiter(0.001, nil).
+		SetBurst(10).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetRequestIDHeader("X-Request-Id").
+		SetUsageNotifier(func(event limiter.UsageEvent) { events <- event }, time.Hour, 0.8, 1)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+	request.Header.Set("X-Request-Id", "req-42")
+
+	for i := 0; i < 12; i++ {
+		LimitByRequest(lmt, httptest.NewRecorder(), request)
+	}
+
+	thresholds := map[float64]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event.Key != "10.1.2.3|/|" || event.RequestID != "req-42" {
+				t.Errorf("Usage event is incorrect. Value: %+v", event)
+			}
+			thresholds[event.Threshold] = true
+		case <-time.After(time.Second):
+			t.Fatal("Using up thresholds of the bucket should notify.")
+		}
+	}
+
+	if !thresholds[0.8] || !thresholds[1] {
+		t.Errorf("Both thresholds should notify. Value: %v", thresholds)
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("Notifications should be debounced. Value: %+v", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestQuotaUsageNotifier(t *testing.T) {
+	events := make(chan limiter.UsageEvent, 10)
+
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetUsageNotifier(func(event limiter.UsageEvent) { events <- event }, time.Hour, 0.8)
+	if err := lmt.SetQuota(limiter.Quota{Allowance: 5, Period: limiter.QuotaDaily}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	// The bucket holds 100 tokens, only the quota is used up to 80%.
+	for i := 0; i < 4; i++ {
+		LimitByRequest(lmt, httptest.NewRecorder(), request)
+	}
+
+	select {
+	case event := <-events:
+		if !event.Quota || event.Tokens != 1 || event.Burst != 5 || event.Threshold != 0.8 {
+			t.Errorf("Usage event should describe the quota. Value: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Using up thresholds of the quota should notify.")
+	}
+}
+
+func TestViolationAlert(t *testing.T) {
+	alerts := make(chan limiter.ViolationAlert, 10)
+
+	lmt := NewLimiter(0.001, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetViolationAlert(func(alert limiter.ViolationAlert) { alerts <- alert }, 3, time.Minute)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	// 1 admitted request, then 3 rejections which are tolerated.
+	for i := 0; i < 4; i++ {
+		LimitByRequest(lmt, httptest.NewRecorder(), request)
+	}
+
+	select {
+	case alert := <-alerts:
+		t.Errorf("Rejections up to the threshold should not alert. Value: %+v", alert)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for i := 0; i < 5; i++ {
+		LimitByRequest(lmt, httptest.NewRecorder(), request)
+	}
+
+	select {
+	case alert := <-alerts:
+		if alert.Key != "10.1.2.3|/|" || alert.Count != 4 || alert.Window != time.Minute {
+			t.Errorf("Violation alert is incorrect. Value: %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Exceeding the rejections should alert.")
+	}
+
+	select {
+	case alert := <-alerts:
+		t.Errorf("Alerts should fire once per window. Value: %+v", alert)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestLimitByRequestWithInfo(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetBurst(2).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.1.2.3:12345"
+
+	httpError, info := LimitByRequestWithInfo(lmt, httptest.NewRecorder(), request)
+	if httpError != nil || info.Key != "10.1.2.3|/|" || info.Limit != 1 || info.Remaining != 1 {
+		t.Errorf("Info is incorrect. Error: %v, Value: %+v", httpError, info)
+	}
+
+	if reset := time.Until(info.ResetAt); reset <= 0 || reset > time.Second {
+		t.Errorf("One missing token should be back within a second. Reset: %v", reset)
+	}
+
+	LimitByRequestWithInfo(lmt, httptest.NewRecorder(), request)
+
+	httpError, info = LimitByRequestWithInfo(lmt, httptest.NewRecorder(), request)
+	if httpError == nil || info.Key != "10.1.2.3|/|" || info.Remaining != 0 {
+		t.Errorf("Info is incorrect. Error: %v, Value: %+v", httpError, info)
+	}
+
+	if reset := time.Until(info.ResetAt); reset <= time.Second || reset > 2*time.Second {
+		t.Errorf("Two missing tokens should be back within two seconds. Reset: %v", reset)
+	}
+}
+
+func TestTokenBucketTTLFunc(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetTokenBucketExpirationTTL(time.Minute).
+		SetTokenBucketTTLFunc(func(r *http.Request) time.Duration {
+			if r.Header.Get("X-Plan") == "paid" {
+				return time.Hour
+			}
+			return 0
+		})
+
+	free := httptest.NewRequest(http.MethodGet, "/", nil)
+	free.RemoteAddr = "10.1.2.3:12345"
+	LimitByRequest(lmt, httptest.NewRecorder(), free)
+
+	paid := httptest.NewRequest(http.MethodGet, "/", nil)
+	paid.RemoteAddr = "10.1.2.4:12345"
+	paid.Header.Set("X-Plan", "paid")
+	LimitByRequest(lmt, httptest.NewRecorder(), paid)
+
+	if state, _ := lmt.InspectKey("10.1.2.3|/|"); state.TTL > time.Minute {
+		t.Errorf("Free tier should keep the limiter-wide TTL. TTL: %v", state.TTL)
+	}
+
+	if state, _ := lmt.InspectKey("10.1.2.4|/|"); state.TTL <= time.Minute {
+		t.Errorf("Paid tier should get its own TTL. TTL: %v", state.TTL)
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	rr := httptest.NewRecorder()
+	SetRateLimitHeaders(rr, limiter.Info{Limit: 100, Remaining: 42, Window: 15 * time.Minute})
+
+	for header, expected := range map[string]string{
+		"RateLimit-Limit":     "100",
+		"RateLimit-Reset":     "900",
+		"RateLimit-Remaining": "42",
+		"RateLimit-Policy":    "100;w=900",
+	} {
+		if value := rr.Header().Get(header); value != expected {
+			t.Errorf("%s has wrong value: got %s want %v", header, value, expected)
+		}
+	}
+}
+
+func TestReadWriteLimits(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	if err := lmt.SetReadWriteLimits(
+		limiter.Rate{Max: 100, Per: time.Second, Burst: 100},
+		limiter.Rate{Max: 1, Per: time.Minute, Burst: 1},
+	); err != nil {
+		t.Fatalf("Valid rates should be accepted. Error: %v", err)
+	}
+
+	request := func(method string) *http.Request {
+		r := httptest.NewRequest(method, "/accounts", nil)
+		r.RemoteAddr = "10.1.2.3:12345"
+		return r
+	}
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), request(http.MethodPost)); httpError != nil {
+		t.Errorf("First write should be admitted. Error: %v", httpError)
+	}
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), request(http.MethodDelete)); httpError == nil {
+		t.Error("Second write should be limited.")
+	}
+
+	// Reads have their own budget.
+	for i := 0; i < 10; i++ {
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), request(http.MethodGet)); httpError != nil {
+			t.Errorf("Reads should not be limited by writes. Error: %v", httpError)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	LimitByRequest(lmt, rr, request(http.MethodPut))
+	if value := rr.Header().Get("RateLimit-Reset"); value != "60" {
+		t.Errorf("RateLimit-Reset should follow the write window: got %s", value)
+	}
+}
+
+func TestSkipFunc(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetSkipFunc(func(r *http.Request) bool { return r.URL.Query().Get("preview") == "1" })
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?preview=1", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("request %d: expected status %d, got %d", i+1, http.StatusOK, rr.Code)
+		}
+	}
+
+	if _, found := lmt.InspectKey("127.0.0.1|/|"); found {
+		t.Error("Exempted requests should not create a bucket.")
+	}
+}
+
+func TestUploadRate(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetUploadRate(100000)
+
+	var read int64
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 150000)))
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The first second of bytes is available at once, the rest is paced.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Upload should be paced. Elapsed: %v", elapsed)
+	}
+
+	if read != 150000 {
+		t.Errorf("The whole body should be read. Read: %v", read)
+	}
+}
+
+func TestDownloadRate(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetDownloadRate(100000)
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Paced writer should pass Flush through.")
+		}
+		w.Write([]byte(strings.Repeat("x", 150000)))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/download", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	handler.ServeHTTP(rr, req)
+
+	// The first second of bytes is available at once, the rest is paced.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Download should be paced. Elapsed: %v", elapsed)
+	}
+
+	if rr.Body.Len() != 150000 {
+		t.Errorf("The whole response should be written. Written: %v", rr.Body.Len())
+	}
+
+	// Requests which skip the limiter are not paced.
+	lmt.SetExcludedPaths([]string{"/healthz"})
+	req = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	start = time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Requests skipping the limiter should not be paced. Elapsed: %v", elapsed)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMaxRequestsPerConn(2)
+
+	server := httptest.NewUnstartedServer(LimitFuncHandler(lmt, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for i, expected := range []bool{false, true, false} {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		// The counter starts over on the new connection.
+		if resp.Close != expected {
+			t.Errorf("Request %v should close the connection: %v.", i+1, expected)
+		}
+	}
+}
+
+func TestMaxQueueTime(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMaxQueueTime(time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("X-Request-Start", fmt.Sprintf("t=%d", time.Now().Add(-5*time.Second).UnixMilli()))
+
+	httpError := LimitByRequest(lmt, httptest.NewRecorder(), req)
+	if httpError == nil || httpError.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Requests queued for too long should be rejected with 503. Got: %v", httpError)
+	}
+
+	if _, found := lmt.InspectKey("127.0.0.1|/|"); found {
+		t.Error("Requests queued for too long should not spend tokens.")
+	}
+
+	req.Header.Set("X-Request-Start", fmt.Sprintf("t=%d", time.Now().UnixMilli()))
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("Fresh requests should be limited as usual. Got: %v", httpError)
+	}
+}
+
+func TestClientRateHeader(t *testing.T) {
+	lmt := NewLimiter(5, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetClientRateHeader("X-Recommended-Rate")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	LimitByRequest(lmt, rr, req)
+
+	if value := rr.Header().Get("X-Recommended-Rate"); value != "5.00" {
+		t.Errorf("X-Recommended-Rate has wrong value: got %s want %v", value, "5.00")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	header := http.Header{}
+	header.Set("RateLimit-Policy", "100;w=60, 1000;w=3600")
+
+	policy, ok := ParsePolicy(header)
+	if !ok || policy.Limit != 100 || policy.Window != time.Minute {
+		t.Errorf("First policy should be parsed. Got: %+v", policy)
+	}
+
+	header.Set("RateLimit-Policy", "plenty")
+	if _, ok := ParsePolicy(header); ok {
+		t.Error("Invalid policies should not be parsed.")
+	}
+}
+
+func TestClientTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Recommended-Rate", "5.00")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &ClientTransport{RateHeader: "X-Recommended-Rate"}}
+
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// The first request teaches the rate, the next 5 use the burst and the last one waits.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Client should pace itself with the advertised rate. Elapsed: %v", elapsed)
+	}
+}
+
+func TestChain(t *testing.T) {
+	perIP := NewLimiter(5, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	if err := perIP.SetQuota(limiter.Quota{Allowance: 100, Period: limiter.QuotaDaily}); err != nil {
+		t.Fatal(err)
+	}
+	global := NewLimiter(2, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).SetMessage("Service is busy.")
+
+	handler := Chain(perIP, global)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, expected := range []struct {
+		status    int
+		limit     string
+		remaining string
+	}{
+		{http.StatusOK, "2", "1"},
+		{http.StatusOK, "2", "0"},
+		{http.StatusTooManyRequests, "2", "0"},
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != expected.status {
+			t.Errorf("Request %v should get status %v. Got: %v", i+1, expected.status, rr.Code)
+		}
+		if rr.Header().Get("RateLimit-Limit") != expected.limit || rr.Header().Get("RateLimit-Remaining") != expected.remaining {
+			t.Errorf("Request %v should get the headers of the strictest limiter. Got: %v", i+1, rr.Header())
+		}
+		if rr.Header().Get("X-Quota-Limit") != "100" {
+			t.Errorf("Request %v should get the quota headers of the first limiter. Got: %v", i+1, rr.Header())
+		}
+	}
+
+	// The rejection came from the last limiter, after the first one spent a token each time.
+	if state, _ := perIP.InspectKey("127.0.0.1|/|"); state.Tokens > 2.1 {
+		t.Errorf("Every limiter before the rejecting one should spend a token. Tokens: %v", state.Tokens)
+	}
+}
+
+func TestScheduledLimit(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetClock(func() time.Time { return now })
+
+	if err := lmt.SetScheduledLimit(
+		limiter.Schedule{Name: "business-hours", Start: 9 * time.Hour, End: 17 * time.Hour, Location: time.UTC},
+		limiter.Rate{Max: 1, Per: time.Second, Burst: 1},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	if keys := BuildKeys(lmt, req); strings.Join(keys[0], "|") != "127.0.0.1|/|business-hours|" {
+		t.Errorf("The schedule should get its own bucket. Keys: %v", keys)
+	}
+
+	LimitByRequest(lmt, httptest.NewRecorder(), req)
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError == nil {
+		t.Error("The stricter limit should apply during business hours.")
+	}
+
+	now = now.Add(8 * time.Hour)
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("The limiter-wide limit should apply after business hours. Got: %v", httpError)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMaintenance(1, "Back soon.")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	for i := 0; i < 3; i++ {
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+			t.Fatalf("Maintenance mode should be off by default. Got: %v", httpError)
+		}
+	}
+
+	lmt.SetMaintenanceMode(true)
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("The trickle should get through. Got: %v", httpError)
+	}
+
+	httpError := LimitByRequest(lmt, httptest.NewRecorder(), req)
+	if httpError == nil || httpError.StatusCode != http.StatusServiceUnavailable || httpError.Message != "Back soon." {
+		t.Errorf("Traffic above the trickle should get the maintenance message with 503. Got: %v", httpError)
+	}
+
+	lmt.SetMaintenanceMode(false)
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("Traffic should be limited as usual after maintenance. Got: %v", httpError)
+	}
+}
+
+func TestCanaryLimit(t *testing.T) {
+	lmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	if err := lmt.SetCanaryLimit(limiter.Rate{Max: 1, Per: time.Second, Burst: 1}, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	canaried := 0
+	for i := 1; i <= 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:12345", i)
+
+		LimitByRequest(lmt, httptest.NewRecorder(), req)
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+			canaried++
+		}
+	}
+
+	if canaried < 30 || canaried > 70 {
+		t.Errorf("About half of the keys should get the canary rate. Canaried: %v", canaried)
+	}
+}
+
+func TestCanaryLimitKeepsPathLimits(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetPathLimits(map[string]float64{"/login": 1})
+
+	if err := lmt.SetCanaryLimit(limiter.Rate{Max: 50, Per: time.Second, Burst: 50}, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(path string) bool {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		return LimitByRequest(lmt, httptest.NewRecorder(), req) == nil
+	}
+
+	// The canary replaces the limiter-wide rate.
+	for i := 0; i < 3; i++ {
+		if !request("/search") {
+			t.Fatalf("Request %d should get the canary rate.", i+1)
+		}
+	}
+
+	// The strict limit of the path still applies to keys in the canary.
+	if !request("/login") {
+		t.Fatal("The first request should be admitted.")
+	}
+	if request("/login") {
+		t.Error("The path limit should apply on top of the canary rate.")
+	}
+}
+
+func TestIPFamilyLimits(t *testing.T) {
+	lmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	if err := lmt.SetIPFamilyLimits(
+		limiter.Rate{Max: 3, Per: time.Second, Burst: 3},
+		limiter.Rate{Max: 1, Per: time.Second, Burst: 1},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for remoteAddr, burst := range map[string]int{"10.1.2.3:12345": 3, "[2001:db8::1]:12345": 1} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+
+		for i := 0; i < burst; i++ {
+			if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+				t.Errorf("%v should be allowed %v requests. Got: %v", remoteAddr, burst, httpError)
+			}
+		}
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError == nil {
+			t.Errorf("%v should be rejected after %v requests.", remoteAddr, burst)
+		}
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	var log strings.Builder
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetDecisionLog(&log, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	LimitByRequest(lmt, httptest.NewRecorder(), req)
+	LimitByRequest(lmt, httptest.NewRecorder(), req)
+
+	expected := []string{
+		`"key":"127.0.0.1|/|","key_class":"ip","max":1,"burst":1,"window_seconds":1,"remaining":0,"admitted":true`,
+		`"key":"127.0.0.1|/|","key_class":"ip","max":1,"burst":1,"window_seconds":1,"remaining":0,"admitted":false`,
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Every decision should be logged. Log: %v", log.String())
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Errorf("Decision %v is not logged correctly. Got: %v", i+1, line)
+		}
+	}
+}
+
+func TestSwappableHandler(t *testing.T) {
+	old := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	strict := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := NewSwappableHandler(old, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		return req
+	}
+
+	go handler.ServeHTTP(httptest.NewRecorder(), newRequest("/slow"))
+	<-started
+
+	swapped := make(chan error, 1)
+	go func() {
+		_, err := handler.Swap(context.Background(), strict)
+		swapped <- err
+	}()
+
+	for handler.Limiter() != strict {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newRequest("/"))
+		if rr.Code != expected {
+			t.Errorf("Request %v should be served by the new limiter with status %v. Got: %v", i+1, expected, rr.Code)
+		}
+	}
+
+	select {
+	case <-swapped:
+		t.Error("Swap should wait for the requests of the old limiter.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-swapped; err != nil {
+		t.Fatal(err)
+	}
+	if !old.IsDraining() {
+		t.Error("Old limiter should be drained.")
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rw := NewResponseWriter(rr)
+
+	var w http.ResponseWriter = rw
+	if _, ok := w.(http.Flusher); !ok {
+		t.Fatal("ResponseWriter should be a http.Flusher.")
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte("hello "))
+	if _, err := rw.ReadFrom(strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	rw.Flush()
+
+	if rw.StatusCode != http.StatusCreated || rw.BytesWritten != 11 || rr.Body.String() != "hello world" {
+		t.Errorf("Status and bytes are not recorded correctly. Status: %v, bytes: %v", rw.StatusCode, rw.BytesWritten)
+	}
+	if !rr.Flushed {
+		t.Error("Flush should be passed through.")
+	}
+	if _, _, err := rw.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack should not be supported by a recorder. Got: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	dw := DownloadWriter(context.Background(), NewLimiter(1, nil).SetDownloadRate(1000), "127.0.0.1", rr)
+	if _, ok := dw.(http.Hijacker); !ok {
+		t.Error("DownloadWriter should pass Hijack through.")
+	}
+
+	if _, err := dw.(io.ReaderFrom).ReadFrom(strings.NewReader("paced")); err != nil {
+		t.Fatal(err)
+	}
+	dw.(http.Flusher).Flush()
+
+	if rr.Body.String() != "paced" || !rr.Flushed {
+		t.Errorf("DownloadWriter should pass ReadFrom and Flush through. Body: %q, flushed: %v", rr.Body.String(), rr.Flushed)
+	}
+}
+
+func TestSummaryHandler(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	search := lmt.ForRoute("search")
+
+	for _, remoteAddr := range []string{"10.1.2.3:12345", "10.1.2.3:12345", "10.1.2.3:12345", "10.1.2.4:12345", "10.1.2.4:12345"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		LimitByRequest(lmt, httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	SummaryHandler(1, lmt, search).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var summaries []limiter.Summary
+	if err := json.Unmarshal(rr.Body.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summaries) != 2 || summaries[1].Route != "search" || summaries[1].Allowed != 0 {
+		t.Fatalf("Every route should count on its own. Got: %+v", summaries)
+	}
+
+	expected := []limiter.KeyCount{{Key: "10.1.2.3|/|", Limited: 2}}
+	if summary := summaries[0]; summary.Allowed != 2 || summary.Limited != 3 || !reflect.DeepEqual(summary.TopKeys, expected) {
+		t.Errorf("Decisions are not counted correctly. Got: %+v", summary)
+	}
+
+	rr = httptest.NewRecorder()
+	SummaryHandler(1, lmt).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/?format=html", nil))
+	if !strings.Contains(rr.Body.String(), "<td>10.1.2.3|/|</td><td>2</td>") {
+		t.Errorf("HTML summary should list the top keys. Got: %v", rr.Body.String())
+	}
+}
+
+func TestWaitMode(t *testing.T) {
+	lmt := NewLimiter(20, nil).
+		SetBurst(1).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetWaitMode(time.Second, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Fatalf("The first request should be admitted. Got: %v", httpError)
+	}
+
+	start := time.Now()
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Fatalf("Requests should wait for a token instead of being rejected. Got: %v", httpError)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Requests should wait until a token is refilled. Waited: %v", waited)
+	}
+
+	// Hold the only place in the queue.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lmt.WaitTurn(context.Background(), "other", 0, time.Millisecond, func() bool { return false })
+	}()
+	for lmt.WaitQueueLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	httpError := LimitByRequest(lmt, rr, req)
+	if httpError == nil || httpError.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Requests should be rejected when the queue is full. Got: %v", httpError)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Retry-After should account for the queued requests. Got: %v", retryAfter)
+	}
+
+	<-done
+}
+
+func TestWaitModeRetryAfterPerKey(t *testing.T) {
+	lmt := NewLimiter(0.5, nil).
+		SetBurst(1).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetWaitMode(time.Second, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Fatalf("The first request should be admitted. Got: %v", httpError)
+	}
+
+	// Another key holds the only place in the queue.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lmt.WaitTurn(context.Background(), "other", 0, time.Millisecond, func() bool { return false })
+	}()
+	for lmt.WaitQueueLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	if httpError := LimitByRequest(lmt, rr, req); httpError == nil {
+		t.Fatal("Requests should be rejected when the queue is full.")
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Retry-After should only account for the queued requests of the key. Got: %v", retryAfter)
+	}
+
+	<-done
+}
+
+func TestRegion(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetRegion("eu-west-1")
+
+	if err := lmt.SetRegionLimits(map[string]limiter.Rate{"eu-west-1": {Max: 2, Per: time.Second, Burst: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	for i := 0; i < 2; i++ {
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+			t.Errorf("Requests within the region rate should be allowed. Got: %v", httpError)
+		}
+	}
+
+	_, info := LimitByRequestWithInfo(lmt, httptest.NewRecorder(), req)
+	if info.Key != "127.0.0.1|/|eu-west-1|" {
+		t.Errorf("The region should be part of the key. Key: %v", info.Key)
+	}
+	if info.Limit != 2 {
+		t.Errorf("The region rate should replace the limiter-wide rate. Limit: %v", info.Limit)
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetBurst(2).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	called := false
+	handler := LimitHandler(lmt, LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !called {
+		t.Fatal("The request should be admitted.")
+	}
+	if state, _ := lmt.InspectKey("127.0.0.1|/|"); state.Tokens < 0.9 {
+		t.Errorf("Nested middlewares should charge a request only once. Tokens: %v", state.Tokens)
+	}
+
+	// Without a cache, every call decides again.
+	LimitByRequest(lmt, httptest.NewRecorder(), req)
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError == nil {
+		t.Error("Requests without a decision cache should be charged on every call.")
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	lmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	if err := lmt.SetAdaptive(limiter.AdaptiveOptions{
+		Min: 1, Increase: 1, Decrease: 0.5, LatencyThreshold: time.Second, ErrorRateThreshold: 0.5, Interval: time.Nanosecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lmt.AdaptiveMax() != 50 {
+		t.Errorf("Failed responses should cut the max. Got: %v", lmt.AdaptiveMax())
+	}
+
+	// Slow downloads paced by the download rate are not mistaken for a slow handler.
+	lmt = NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).SetDownloadRate(100000)
+	if err := lmt.SetAdaptive(limiter.AdaptiveOptions{
+		Min: 1, Increase: 1, Decrease: 0.5, LatencyThreshold: 200 * time.Millisecond, Interval: time.Nanosecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler = LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 150000)))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lmt.AdaptiveMax() != 100 {
+		t.Errorf("Download pacing should not count as latency. Got: %v", lmt.AdaptiveMax())
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	cpu := 0.9
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetLoadShedding(limiter.LoadShedding{MaxCPU: 0.8, CPUUtilization: func() float64 { return cpu }})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	rr := httptest.NewRecorder()
+	httpError := LimitByRequest(lmt, rr, req)
+	if httpError == nil || httpError.StatusCode != http.StatusServiceUnavailable || httpError.Message != "Server is overloaded, please try again later." {
+		t.Fatalf("Requests should be shed while overloaded. Got: %v", httpError)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Shed requests should be told when to retry. Retry-After: %v", rr.Header().Get("Retry-After"))
+	}
+	if _, found := lmt.InspectKey("127.0.0.1|/|"); found {
+		t.Error("Shed requests should not spend tokens.")
+	}
+
+	cpu = 0.5
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("Requests should be limited as usual once the load drops. Got: %v", httpError)
+	}
+}
+
+func TestWaitBudgetHeader(t *testing.T) {
+	lmt := NewLimiter(10, nil).
+		SetBurst(1).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetWaitMode(time.Second, 5).
+		SetWaitBudgetHeader("X-Client-Wait-Budget")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	LimitByRequest(lmt, httptest.NewRecorder(), req)
+
+	req.Header.Set("X-Client-Wait-Budget", "10")
+	start := time.Now()
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError == nil || httpError.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Requests should be rejected when no token would come within their budget. Got: %v", httpError)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("Requests with a too small budget should be rejected right away. Waited: %v", waited)
+	}
+
+	req.Header.Set("X-Client-Wait-Budget", "500ms")
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Errorf("Requests should wait within their budget. Got: %v", httpError)
+	}
+}
+
+func TestBeforeAndAfterAuth(t *testing.T) {
+	type userKey struct{}
+
+	ipLmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	userLmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.Header.Get("X-User"); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	identity := func(ctx context.Context) (string, bool) {
+		user, found := ctx.Value(userKey{}).(string)
+		return user, found
+	}
+
+	handler := BeforeAuth(ipLmt)(auth(AfterAuth(userLmt, identity)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	request := func(remoteAddr, user string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-User", user)
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := request("127.0.0.1:12345", "alice"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if _, found := userLmt.InspectKey("alice|/|"); !found {
+		t.Error("Authenticated requests should be limited by identity.")
+	}
+
+	// Same user from another IP address shares the budget.
+	if code := request("127.0.0.2:12345", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Anonymous requests fall back to the IP address.
+	if code := request("127.0.0.3:12345", ""); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if _, found := ipLmt.InspectKey("127.0.0.3|/|"); !found {
+		t.Error("Requests should be limited by IP address before authentication.")
+	}
+
+	// Limiters mounted inside of AfterAuth did not opt in, and keep limiting by IP address.
+	innerLmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	handler = auth(AfterAuth(NewLimiter(100, nil), identity)(LimitHandler(innerLmt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+	if code := request("127.0.0.4:12345", "bob"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if _, found := innerLmt.InspectKey("127.0.0.4|/|"); !found {
+		t.Error("Other limiters should not be limited by identity.")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	lmt := NewLimiter(1, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"})
+	if err := lmt.SetLimits(
+		limiter.Rate{Max: 3, Per: time.Hour, Burst: 3},
+		limiter.Rate{Max: 10, Per: time.Second, Burst: 10},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	for i := 0; i < 3; i++ {
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+			t.Errorf("Requests within every window should be admitted. Got: %v", httpError)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	if httpError := LimitByRequest(lmt, rr, req); httpError == nil {
+		t.Error("Requests should be rejected once the hourly window is spent.")
+	}
+	if policy := rr.Header().Get("RateLimit-Policy"); policy != "3;w=3600" {
+		t.Errorf("The headers should describe the strictest window. RateLimit-Policy: %v", policy)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "1200" {
+		t.Errorf("Retry-After should follow the strictest window. Got: %v", retryAfter)
+	}
+
+	if state, _ := lmt.InspectKey("127.0.0.1|/|"); state.Tokens < 6.9 {
+		t.Errorf("Rejected requests should not take tokens from any window. Tokens: %v", state.Tokens)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMethods([]string{http.MethodPost}).
+		SetMinInterval(5 * time.Second)
+
+	req := httptest.NewRequest(http.MethodPost, "/password-reset", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+		t.Fatalf("The first request should be admitted. Got: %v", httpError)
+	}
+
+	rr := httptest.NewRecorder()
+	if httpError := LimitByRequest(lmt, rr, req); httpError == nil {
+		t.Error("A second request within the minimum interval should be rejected.")
+	}
+	if policy := rr.Header().Get("RateLimit-Policy"); policy != "1;w=5" {
+		t.Errorf("The headers should describe one request per interval. RateLimit-Policy: %v", policy)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "5" {
+		t.Errorf("Retry-After should be the minimum interval. Got: %v", retryAfter)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/password-reset", nil)
+	get.RemoteAddr = "127.0.0.1:12345"
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), get); httpError != nil {
+		t.Errorf("Other methods should not be debounced. Got: %v", httpError)
+	}
+}
+
+func TestCostFunc(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetBurst(10).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetCostFunc(func(r *http.Request) int { return 4 })
+
+	req := httptest.NewRequest(http.MethodGet, "/export", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	for _, remaining := range []string{"6", "2"} {
+		rr := httptest.NewRecorder()
+		if httpError := LimitByRequest(lmt, rr, req); httpError != nil {
+			t.Fatalf("Costly requests within the burst should be admitted. Got: %v", httpError)
+		}
+		if rr.Header().Get("RateLimit-Remaining") != remaining {
+			t.Errorf("RateLimit-Remaining should reflect the cost. Expected: %v, got: %v", remaining, rr.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	if httpError := LimitByRequest(lmt, rr, req); httpError == nil {
+		t.Error("Costly requests should be rejected once fewer tokens than their cost are left.")
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "4" {
+		t.Errorf("Retry-After should leave time for every token of the request. Got: %v", retryAfter)
+	}
+}
+
+func TestMaxFunc(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetMaxFunc(func(key string, r *http.Request) float64 {
+			if r.Header.Get("X-Plan") == "premium" {
+				return 3
+			}
+			return 0
+		})
+
+	premium := httptest.NewRequest(http.MethodGet, "/", nil)
+	premium.RemoteAddr = "127.0.0.1:12345"
+	premium.Header.Set("X-Plan", "premium")
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		if httpError := LimitByRequest(lmt, rr, premium); httpError != nil {
+			t.Fatalf("Premium requests within their max should be admitted. Got: %v", httpError)
+		}
+		if rr.Header().Get("RateLimit-Limit") != "3" {
+			t.Errorf("The headers should describe the max of the key. RateLimit-Limit: %v", rr.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	basic := httptest.NewRequest(http.MethodGet, "/", nil)
+	basic.RemoteAddr = "127.0.0.2:12345"
+
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), basic); httpError != nil {
+		t.Errorf("The first basic request should be admitted. Got: %v", httpError)
+	}
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), basic); httpError == nil {
+		t.Error("Basic requests should keep the max of the limiter.")
+	}
+}
+
+func TestBurstFunc(t *testing.T) {
+	lmt := NewLimiter(1, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetBurstFunc(func(key string, r *http.Request) int {
+			if _, _, ok := r.BasicAuth(); ok {
+				return 3
+			}
+			return 0
+		})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.SetBasicAuth("didip", "secret")
+
+	for i := 0; i < 3; i++ {
+		if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError != nil {
+			t.Fatalf("Authenticated requests within their burst should be admitted. Got: %v", httpError)
+		}
+	}
+	if httpError := LimitByRequest(lmt, httptest.NewRecorder(), req); httpError == nil {
+		t.Error("Authenticated requests over their burst should be rejected.")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	lmt := NewLimiter(100, nil).
+		SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).
+		SetQuotaExhaustedResponse("Daily quota exhausted.", http.StatusForbidden)
+	if err := lmt.SetQuota(limiter.Quota{Allowance: 2, Period: limiter.QuotaDaily}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		if httpError := LimitByRequest(lmt, rr, req); httpError != nil {
+			t.Fatalf("Requests within the quota should be admitted. Got: %v", httpError)
+		}
+		if remaining := rr.Header().Get("X-Quota-Remaining"); remaining != strconv.Itoa(1-i) {
+			t.Errorf("X-Quota-Remaining has wrong value: got %s want %d", remaining, 1-i)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	httpError := LimitByRequest(lmt, rr, req)
+	if httpError == nil || httpError.StatusCode != http.StatusForbidden || httpError.Message != "Daily quota exhausted." {
+		t.Fatalf("Requests over the quota should get the quota response. Got: %v", httpError)
+	}
+	if rr.Header().Get("X-Quota-Limit") != "2" || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Quota headers are incorrect. Got: %v", rr.Header())
+	}
+}
+
+func TestQuotaRefundsTokens(t *testing.T) {
+	lmt := NewLimiter(3, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).SetGlobalMax(2)
+	if err := lmt.SetQuota(limiter.Quota{Allowance: 1, Period: limiter.QuotaDaily}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(remoteAddr string) (bool, limiter.Info) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		httpError, info := LimitByRequestWithInfo(lmt, httptest.NewRecorder(), req)
+		return httpError == nil, info
+	}
+
+	if admitted, info := request("127.0.0.1:12345"); !admitted || info.Remaining != 2 {
+		t.Fatalf("Requests within the quota should be admitted. Got: %v, %+v", admitted, info)
+	}
+
+	// Over its quota, the request keeps the short-term budget of the client.
+	if admitted, info := request("127.0.0.1:12345"); admitted || info.Remaining != 2 {
+		t.Errorf("Requests over the quota should be rejected and refunded. Got: %v, %+v", admitted, info)
+	}
+
+	// The service-level token taken by the rejected request was given back.
+	if admitted, _ := request("127.0.0.2:12345"); !admitted {
+		t.Error("Requests over the quota should not eat into the service-level limit.")
+	}
+}
+
+func TestQuotaSpansPaths(t *testing.T) {
+	lmt := NewLimiter(100, nil).SetIPLookup(limiter.IPLookup{Name: "RemoteAddr"}).SetMethods([]string{"GET", "POST"})
+	if err := lmt.SetQuota(limiter.Quota{Allowance: 3, Period: limiter.QuotaDaily}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path, remoteAddr string) bool {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		return LimitByRequest(lmt, httptest.NewRecorder(), req) == nil
+	}
+
+	// Every path and method spends the same quota of the client.
+	for i, path := range []string{"/a", "/b", "/c"} {
+		if !request(http.MethodGet, path, "127.0.0.1:12345") {
+			t.Fatalf("Request %d within the quota should be admitted.", i+1)
+		}
+	}
+	if request(http.MethodPost, "/d", "127.0.0.1:12345") {
+		t.Error("Quota should span every path and method of a client.")
+	}
+
+	if !request(http.MethodGet, "/a", "127.0.0.2:12345") {
+		t.Error("Other clients should have their own quota.")
+	}
+}